@@ -4,10 +4,18 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
 	"github.com/hironobu-s/conoha-net/conoha"
+	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
@@ -70,6 +78,240 @@ var commands = []cli.Command{
 		Action:    runCmd,
 	},
 
+	{
+		Name:    "list-address-pairs",
+		Aliases: []string{},
+		Usage:   "list allowed address pairs of VPS port",
+		Flags: append(queryVpsFlags,
+			cli.StringFlag{
+				Name:  "port-id",
+				Usage: "Port UUID. The port connected to global network is used by default.",
+			},
+		),
+		Action: runCmd,
+	},
+
+	{
+		Name:    "add-address-pair",
+		Aliases: []string{},
+		Usage:   "add an allowed address pair to VPS port",
+		Flags: append(queryVpsFlags,
+			cli.StringFlag{
+				Name:  "port-id",
+				Usage: "Port UUID. The port connected to global network is used by default.",
+			},
+			cli.StringFlag{
+				Name:  "mac, m",
+				Usage: "MAC address of the pair. The MAC address of the port is used by default.",
+			},
+		),
+		ArgsUsage: "ip-address-or-cidr",
+		Action:    runCmd,
+	},
+
+	{
+		Name:    "remove-address-pair",
+		Aliases: []string{},
+		Usage:   "remove an allowed address pair from VPS port",
+		Flags: append(queryVpsFlags,
+			cli.StringFlag{
+				Name:  "port-id",
+				Usage: "Port UUID. The port connected to global network is used by default.",
+			},
+			cli.StringFlag{
+				Name:  "mac, m",
+				Usage: "MAC address of the pair. If omitted, the pairs are removed regardless of MAC address.",
+			},
+		),
+		ArgsUsage: "ip-address-or-cidr",
+		Action:    runCmd,
+	},
+
+	{
+		Name:    "add-fixed-ip",
+		Aliases: []string{},
+		Usage:   "add a fixed IP address to VPS port",
+		Flags: append(queryVpsFlags,
+			cli.StringFlag{
+				Name:  "port-id",
+				Usage: "Port UUID. The port connected to global network is used by default.",
+			},
+			cli.StringFlag{
+				Name:  "subnet-id",
+				Usage: "Subnet UUID of the address. Neutron detects it from the address by default.",
+			},
+		),
+		ArgsUsage: "ip-address",
+		Action:    runCmd,
+	},
+
+	{
+		Name:    "remove-fixed-ip",
+		Aliases: []string{},
+		Usage:   "remove a fixed IP address from VPS port",
+		Flags: append(queryVpsFlags,
+			cli.StringFlag{
+				Name:  "port-id",
+				Usage: "Port UUID. The port connected to global network is used by default.",
+			},
+		),
+		ArgsUsage: "ip-address",
+		Action:    runCmd,
+	},
+
+	{
+		Name:    "allow-me",
+		Aliases: []string{},
+		Usage:   "allow the access from your public IP address to VPS temporarily",
+		Flags: append(queryVpsFlags,
+			cli.StringFlag{
+				Name:  "port, p",
+				Usage: "Port or port range to allow.",
+				Value: "22",
+			},
+			cli.StringFlag{
+				Name:  "protocol, P",
+				Usage: "Protocol to allow.",
+				Value: "tcp",
+			},
+			cli.StringFlag{
+				Name:  "for",
+				Usage: `Duration of the access. (e.g. "30m", "1h") The expired rules are deleted by "reap" command.`,
+				Value: "1h",
+			},
+			cli.StringFlag{
+				Name:  "source-ip",
+				Usage: "Your IP address. It is determined by --ip-service if omitted. (--ip specifies VPS, as in the other commands.)",
+			},
+			cli.StringFlag{
+				Name:  "ip-service",
+				Usage: "URL of the service that returns your public IP address as plain text.",
+				Value: conoha.DEFAULT_IP_SERVICE,
+			},
+			cli.StringFlag{
+				Name:  "user",
+				Usage: "User name of the access. OS user name is used by default.",
+			},
+		),
+		Action: runCmd,
+	},
+
+	{
+		Name:    "revoke-me",
+		Aliases: []string{},
+		Usage:   "revoke the accesses allowed by allow-me",
+		Flags: append(queryVpsFlags,
+			cli.StringFlag{
+				Name:  "user",
+				Usage: "User name of the access. OS user name is used by default.",
+			},
+		),
+		Action: runCmd,
+	},
+
+	{
+		Name:    "check",
+		Aliases: []string{},
+		Usage:   "check whether a packet would be allowed by the security groups of VPS",
+		Flags: append(queryVpsFlags,
+			cli.StringFlag{
+				Name:  "from",
+				Usage: "Source address of the ingress packet.",
+			},
+			cli.StringFlag{
+				Name:  "to",
+				Usage: "Destination address of the egress packet.",
+			},
+			cli.StringFlag{
+				Name:  "proto",
+				Usage: `Protocol of the packet. (e.g. "tcp", "udp", "icmp", "gre")`,
+				Value: "tcp",
+			},
+			cli.StringFlag{
+				Name:  "port",
+				Usage: `Destination port of the packet. For ICMP, the type and code. (e.g. "5432", "echo-request")`,
+			},
+			cli.StringFlag{
+				Name:  "direction",
+				Usage: `Direction of the packet. Must be either "ingress" or "egress".`,
+				Value: "ingress",
+			},
+			cli.StringFlag{
+				Name:  "port-id",
+				Usage: "Port ID of VPS. It is chosen from the address of the other end if omitted.",
+			},
+		),
+		Action: runCmd,
+	},
+
+	{
+		Name:    "matrix",
+		Aliases: []string{},
+		Usage:   "show which VPS can reach which VPS on the ports",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "ports,p",
+				Usage: `Comma separated services. The protocol is TCP if omitted. (e.g. "22,tcp/5432,udp/53,icmp/echo-request")`,
+				Value: "22",
+			},
+			cli.StringFlag{
+				Name:  "format,f",
+				Usage: `Output format. Must be either "table", "csv" or "dot".`,
+				Value: "table",
+			},
+		},
+		Action: runCmd,
+	},
+
+	{
+		Name:    "graph",
+		Aliases: []string{},
+		Usage:   "draw VPS, security groups and the rules as a diagram",
+		Flags: append(queryVpsFlags,
+			cli.StringFlag{
+				Name:  "format,f",
+				Usage: `Output format. Must be either "dot" or "mermaid".`,
+				Value: "dot",
+			},
+			cli.BoolFlag{
+				Name:  "collapse-system",
+				Usage: "Draw the system groups as a single node without their rules.",
+			},
+		),
+		Action: runCmd,
+	},
+
+	{
+		Name:    "who-can-reach",
+		Aliases: []string{},
+		Usage:   "list the sources granted the access to the port of VPS",
+		Flags: append(queryVpsFlags,
+			cli.StringFlag{
+				Name:  "proto",
+				Usage: `Protocol of the service. (e.g. "tcp", "udp", "icmp")`,
+				Value: "tcp",
+			},
+			cli.StringFlag{
+				Name:  "port",
+				Usage: `Port of the service. For ICMP, the type and code. (e.g. "443", "echo-request")`,
+			},
+		),
+		Action: runCmd,
+	},
+
+	{
+		Name:    "reach-from",
+		Aliases: []string{},
+		Usage:   "list the ports of VPS that the IP address is permitted to reach",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "ip",
+				Usage: "Source IP address.",
+			},
+		},
+		Action: runCmd,
+	},
+
 	// ---------
 
 	{
@@ -81,6 +323,147 @@ var commands = []cli.Command{
 				Name:  "all,a",
 				Usage: "List all security groups (including system groups).",
 			},
+			cli.BoolFlag{
+				Name:  "expression,x",
+				Usage: `Print rules as rule expressions. (e.g. "in tcp/22 from 1.2.3.0/24")`,
+			},
+			cli.BoolFlag{
+				Name:  "groups,G",
+				Usage: "List security groups only (not rules).",
+			},
+			cli.StringFlag{
+				Name:  "selector,l",
+				Usage: `Filter by labels. Labels of the group are inherited by its rules. (e.g. "owner=payments", "env!=prod,ticket")`,
+			},
+			cli.StringFlag{
+				Name:  "name",
+				Usage: `Filter by the glob pattern of the group name. (e.g. "web-*")`,
+			},
+			cli.StringFlag{
+				Name:  "direction",
+				Usage: `Filter by the direction. ("ingress" or "egress")`,
+			},
+			cli.StringFlag{
+				Name:  "ether-type",
+				Usage: `Filter by the ether type. ("IPv4" or "IPv6")`,
+			},
+			cli.StringFlag{
+				Name:  "proto",
+				Usage: `Filter by the protocol. Rules of all protocols are also matched. (e.g. "tcp")`,
+			},
+			cli.IntFlag{
+				Name:  "port",
+				Usage: "Filter the rules that allow the port. (e.g. 8080 matches 8000-9000)",
+			},
+			cli.StringFlag{
+				Name:  "cidr",
+				Usage: `Filter the rules whose remote prefix contains the CIDR or IP address. (e.g. "10.1.2.3")`,
+			},
+			cli.StringFlag{
+				Name:  "overlaps",
+				Usage: `Filter the rules whose remote prefix overlaps the CIDR. (e.g. "192.168.0.0/16")`,
+			},
+			cli.StringFlag{
+				Name:  "remote-group",
+				Usage: "Filter the rules that refer to the remote group.",
+			},
+		},
+		Action: runCmd,
+	},
+
+	{
+		Name:    "snapshot",
+		Aliases: []string{},
+		Usage:   "save, restore, list or delete the snapshots of security groups and attachments",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Show the changes to restore without applying them.",
+			},
+			cli.BoolFlag{
+				Name:  "force,f",
+				Usage: "Overwrite the existing snapshot on save.",
+			},
+		},
+		ArgsUsage: "save|restore|delete snapshot-name | list",
+		Action:    runCmd,
+	},
+
+	{
+		Name:      "diff",
+		Aliases:   []string{},
+		Usage:     `compare two snapshots, or a snapshot and the current state ("live")`,
+		ArgsUsage: "snapshot-name snapshot-name|live",
+		Action:    runCmd,
+	},
+
+	{
+		Name:    "audit-log",
+		Aliases: []string{},
+		Usage:   "query the local journal of the changes of security groups and attachments",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "since",
+				Usage: `Show the records at or after the time. RFC3339, date or duration before now. (e.g. "2006-01-02", "24h", "7d")`,
+			},
+			cli.StringFlag{
+				Name:  "until",
+				Usage: "Show the records before the time",
+			},
+			cli.StringFlag{
+				Name:  "group, g",
+				Usage: "Security group name or UUID",
+			},
+			cli.StringFlag{
+				Name:  "vps",
+				Usage: "VPS name or UUID",
+			},
+			cli.StringFlag{
+				Name:  "operation",
+				Usage: "Operation. (create-group, delete-group, create-rule, delete-rule, attach, detach or update-port)",
+			},
+		},
+		Action: runCmd,
+	},
+
+	{
+		Name:      "undo",
+		Aliases:   []string{},
+		Usage:     "undo the most recent (or the specified) operation in the journal",
+		ArgsUsage: "[journal-record-id]",
+		Action:    runCmd,
+	},
+
+	{
+		Name:    "watch",
+		Aliases: []string{},
+		Usage:   "watch the drift from the baseline snapshot and the policy violations",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "baseline, b",
+				Usage: "Snapshot name of the baseline. The latest snapshot is used by default, or the state at start if no snapshot is saved.",
+			},
+			cli.StringFlag{
+				Name:  "policy",
+				Usage: "Policy file to check. The global --policy is used by default.",
+			},
+			cli.DurationFlag{
+				Name:  "interval",
+				Value: 5 * time.Minute,
+				Usage: "Interval of the checks",
+			},
+			cli.StringSliceFlag{
+				Name:  "notify",
+				Usage: `Notifier of the drift. "stdout", "jsonl:<file>" or "webhook:<url>". Can be specified multiple times. (default: stdout)`,
+			},
+			cli.BoolFlag{
+				Name:  "remediate",
+				Usage: "Restore the baseline snapshot when the drift is detected",
+			},
+			cli.BoolFlag{
+				Name:  "once",
+				Usage: "Check once and exit",
+			},
 		},
 		Action: runCmd,
 	},
@@ -94,6 +477,10 @@ var commands = []cli.Command{
 				Name:  "description,d",
 				Usage: "Description of security group",
 			},
+			cli.StringSliceFlag{
+				Name:  "label,l",
+				Usage: `Label of security group in "key=value" format. Can be specified multiple times.`,
+			},
 		},
 		ArgsUsage: "security-group-name",
 		Action:    runCmd,
@@ -120,53 +507,165 @@ var commands = []cli.Command{
 
 			cli.StringFlag{
 				Name:  "e,ether-type",
-				Usage: `(Required) Type of IP version. Must be either "Ipv4" or "Ipv6".`,
-				Value: "IPv4",
+				Usage: `Type of IP version. Must be "IPv4", "IPv6" or "both". Detected from the remote IP prefix if omitted (IPv4 by default).`,
 			},
 
 			cli.StringFlag{
 				Name:  "p,port-range",
-				Usage: ` The source port or port range. For example "80", "80-8080".`,
+				Usage: ` The source port, port range or comma-separated list of them. For example "80", "80-8080", "80,443,8000-8100". For ICMP, the type and code. For example "echo-request", "3/4".`,
 			},
 
 			cli.StringFlag{
 				Name:  "P,protocol",
-				Usage: ` The IP protocol. Valid value are "tcp", "udp", "icmp" or "all".`,
+				Usage: ` The IP protocol. Valid value are "tcp", "udp", "icmp", "icmpv6", "all", the IANA protocol name (e.g. "gre") or number.`,
 				Value: "all",
 			},
 
 			cli.StringFlag{
-				Name:  "g,remote-group-id",
-				Usage: ` The remote group ID to be associated with this rule.`,
+				Name:  "g,remote-group-id,remote-group",
+				Usage: ` The remote group name or ID to be associated with this rule.`,
 			},
 
 			cli.StringFlag{
 				Name:  "i,remote-ip-prefix",
 				Usage: ` The IP prefix to be associated with this rule.`,
 			},
+
+			cli.StringFlag{
+				Name:  "description",
+				Usage: ` Description of this rule. (e.g. why the rule exists)`,
+			},
+
+			cli.StringSliceFlag{
+				Name:  "l,label",
+				Usage: ` Label of this rule in "key=value" format. (e.g. "owner=payments") Can be specified multiple times.`,
+			},
+
+			cli.StringFlag{
+				Name:  "ttl",
+				Usage: ` Time to live of this rule. (e.g. "30m", "2h", "7d") The expired rules are deleted by "reap" command.`,
+			},
+
+			cli.StringSliceFlag{
+				Name:  "except-ip-prefix",
+				Usage: ` The IP prefix or address to be excepted from the remote IP prefix (any address if omitted). Can be specified multiple times. The rules are created as a bundle.`,
+			},
+
+			cli.StringFlag{
+				Name:  "bundle",
+				Usage: ` Name of the bundle. The rules of the existing bundle are replaced. Generated if omitted.`,
+			},
 		},
-		ArgsUsage: "security-group-name",
+		ArgsUsage: `security-group-name [rule-expression (e.g. "in tcp/22 from 1.2.3.0/24")]`,
 		Action:    runCmd,
 	},
 
 	{
-		Name:      "delete-rule",
-		Aliases:   []string{},
-		Usage:     "delete a security group rule",
-		ArgsUsage: "uuid-of-rule",
+		Name:    "delete-rule",
+		Aliases: []string{},
+		Usage:   "delete a security group rule",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "bundle",
+				Usage: "Delete all rules of the bundle in the security group.",
+			},
+		},
+		ArgsUsage: "uuid-of-rule | security-group-name --bundle bundle-name",
 		Action:    runCmd,
 	},
-}
-
-var openstack *conoha.OpenStack
 
-func runCmd(c *cli.Context) (err error) {
-	// Run
-	switch c.Command.Name {
-	case "create-rule":
-		err = cmdCreateRule(c)
-	case "delete-rule":
-		err = cmdDeleteRule(c)
+	{
+		Name:    "reap",
+		Aliases: []string{},
+		Usage:   "delete the expired rules created with --ttl",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "List the expired rules without deleting them.",
+			},
+		},
+		Action: runCmd,
+	},
+
+	{
+		Name:    "optimize",
+		Aliases: []string{},
+		Usage:   "merge the adjacent and overlapping prefixes and port ranges of the rules",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Show the changes without applying them.",
+			},
+		},
+		ArgsUsage: "security-group-name",
+		Action:    runCmd,
+	},
+
+	{
+		Name:    "lint",
+		Aliases: []string{},
+		Usage:   "report duplicate and shadowed rules, empty and unattached groups",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "fail-on",
+				Usage: `Exit with non-zero status if there are the findings at or above the severity. Must be "info", "warning", "error" or "none".`,
+				Value: conoha.SEVERITY_ERROR,
+			},
+		},
+		Action: runCmd,
+	},
+
+	{
+		Name:    "audit",
+		Aliases: []string{},
+		Usage:   "report the services of VPS reachable from any address in Markdown (or JSON with -o json)",
+		Action:  runCmd,
+	},
+}
+
+var openstack *conoha.OpenStack
+
+// Create OpenStack with the policy given by the global options.
+func newOpenStack(c *cli.Context) (*conoha.OpenStack, error) {
+	stack, err := conoha.NewOpenStack()
+	if err != nil {
+		return nil, err
+	}
+
+	file := c.GlobalString("policy")
+	if c.String("policy") != "" {
+		file = c.String("policy")
+	}
+	if file != "" {
+		stack.Policy, err = conoha.LoadPolicy(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	stack.PolicyOverride = c.GlobalString("override-policy")
+
+	if stack.Journal, err = conoha.DefaultJournal(); err != nil {
+		return nil, err
+	}
+
+	return stack, nil
+}
+
+func runCmd(c *cli.Context) (err error) {
+	// Run
+	switch c.Command.Name {
+	case "create-rule":
+		err = cmdCreateRule(c)
+	case "delete-rule":
+		err = cmdDeleteRule(c)
+	case "reap":
+		err = cmdReap(c)
+	case "optimize":
+		err = cmdOptimize(c)
+	case "lint":
+		err = cmdLint(c)
+	case "audit":
+		err = cmdAudit(c)
 
 	case "list-group":
 		err = cmdListGroup(c)
@@ -182,6 +681,35 @@ func runCmd(c *cli.Context) (err error) {
 	case "detach":
 		err = cmdAttachOrDetach(c, "detach")
 
+	case "list-address-pairs", "add-address-pair", "remove-address-pair":
+		err = cmdAddressPairs(c)
+	case "add-fixed-ip", "remove-fixed-ip":
+		err = cmdFixedIP(c)
+	case "allow-me":
+		err = cmdAllowMe(c)
+	case "revoke-me":
+		err = cmdRevokeMe(c)
+	case "check":
+		err = cmdCheck(c)
+	case "matrix":
+		err = cmdMatrix(c)
+	case "graph":
+		err = cmdGraph(c)
+	case "who-can-reach":
+		err = cmdWhoCanReach(c)
+	case "reach-from":
+		err = cmdReachFrom(c)
+	case "snapshot":
+		err = cmdSnapshot(c)
+	case "diff":
+		err = cmdDiff(c)
+	case "watch":
+		err = cmdWatch(c)
+	case "audit-log":
+		err = cmdAuditLog(c)
+	case "undo":
+		err = cmdUndo(c)
+
 	default:
 		return fmt.Errorf("Unimplemented command. [%s]", c.Command.Name)
 	}
@@ -211,298 +739,1643 @@ func queryVps(c *cli.Context) (*conoha.Vps, error) {
 	}
 }
 
-func cmdCreateRule(c *cli.Context) (err error) {
-	openstack, err = conoha.NewOpenStack()
-	if err != nil {
-		return err
+func cmdCreateRule(c *cli.Context) (err error) {
+	openstack, err = newOpenStack(c)
+	if err != nil {
+		return err
+	}
+
+	var name string
+	if len(c.Args()) > 0 {
+		name = c.Args()[0]
+	} else {
+		name = ""
+	}
+
+	var rule conoha.RuleCreateOpts
+	if len(c.Args()) > 1 {
+		// rule expression. (e.g. "in tcp/22 from 1.2.3.0/24")
+		for _, f := range []string{"direction", "ether-type", "port-range", "protocol", "remote-group-id", "remote-ip-prefix"} {
+			if c.IsSet(f) {
+				return fmt.Errorf(`Can't use "%s" option with the rule expression.`, f)
+			}
+		}
+
+		rule, err = conoha.ParseRule(strings.Join(c.Args()[1:], " "))
+		if err != nil {
+			return err
+		}
+		rule.SecurityGroupName = name
+
+	} else {
+		rule = conoha.RuleCreateOpts{
+			SecurityGroupName: name,
+			Direction:         c.String("direction"),
+			EtherType:         c.String("ether-type"),
+			PortRange:         c.String("port-range"),
+			Protocol:          c.String("protocol"),
+			RemoteGroupID:     c.String("remote-group-id"),
+			RemoteIPPrefix:    c.String("remote-ip-prefix"),
+		}
+	}
+
+	labels := c.StringSlice("label")
+	if c.IsSet("ttl") {
+		ttl, err := conoha.ParseTTL(c.String("ttl"))
+		if err != nil {
+			return err
+		}
+		labels = append(labels, conoha.ExpiryLabels(time.Now().Add(ttl))...)
+	}
+
+	rule.Description, err = conoha.BuildDescription(c.String("description"), labels)
+	if err != nil {
+		return err
+	}
+
+	if c.IsSet("except-ip-prefix") || c.IsSet("bundle") {
+		return createBundle(c, rule)
+	}
+
+	created, err := conoha.CreateRules(openstack, rule)
+	if err != nil {
+		return err
+	}
+
+	data := make([][]string, 0, len(created))
+	jsondata := make([]map[string]string, 0, len(created))
+	for _, rt := range created {
+		data = append(data, []string{rt.ID})
+		jsondata = append(jsondata, map[string]string{"uuid": rt.ID})
+	}
+
+	if c.GlobalString("output") == "json" {
+		return outputJson(jsondata)
+	} else {
+		return outputTable(data)
+	}
+}
+
+// Create or update the bundle of rules that allow the remote IP prefix except --except-ip-prefix.
+func createBundle(c *cli.Context, rule conoha.RuleCreateOpts) (err error) {
+	rs := []conoha.RuleCreateOpts{rule}
+	if c.IsSet("except-ip-prefix") {
+		rs, err = rule.Except(c.StringSlice("except-ip-prefix"))
+		if err != nil {
+			return err
+		}
+	}
+
+	bundle := c.String("bundle")
+	if bundle == "" {
+		bundle = strconv.FormatInt(time.Now().Unix(), 36)
+	}
+
+	created, deleted, err := conoha.ApplyBundle(openstack, rule.SecurityGroupName, bundle, rs)
+	if err != nil {
+		return err
+	}
+
+	data := make([][]string, 0, len(created)+len(deleted)+1)
+	data = append(data, []string{"Bundle", "UUID", "Action"})
+	createdIDs := make([]string, 0, len(created))
+	for _, rt := range created {
+		data = append(data, []string{bundle, rt.ID, "created"})
+		createdIDs = append(createdIDs, rt.ID)
+	}
+	deletedIDs := make([]string, 0, len(deleted))
+	for _, rt := range deleted {
+		data = append(data, []string{bundle, rt.ID, "deleted"})
+		deletedIDs = append(deletedIDs, rt.ID)
+	}
+	jsondata := map[string]interface{}{
+		"bundle":  bundle,
+		"created": createdIDs,
+		"deleted": deletedIDs,
+	}
+
+	if c.GlobalString("output") == "json" {
+		return outputJson(jsondata)
+	} else {
+		return outputTable(data)
+	}
+}
+
+func cmdDeleteRule(c *cli.Context) (err error) {
+	openstack, err = newOpenStack(c)
+	if err != nil {
+		return err
+	}
+
+	if c.IsSet("bundle") {
+		if c.NArg() == 0 {
+			return fmt.Errorf("Please specify the security group name")
+		}
+		_, err = conoha.DeleteBundle(openstack, c.Args()[0], c.String("bundle"))
+		return err
+	}
+
+	// uuid of rule to delete
+	if c.NArg() == 0 {
+		err = fmt.Errorf("Please specify the security group name")
+		return err
+	}
+	uuid := c.Args()[0]
+
+	return conoha.DeleteRule(openstack, uuid)
+}
+
+func cmdReap(c *cli.Context) (err error) {
+	openstack, err = newOpenStack(c)
+	if err != nil {
+		return err
+	}
+
+	reaped, rerr := conoha.Reap(openstack, time.Now(), c.Bool("dry-run"))
+
+	data := make([][]string, 0, len(reaped)+1)
+	jsondata := make([]map[string]interface{}, 0, len(reaped))
+
+	data = append(data, []string{"UUID", "SecurityGroup", "Rule", "Expires"})
+	for _, e := range reaped {
+		var r conoha.RuleCreateOpts
+		r.FromSecGroupRule(e.Rule)
+
+		data = append(data, []string{e.Rule.ID, e.Group.Name, r.String(), e.Expires.Format(time.RFC3339)})
+		jsondata = append(jsondata, map[string]interface{}{
+			"uuid":           e.Rule.ID,
+			"security-group": e.Group.Name,
+			"rule":           r.String(),
+			"expires":        e.Expires.Format(time.RFC3339),
+			"deleted":        !c.Bool("dry-run"),
+		})
+	}
+
+	if c.GlobalString("output") == "json" {
+		err = outputJson(jsondata)
+	} else if len(reaped) > 0 {
+		err = outputTable(data)
+	}
+	if rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func cmdOptimize(c *cli.Context) (err error) {
+	openstack, err = newOpenStack(c)
+	if err != nil {
+		return err
+	}
+
+	if c.NArg() == 0 {
+		return fmt.Errorf("Please specify the security group name")
+	}
+
+	plan, perr := conoha.Optimize(openstack, c.Args()[0], c.Bool("dry-run"))
+	if plan == nil {
+		return perr
+	}
+
+	data := make([][]string, 0, len(plan.Creates)+len(plan.Deletes)+1)
+	changes := make([]map[string]string, 0, len(plan.Creates)+len(plan.Deletes))
+
+	data = append(data, []string{"Action", "UUID", "Rule"})
+	for _, ch := range []struct {
+		action string
+		rules  []rules.SecGroupRule
+	}{
+		{"create", plan.Creates},
+		{"delete", plan.Deletes},
+	} {
+		for _, rule := range ch.rules {
+			var r conoha.RuleCreateOpts
+			r.FromSecGroupRule(rule)
+
+			data = append(data, []string{ch.action, rule.ID, r.String()})
+			changes = append(changes, map[string]string{
+				"action": ch.action,
+				"uuid":   rule.ID,
+				"rule":   r.String(),
+			})
+		}
+	}
+
+	if c.GlobalString("output") == "json" {
+		err = outputJson(map[string]interface{}{
+			"security-group": plan.Group.Name,
+			"before":         len(plan.Before),
+			"after":          len(plan.After),
+			"applied":        !c.Bool("dry-run") && perr == nil,
+			"changes":        changes,
+		})
+	} else {
+		fmt.Fprintf(os.Stdout, "Rules: %d -> %d\n", len(plan.Before), len(plan.After))
+		if plan.HasChanges() {
+			err = outputTable(data)
+		}
+	}
+	if perr != nil {
+		return perr
+	}
+	return err
+}
+
+func cmdLint(c *cli.Context) (err error) {
+	failOn := c.String("fail-on")
+	if failOn != "none" {
+		if _, err = conoha.SeverityLevel(failOn); err != nil {
+			return err
+		}
+	}
+
+	openstack, err = newOpenStack(c)
+	if err != nil {
+		return err
+	}
+
+	findings, err := conoha.LintAll(openstack)
+	if err != nil {
+		return err
+	}
+
+	data := make([][]string, 0, len(findings)+1)
+	jsondata := make([]map[string]interface{}, 0, len(findings))
+
+	data = append(data, []string{"Severity", "Check", "SecurityGroup", "UUID", "Rule", "Message"})
+	for _, f := range findings {
+		var uuid, expr string
+		if f.Rule != nil {
+			var r conoha.RuleCreateOpts
+			r.FromSecGroupRule(*f.Rule)
+			uuid = f.Rule.ID
+			expr = r.String()
+		}
+
+		data = append(data, []string{f.Severity, f.Check, f.Group.Name, uuid, expr, f.Message})
+		jsondata = append(jsondata, map[string]interface{}{
+			"severity":       f.Severity,
+			"check":          f.Check,
+			"security-group": f.Group.Name,
+			"uuid":           uuid,
+			"rule":           expr,
+			"message":        f.Message,
+		})
+	}
+
+	if c.GlobalString("output") == "json" {
+		err = outputJson(jsondata)
+	} else if len(findings) > 0 {
+		err = outputTable(data)
+	}
+	if err != nil || failOn == "none" {
+		return err
+	}
+
+	n, err := conoha.CountFindings(findings, failOn)
+	if err != nil {
+		return err
+	} else if n > 0 {
+		return fmt.Errorf("%d finding(s) at or above %s.", n, failOn)
+	}
+	return nil
+}
+
+func cmdAudit(c *cli.Context) (err error) {
+	openstack, err = newOpenStack(c)
+	if err != nil {
+		return err
+	}
+
+	report, err := conoha.Audit(openstack)
+	if err != nil {
+		return err
+	}
+
+	if c.GlobalString("output") != "json" {
+		_, err = fmt.Fprint(os.Stdout, report.Markdown())
+		return err
+	}
+
+	vpsdata := make([]map[string]interface{}, 0, len(report.Vps))
+	for _, a := range report.Vps {
+		sgs := make([]string, 0, len(a.Groups))
+		for _, sg := range a.Groups {
+			sgs = append(sgs, sg.Name)
+		}
+
+		exposures := make([]map[string]interface{}, 0, len(a.Exposures))
+		for _, e := range a.Exposures {
+			rs := make([]map[string]string, 0, len(e.Rules))
+			for _, er := range e.Rules {
+				var r conoha.RuleCreateOpts
+				r.FromSecGroupRule(er.Rule)
+				rs = append(rs, map[string]string{
+					"uuid":           er.Rule.ID,
+					"security-group": er.Group.Name,
+					"rule":           r.String(),
+				})
+			}
+
+			exposures = append(exposures, map[string]interface{}{
+				"severity":        e.Severity,
+				"ether-type":      e.EtherType,
+				"protocol":        e.Protocol,
+				"port":            e.PortRange(),
+				"sensitive-ports": e.SensitivePorts,
+				"rules":           rs,
+			})
+		}
+
+		vpsdata = append(vpsdata, map[string]interface{}{
+			"name-tag":        a.Vps.NameTag,
+			"ipv4":            ipString(a.Vps.ExternalIPv4Address),
+			"ipv6":            ipString(a.Vps.ExternalIPv6Address),
+			"internet-facing": len(a.Ports) > 0,
+			"security-groups": sgs,
+			"exposures":       exposures,
+		})
+	}
+
+	return outputJson(map[string]interface{}{
+		"generated": report.Generated.Format(time.RFC3339),
+		"vps":       vpsdata,
+	})
+}
+
+// Return the IP address as string, or "" if it's nil.
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+func cmdCheck(c *cli.Context) (err error) {
+	openstack, err = newOpenStack(c)
+	if err != nil {
+		return err
+	}
+
+	vps, err := queryVps(c)
+	if err != nil {
+		return err
+	}
+
+	remote := c.String("from")
+	if c.String("to") != "" {
+		if remote != "" {
+			return fmt.Errorf(`Can't use both "from" and "to" option.`)
+		}
+		remote = c.String("to")
+	}
+	if remote == "" {
+		return fmt.Errorf(`Please specify the address of the other end with "from" or "to" option.`)
+	}
+
+	flow, err := conoha.NewFlow(c.String("direction"), c.String("proto"), c.String("port"), remote)
+	if err != nil {
+		return err
+	}
+
+	result, port, err := conoha.CheckFlow(openstack, vps, flow, c.String("port-id"))
+	if err != nil {
+		return err
+	}
+
+	verdict := "DENIED"
+	if result.Allowed {
+		verdict = "ALLOWED"
+	}
+
+	sgs := make([]string, 0, len(result.Groups))
+	for _, sg := range result.Groups {
+		sgs = append(sgs, sg.Name)
+	}
+
+	data := make([][]string, 0, len(result.Matches)+1)
+	matches := make([]map[string]interface{}, 0, len(result.Matches))
+
+	data = append(data, []string{"UUID", "SecurityGroup", "Rule", "Members"})
+	for _, m := range result.Matches {
+		var r conoha.RuleCreateOpts
+		r.FromSecGroupRule(m.Rule)
+
+		members := make([]string, 0, len(m.Members))
+		for _, member := range m.Members {
+			members = append(members, member.NameTag)
+		}
+
+		data = append(data, []string{m.Rule.ID, m.Group.Name, r.String(), strings.Join(members, ", ")})
+		matches = append(matches, map[string]interface{}{
+			"uuid":           m.Rule.ID,
+			"security-group": m.Group.Name,
+			"rule":           r.String(),
+			"members":        members,
+		})
+	}
+
+	if c.GlobalString("output") == "json" {
+		return outputJson(map[string]interface{}{
+			"verdict":         verdict,
+			"flow":            flow.String(),
+			"port-id":         port.ID,
+			"security-groups": sgs,
+			"rules":           matches,
+		})
+	}
+
+	fmt.Fprintf(os.Stdout, "%s: %s (port %s, groups: %s)\n", verdict, flow, port.ID, strings.Join(sgs, ", "))
+	if result.Allowed {
+		return outputTable(data)
+	}
+	return nil
+}
+
+func cmdListGroup(c *cli.Context) (err error) {
+	openstack, err = newOpenStack(c)
+	if err != nil {
+		return err
+	}
+
+	allgroups, err := conoha.ListGroup(openstack)
+	if err != nil {
+		return err
+	}
+	groups := allgroups
+	if !c.Bool("all") {
+		groups = conoha.RemoveSystemGroups(groups)
+	}
+
+	groupNames := make(map[string]string, len(allgroups))
+	for _, sg := range allgroups {
+		groupNames[sg.ID] = sg.Name
+	}
+
+	// Filter by labels
+	if c.IsSet("selector") {
+		selector, err := conoha.ParseSelector(c.String("selector"))
+		if err != nil {
+			return err
+		}
+		groups = selector.Filter(groups)
+	}
+
+	// Filter by rules
+	matcher, err := ruleMatcher(c)
+	if err != nil {
+		return err
+	}
+	if err = matcher.ResolveRemoteGroup(allgroups); err != nil {
+		return err
+	}
+	if groups, err = matcher.Filter(groups); err != nil {
+		return err
+	}
+
+	// Display
+	data := make([][]string, 0, len(groups))
+	jsondata := make([]map[string]interface{}, 0, len(groups))
+
+	if len(groups) > 0 && c.Bool("groups") {
+		data = append(data, []string{"UUID", "SecurityGroup", "Rules", "Description"})
+		for _, sg := range groups {
+			data = append(data, []string{sg.ID, sg.Name, fmt.Sprintf("%d", len(sg.Rules)), sg.Description})
+			jsondata = append(jsondata, map[string]interface{}{
+				"uuid":           sg.ID,
+				"security-group": sg.Name,
+				"rules":          len(sg.Rules),
+				"description":    sg.Description,
+				"labels":         conoha.ParseAnnotation(sg.Description).Labels,
+			})
+		}
+
+	} else if len(groups) > 0 && c.Bool("expression") {
+		data = append(data, []string{"UUID", "SecurityGroup", "Rule", "Description"})
+		for _, sg := range groups {
+			for _, rule := range sg.Rules {
+				var r conoha.RuleCreateOpts
+				r.FromSecGroupRule(rule)
+
+				expr := r.String()
+				dangling := false
+				if r.RemoteGroupID != "" {
+					if name, ok := groupNames[r.RemoteGroupID]; ok {
+						r.RemoteGroupID = name
+						expr = r.String()
+					} else {
+						dangling = true
+						expr += "  [missing remote group]"
+					}
+				}
+
+				data = append(data, []string{rule.ID, sg.Name, expr, rule.Description})
+				jsondata = append(jsondata, map[string]interface{}{
+					"uuid":           rule.ID,
+					"security-group": sg.Name,
+					"rule":           r.String(),
+					"dangling":       dangling,
+					"description":    rule.Description,
+					"labels":         conoha.MergeLabels(sg.Description, rule.Description),
+				})
+			}
+		}
+
+	} else if len(groups) > 0 {
+		data = append(data, []string{"UUID", "SecurityGroup", "Direction", "EtherType", "Proto", "IP Range", "Port", "Remote", "Description"})
+		for _, sg := range groups {
+			for _, rule := range sg.Rules {
+				cols := make([]string, 0, 9)
+				cols = append(cols, rule.ID, sg.Name, rule.Direction, rule.EtherType)
+
+				jsoncols := map[string]interface{}{
+					"uuid":           rule.ID,
+					"security-group": sg.Name,
+					"direction":      rule.Direction,
+					"ether-type":     rule.EtherType,
+					"proto":          "",
+					"ip-range":       "",
+					"port":           "",
+					"remote":         nil,
+					"description":    rule.Description,
+					"labels":         conoha.MergeLabels(sg.Description, rule.Description),
+				}
+
+				proto := conoha.ProtocolName(rule.Protocol)
+				if rule.Protocol != "" {
+					cols = append(cols, proto)
+					jsoncols["proto"] = proto
+				} else {
+					cols = append(cols, "ALL")
+					jsoncols["proto"] = "ALL"
+				}
+				cols = append(cols, rule.RemoteIPPrefix)
+				jsoncols["ip-range"] = rule.RemoteIPPrefix
+
+				if rule.PortRangeMin == 0 && rule.PortRangeMax == 0 {
+					cols = append(cols, "ALL")
+					jsoncols["port"] = "ALL"
+				} else if proto == "icmp" || proto == "icmpv6" {
+					// ICMP type and code
+					var r conoha.RuleCreateOpts
+					r.FromSecGroupRule(rule)
+					cols = append(cols, r.PortRange)
+					jsoncols["port"] = map[string]interface{}{
+						"name": r.PortRange,
+						"type": rule.PortRangeMin,
+						"code": rule.PortRangeMax,
+					}
+				} else {
+					cols = append(cols, fmt.Sprintf("%d - %d", rule.PortRangeMin, rule.PortRangeMax))
+					jsoncols["port"] = map[string]int{
+						"min": rule.PortRangeMin,
+						"max": rule.PortRangeMax,
+					}
+				}
+
+				// Remote security group
+				if rule.RemoteGroupID == "" {
+					cols = append(cols, "")
+				} else if name, ok := groupNames[rule.RemoteGroupID]; ok {
+					cols = append(cols, name)
+					jsoncols["remote"] = map[string]interface{}{
+						"uuid":     rule.RemoteGroupID,
+						"name":     name,
+						"dangling": false,
+					}
+				} else {
+					cols = append(cols, rule.RemoteGroupID+" (missing)")
+					jsoncols["remote"] = map[string]interface{}{
+						"uuid":     rule.RemoteGroupID,
+						"name":     "",
+						"dangling": true,
+					}
+				}
+				cols = append(cols, rule.Description)
+
+				data = append(data, cols)
+				jsondata = append(jsondata, jsoncols)
+			}
+		}
+
+	} else {
+		data = append(data, []string{"No security groups found"})
+	}
+
+	if c.GlobalString("output") == "json" {
+		return outputJson(jsondata)
+	} else {
+		return outputTable(data)
+	}
+}
+
+func ruleMatcher(c *cli.Context) (m *conoha.RuleMatcher, err error) {
+	m = &conoha.RuleMatcher{
+		GroupPattern: c.String("name"),
+		Port:         c.Int("port"),
+		RemoteGroup:  c.String("remote-group"),
+	}
+
+	if m.Port < 0 || m.Port > 65535 {
+		return nil, fmt.Errorf("Port must be between 1 and 65535. [%d]", m.Port)
+	}
+	if c.String("direction") != "" {
+		if m.Direction, err = conoha.NormalizeDirection(c.String("direction")); err != nil {
+			return nil, err
+		}
+	}
+	if c.String("ether-type") != "" {
+		if m.EtherType, err = conoha.NormalizeEtherType(c.String("ether-type")); err != nil {
+			return nil, err
+		}
+	}
+	if c.String("proto") != "" {
+		if m.Protocol, err = conoha.NormalizeProtocol(c.String("proto")); err != nil {
+			return nil, err
+		}
+	}
+	if c.String("cidr") != "" {
+		if m.Contains, err = conoha.ParseNetwork(c.String("cidr")); err != nil {
+			return nil, err
+		}
+	}
+	if c.String("overlaps") != "" {
+		if m.Overlaps, err = conoha.ParseNetwork(c.String("overlaps")); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func cmdCreateGroup(c *cli.Context) (err error) {
+	openstack, err = newOpenStack(c)
+	if err != nil {
+		return err
+	}
+
+	// description and labels
+	description, err := conoha.BuildDescription(c.String("description"), c.StringSlice("label"))
+	if err != nil {
+		return err
+	}
+
+	// security group name to create
+	if c.NArg() == 0 {
+		err = fmt.Errorf("Please specify the security group name")
+		return err
+	}
+	name := c.Args()[0]
+
+	created, err := conoha.CreateGroup(openstack, name, description)
+	if err != nil {
+		return err
+	}
+
+	if c.GlobalString("output") == "json" {
+		return outputJson(map[string]string{"uuid": created.ID})
+	} else {
+		return outputTable([][]string{[]string{created.ID}})
+	}
+}
+
+func cmdDeleteGroup(c *cli.Context) (err error) {
+	openstack, err = newOpenStack(c)
+	if err != nil {
+		return err
+	}
+
+	// security group name to delete
+	if c.NArg() == 0 {
+		err = fmt.Errorf("Please specify the security group name")
+		return err
+	}
+	name := c.Args()[0]
+
+	return conoha.DeleteGroup(openstack, name)
+}
+
+func cmdList(c *cli.Context) (err error) {
+	openstack, err = newOpenStack(c)
+	if err != nil {
+		return err
+	}
+
+	vpss, err := conoha.ListVps(openstack, nil)
+	if err != nil {
+		return err
+	}
+
+	numVps := len(vpss)
+	data := make([][]string, 0, numVps)
+	jsondata := make([]map[string]interface{}, 0, numVps)
+
+	data = append(data, []string{"NameTag", "IPv4", "IPv6", "SecurityGroups"})
+	for _, vps := range vpss {
+		var buf bytes.Buffer
+		var i = 0
+		sgs := make([]string, 0, len(vps.SecurityGroups))
+		for _, sg := range vps.SecurityGroups {
+			sgs = append(sgs, sg.Name)
+			buf.WriteString(sg.Name)
+			i++
+			if len(vps.SecurityGroups) != i {
+				buf.WriteString(", ")
+			}
+		}
+
+		data = append(data, []string{
+			vps.NameTag,
+			vps.ExternalIPv4Address.String(),
+			vps.ExternalIPv6Address.String(),
+			buf.String(),
+		})
+
+		jsondata = append(jsondata, map[string]interface{}{
+			"name-tag":        vps.NameTag,
+			"ipv4":            vps.ExternalIPv4Address.String(),
+			"ipv6":            vps.ExternalIPv6Address.String(),
+			"security-groups": sgs,
+		})
+	}
+
+	if c.GlobalString("output") == "json" {
+		return outputJson(jsondata)
+	} else {
+		return outputTable(data)
+	}
+}
+
+func cmdAttachOrDetach(c *cli.Context, mode string) (err error) {
+	var vps *conoha.Vps
+	var secGroup string
+
+	// security group name to attach or detach
+	if c.NArg() == 0 {
+		err = fmt.Errorf("Please specify the security group name")
+		goto ON_ERROR
+	}
+	secGroup = c.Args()[0]
+
+	// initialize openstack
+	openstack, err = newOpenStack(c)
+	if err != nil {
+		goto ON_ERROR
+	}
+
+	// detect vps to attach or detach
+	vps, err = queryVps(c)
+	if err != nil {
+		goto ON_ERROR
+	}
+
+	// fetch details of port and security groups
+	if err = vps.PopulateSecurityGroups(openstack); err != nil {
+		goto ON_ERROR
+	}
+	if err = vps.PopulatePorts(openstack); err != nil {
+		goto ON_ERROR
+	}
+
+	// run
+	if mode != "attach" && mode != "detach" {
+		err = fmt.Errorf(`"mode" has to be either "attach" or "detach"`)
+		goto ON_ERROR
+	}
+
+	if mode == "attach" {
+		var fixedIps, allowedAddressPairs []string = nil, nil
+
+		if c.IsSet("fixed-ips") {
+			fixedIps = strings.Split(c.String("fixed-ips"), ",")
+		}
+
+		if c.IsSet("allowed-address-pairs") {
+			allowedAddressPairs = strings.Split(c.String("allowed-address-pairs"), ",")
+		}
+
+		attached, aerr := conoha.Attach(openstack, vps, secGroup, fixedIps, allowedAddressPairs)
+		if aerr != nil {
+			err = aerr
+			goto ON_ERROR
+		}
+
+		if c.GlobalString("output") == "json" {
+			return outputJson(map[string]interface{}{"uuid": attached.ID})
+		} else {
+			return outputTable([][]string{[]string{attached.ID}})
+		}
+
+	} else {
+		detached, derr := conoha.Detach(openstack, vps, secGroup)
+		if derr != nil {
+			err = derr
+			goto ON_ERROR
+		}
+		if c.GlobalString("output") == "json" {
+			return outputJson(map[string]interface{}{"uuid": detached.ID})
+		} else {
+			return outputTable([][]string{[]string{detached.ID}})
+		}
+	}
+
+ON_ERROR:
+	return err
+}
+
+func cmdAddressPairs(c *cli.Context) (err error) {
+	openstack, err = newOpenStack(c)
+	if err != nil {
+		return err
+	}
+
+	var address string
+	if c.Command.Name != "list-address-pairs" {
+		if c.NArg() == 0 {
+			return fmt.Errorf("Please specify the IP address or CIDR")
+		}
+		address = c.Args()[0]
+	}
+
+	vps, err := queryVps(c)
+	if err != nil {
+		return err
+	}
+	if err = vps.PopulatePorts(openstack); err != nil {
+		return err
+	}
+
+	var pairs []ports.AddressPair
+	switch c.Command.Name {
+	case "add-address-pair":
+		pairs, err = conoha.AddAddressPair(openstack, vps, c.String("port-id"), address, c.String("mac"))
+	case "remove-address-pair":
+		pairs, err = conoha.RemoveAddressPair(openstack, vps, c.String("port-id"), address, c.String("mac"))
+	default:
+		pairs, err = conoha.ListAddressPairs(openstack, vps, c.String("port-id"))
+	}
+	if err != nil {
+		return err
+	}
+
+	data := make([][]string, 0, len(pairs)+1)
+	jsondata := make([]map[string]interface{}, 0, len(pairs))
+
+	data = append(data, []string{"IP Address", "MAC Address"})
+	for _, p := range pairs {
+		data = append(data, []string{p.IPAddress, p.MACAddress})
+		jsondata = append(jsondata, map[string]interface{}{
+			"ip-address":  p.IPAddress,
+			"mac-address": p.MACAddress,
+		})
+	}
+
+	if c.GlobalString("output") == "json" {
+		return outputJson(jsondata)
+	} else {
+		return outputTable(data)
+	}
+}
+
+func cmdFixedIP(c *cli.Context) (err error) {
+	openstack, err = newOpenStack(c)
+	if err != nil {
+		return err
+	}
+
+	if c.NArg() == 0 {
+		return fmt.Errorf("Please specify the IP address")
+	}
+	address := c.Args()[0]
+
+	vps, err := queryVps(c)
+	if err != nil {
+		return err
+	}
+	if err = vps.PopulatePorts(openstack); err != nil {
+		return err
+	}
+
+	var fixedIPs []ports.IP
+	if c.Command.Name == "add-fixed-ip" {
+		fixedIPs, err = conoha.AddFixedIP(openstack, vps, c.String("port-id"), address, c.String("subnet-id"))
+	} else {
+		fixedIPs, err = conoha.RemoveFixedIP(openstack, vps, c.String("port-id"), address)
+	}
+	if err != nil {
+		return err
+	}
+
+	data := make([][]string, 0, len(fixedIPs)+1)
+	jsondata := make([]map[string]interface{}, 0, len(fixedIPs))
+
+	data = append(data, []string{"IP Address", "Subnet"})
+	for _, fip := range fixedIPs {
+		data = append(data, []string{fip.IPAddress, fip.SubnetID})
+		jsondata = append(jsondata, map[string]interface{}{
+			"ip-address": fip.IPAddress,
+			"subnet-id":  fip.SubnetID,
+		})
+	}
+
+	if c.GlobalString("output") == "json" {
+		return outputJson(jsondata)
+	} else {
+		return outputTable(data)
+	}
+}
+
+func jitUser(c *cli.Context) (string, error) {
+	if c.String("user") != "" {
+		return c.String("user"), nil
+	}
+	return conoha.CurrentUser()
+}
+
+func cmdAllowMe(c *cli.Context) (err error) {
+	user, err := jitUser(c)
+	if err != nil {
+		return err
+	}
+
+	ttl, err := conoha.ParseTTL(c.String("for"))
+	if err != nil {
+		return err
+	}
+
+	var ip net.IP
+	if c.String("source-ip") != "" {
+		ip = net.ParseIP(c.String("source-ip"))
+		if ip == nil {
+			return fmt.Errorf("Invalid IP address. [%s]", c.String("source-ip"))
+		}
+	} else {
+		ip, err = conoha.PublicIP(c.String("ip-service"))
+		if err != nil {
+			return err
+		}
+	}
+
+	openstack, err = newOpenStack(c)
+	if err != nil {
+		return err
+	}
+
+	vps, err := queryVps(c)
+	if err != nil {
+		return err
+	}
+	if err = vps.PopulateSecurityGroups(openstack); err != nil {
+		return err
+	}
+	if err = vps.PopulatePorts(openstack); err != nil {
+		return err
+	}
+
+	result, err := conoha.AllowMe(openstack, vps, conoha.AllowMeOpts{
+		User:      user,
+		IP:        ip,
+		Protocol:  c.String("protocol"),
+		PortRange: c.String("port"),
+		TTL:       ttl,
+	})
+	if err != nil {
+		return err
+	}
+
+	ruleIds := make([]string, 0, len(result.Rules))
+	for _, r := range result.Rules {
+		ruleIds = append(ruleIds, r.ID)
+	}
+
+	if c.GlobalString("output") == "json" {
+		return outputJson(map[string]interface{}{
+			"security-group": result.Group.Name,
+			"uuid":           result.Group.ID,
+			"rules":          ruleIds,
+			"ip":             ip.String(),
+			"expires":        result.Expires.Format(time.RFC3339),
+			"attached":       result.Attached,
+		})
+	} else {
+		return outputTable([][]string{
+			[]string{"SecurityGroup", "IP", "Rules", "Expires"},
+			[]string{result.Group.Name, ip.String(), strings.Join(ruleIds, ", "), result.Expires.Format(time.RFC3339)},
+		})
+	}
+}
+
+func cmdRevokeMe(c *cli.Context) (err error) {
+	user, err := jitUser(c)
+	if err != nil {
+		return err
+	}
+
+	openstack, err = newOpenStack(c)
+	if err != nil {
+		return err
+	}
+
+	vps, err := queryVps(c)
+	if err != nil {
+		return err
+	}
+	if err = vps.PopulateSecurityGroups(openstack); err != nil {
+		return err
+	}
+	if err = vps.PopulatePorts(openstack); err != nil {
+		return err
+	}
+
+	revoked, err := conoha.RevokeMe(openstack, vps, user)
+	if err != nil {
+		return err
+	}
+
+	data := make([][]string, 0, len(revoked))
+	jsondata := make([]map[string]string, 0, len(revoked))
+	for _, sg := range revoked {
+		data = append(data, []string{sg.ID, sg.Name})
+		jsondata = append(jsondata, map[string]string{"uuid": sg.ID, "security-group": sg.Name})
+	}
+
+	if c.GlobalString("output") == "json" {
+		return outputJson(jsondata)
+	} else {
+		return outputTable(data)
+	}
+}
+
+func cmdMatrix(c *cli.Context) (err error) {
+	openstack, err = newOpenStack(c)
+	if err != nil {
+		return err
+	}
+
+	services := make([]string, 0, 1)
+	for _, s := range strings.Split(c.String("ports"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			services = append(services, s)
+		}
+	}
+	if len(services) == 0 {
+		return fmt.Errorf("Please specify the ports.")
+	}
+
+	format := c.String("format")
+	switch format {
+	case "table", "csv", "dot":
+	default:
+		return fmt.Errorf(`Format must be either "table", "csv" or "dot". [%s]`, format)
+	}
+
+	m, err := conoha.ComputeMatrixAll(openstack, services)
+	if err != nil {
+		return err
+	}
+
+	if c.GlobalString("output") == "json" {
+		pairs := make([]map[string]interface{}, 0, len(m.Vps)*len(m.Vps))
+		for i, src := range m.Vps {
+			for j, dst := range m.Vps {
+				if i == j {
+					continue
+				}
+				pairs = append(pairs, map[string]interface{}{
+					"from":    src.NameTag,
+					"to":      dst.NameTag,
+					"allowed": m.AllowedServices(i, j),
+				})
+			}
+		}
+		return outputJson(map[string]interface{}{
+			"ports": services,
+			"pairs": pairs,
+		})
+	}
+
+	switch format {
+	case "csv":
+		out, err := m.CSV()
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(os.Stdout, out)
+	case "dot":
+		fmt.Fprint(os.Stdout, m.DOT())
+	default:
+		return outputTable(m.Table())
+	}
+	return nil
+}
+
+func cmdGraph(c *cli.Context) (err error) {
+	openstack, err = newOpenStack(c)
+	if err != nil {
+		return err
+	}
+
+	format := c.String("format")
+	if format != "dot" && format != "mermaid" {
+		return fmt.Errorf(`Format must be either "dot" or "mermaid". [%s]`, format)
+	}
+
+	opts := conoha.GraphOptions{
+		CollapseSystemGroups: c.Bool("collapse-system"),
+	}
+	if c.String("name") != "" || c.String("ip") != "" || c.String("id") != "" {
+		if opts.Vps, err = queryVps(c); err != nil {
+			return err
+		}
+	}
+
+	g, err := conoha.DrawGraph(openstack, opts)
+	if err != nil {
+		return err
+	}
+
+	if format == "mermaid" {
+		fmt.Fprint(os.Stdout, g.Mermaid())
+	} else {
+		fmt.Fprint(os.Stdout, g.DOT())
+	}
+	return nil
+}
+
+func cmdWhoCanReach(c *cli.Context) (err error) {
+	openstack, err = newOpenStack(c)
+	if err != nil {
+		return err
+	}
+
+	vps, err := queryVps(c)
+	if err != nil {
+		return err
+	}
+
+	grants, err := conoha.WhoCanReach(openstack, vps, c.String("proto"), c.String("port"))
+	if err != nil {
+		return err
+	}
+
+	data := make([][]string, 0, len(grants)+1)
+	list := make([]map[string]interface{}, 0, len(grants))
+
+	data = append(data, []string{"UUID", "SecurityGroup", "Source", "Rule", "Members"})
+	for _, g := range grants {
+		var r conoha.RuleCreateOpts
+		r.FromSecGroupRule(g.Rule)
+
+		members := make([]string, 0, len(g.Members))
+		for _, member := range g.Members {
+			members = append(members, member.NameTag)
+		}
+
+		data = append(data, []string{g.Rule.ID, g.Group.Name, g.Source, r.String(), strings.Join(members, ", ")})
+		list = append(list, map[string]interface{}{
+			"uuid":           g.Rule.ID,
+			"security-group": g.Group.Name,
+			"source":         g.Source,
+			"rule":           r.String(),
+			"members":        members,
+		})
+	}
+
+	if c.GlobalString("output") == "json" {
+		return outputJson(list)
+	}
+	return outputTable(data)
+}
+
+func cmdReachFrom(c *cli.Context) (err error) {
+	openstack, err = newOpenStack(c)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(c.String("ip"))
+	if ip == nil {
+		return fmt.Errorf("Please specify the IP address with \"ip\" option. [%s]", c.String("ip"))
+	}
+
+	reaches, err := conoha.ReachFrom(openstack, ip)
+	if err != nil {
+		return err
+	}
+
+	data := make([][]string, 0, len(reaches)+1)
+	list := make([]map[string]interface{}, 0, len(reaches))
+
+	data = append(data, []string{"VPS", "PortID", "Address", "SecurityGroup", "UUID", "Rule"})
+	for _, reach := range reaches {
+		var r conoha.RuleCreateOpts
+		r.FromSecGroupRule(reach.Rule)
+
+		addrs := make([]string, 0, len(reach.Port.FixedIPs))
+		for _, fip := range reach.Port.FixedIPs {
+			addrs = append(addrs, fip.IPAddress)
+		}
+
+		data = append(data, []string{reach.Vps.NameTag, reach.Port.ID, strings.Join(addrs, ", "), reach.Group.Name, reach.Rule.ID, r.String()})
+		list = append(list, map[string]interface{}{
+			"vps":            reach.Vps.NameTag,
+			"port-id":        reach.Port.ID,
+			"addresses":      addrs,
+			"security-group": reach.Group.Name,
+			"uuid":           reach.Rule.ID,
+			"rule":           r.String(),
+		})
+	}
+
+	if c.GlobalString("output") == "json" {
+		return outputJson(list)
+	}
+	return outputTable(data)
+}
+
+func cmdSnapshot(c *cli.Context) (err error) {
+	if c.NArg() == 0 {
+		return fmt.Errorf(`Please specify "save", "restore", "list" or "delete".`)
 	}
 
-	var name string
-	if len(c.Args()) > 0 {
-		name = c.Args()[0]
-	} else {
-		name = ""
+	action := c.Args()[0]
+	if action == "list" {
+		return cmdSnapshotList(c)
+	}
+
+	if c.NArg() < 2 {
+		return fmt.Errorf("Please specify the snapshot name")
 	}
-	rule := conoha.RuleCreateOpts{
-		SecurityGroupName: name,
-		Direction:         c.String("direction"),
-		EtherType:         c.String("ether-type"),
-		PortRange:         c.String("port-range"),
-		Protocol:          c.String("protocol"),
-		RemoteGroupID:     c.String("remote-group-id"),
-		RemoteIPPrefix:    c.String("remote-ip-prefix"),
+	name := c.Args()[1]
+
+	switch action {
+	case "save":
+		openstack, err = newOpenStack(c)
+		if err != nil {
+			return err
+		}
+
+		snap, err := conoha.TakeSnapshot(openstack, name)
+		if err != nil {
+			return err
+		}
+		file, err := conoha.SaveSnapshot(snap, c.Bool("force"))
+		if err != nil {
+			return err
+		}
+
+		if c.GlobalString("output") == "json" {
+			return outputJson(map[string]interface{}{
+				"snapshot": snap.Name,
+				"file":     file,
+				"groups":   len(snap.Groups),
+				"ports":    len(snap.Ports),
+			})
+		}
+		fmt.Fprintf(os.Stdout, "Saved the snapshot %s (%d groups, %d ports) to %s\n", snap.Name, len(snap.Groups), len(snap.Ports), file)
+		return nil
+
+	case "restore":
+		return cmdSnapshotRestore(c, name)
+
+	case "delete":
+		return conoha.DeleteSnapshot(name)
 	}
+	return fmt.Errorf(`Unknown action. Must be either "save", "restore", "list" or "delete". [%s]`, action)
+}
 
-	rt, err := conoha.CreateRule(openstack, rule)
+func cmdSnapshotList(c *cli.Context) (err error) {
+	snaps, err := conoha.ListSnapshots()
 	if err != nil {
 		return err
 	}
 
+	data := make([][]string, 0, len(snaps)+1)
+	list := make([]map[string]interface{}, 0, len(snaps))
+
+	data = append(data, []string{"Name", "Created", "Groups", "Ports"})
+	for _, snap := range snaps {
+		created := snap.Created.Local().Format(time.RFC3339)
+		data = append(data, []string{snap.Name, created, strconv.Itoa(len(snap.Groups)), strconv.Itoa(len(snap.Ports))})
+		list = append(list, map[string]interface{}{
+			"name":    snap.Name,
+			"created": created,
+			"groups":  len(snap.Groups),
+			"ports":   len(snap.Ports),
+		})
+	}
+
 	if c.GlobalString("output") == "json" {
-		return outputJson(map[string]string{"uuid": rt.ID})
-	} else {
-		return outputTable([][]string{[]string{rt.ID}})
+		return outputJson(list)
 	}
+	return outputTable(data)
+}
 
-	return nil
+// Return the rule expression of the rule to be restored. The remote group is shown by name.
+func restoreRuleExpression(r conoha.RestoreRule) string {
+	var expr conoha.RuleCreateOpts
+	expr.FromSecGroupRule(r.Rule)
+	if r.RemoteGroup != "" {
+		expr.RemoteGroupID = r.RemoteGroup
+	}
+	return expr.String()
 }
 
-func cmdDeleteRule(c *cli.Context) (err error) {
-	openstack, err = conoha.NewOpenStack()
+func cmdSnapshotRestore(c *cli.Context, name string) (err error) {
+	openstack, err = newOpenStack(c)
 	if err != nil {
 		return err
 	}
 
-	// uuid of rule to delete
-	if c.NArg() == 0 {
-		err = fmt.Errorf("Please specify the security group name")
+	snap, err := conoha.LoadSnapshot(name)
+	if err != nil {
 		return err
 	}
-	uuid := c.Args()[0]
 
-	return conoha.DeleteRule(openstack, uuid)
-}
+	plan, restoreErr := conoha.RestoreSnapshot(openstack, snap, c.Bool("dry-run"))
+	if plan == nil {
+		return restoreErr
+	}
 
-func cmdListGroup(c *cli.Context) (err error) {
-	openstack, err = conoha.NewOpenStack()
-	if err != nil {
-		return err
+	// If restoring failed halfway, only the applied changes are shown.
+	data := make([][]string, 0)
+	changes := make([]map[string]string, 0)
+	add := func(action string, target string, detail string, applied bool) {
+		if restoreErr != nil && !applied {
+			return
+		}
+		data = append(data, []string{action, target, detail})
+		changes = append(changes, map[string]string{
+			"action": action,
+			"target": target,
+			"detail": detail,
+		})
 	}
 
-	groups, err := conoha.ListGroup(openstack)
-	if err != nil {
-		return err
+	data = append(data, []string{"Action", "Target", "Detail"})
+	for _, sg := range plan.CreateGroups {
+		add("create-group", sg.Name, sg.Description, sg.Applied)
 	}
-	if !c.Bool("all") {
-		groups = conoha.RemoveSystemGroups(groups)
+	for _, r := range plan.CreateRules {
+		add("create-rule", r.Group, restoreRuleExpression(r), r.Applied)
+	}
+	for _, r := range plan.DeleteRules {
+		add("delete-rule", r.Group, r.Rule.ID+" "+restoreRuleExpression(r), r.Applied)
+	}
+	for _, p := range plan.UpdatePorts {
+		add("update-port", p.ID, strings.Join(p.Before, ",")+" -> "+strings.Join(p.After, ","), p.Applied)
+	}
+	for _, p := range plan.MissingPorts {
+		add("missing-port", p.ID, "device "+p.DeviceID, false)
 	}
 
-	// Display
-	data := make([][]string, 0, len(groups))
-	jsondata := make([]map[string]interface{}, 0, len(groups))
+	if c.GlobalString("output") == "json" {
+		result := map[string]interface{}{
+			"snapshot": snap.Name,
+			"created":  snap.Created.Local().Format(time.RFC3339),
+			"applied":  !c.Bool("dry-run") && plan.HasChanges(),
+			"changes":  changes,
+		}
+		if restoreErr != nil {
+			result["error"] = restoreErr.Error()
+		}
+		if err = outputJson(result); err != nil {
+			return err
+		}
+		return restoreErr
+	}
 
-	if len(groups) > 0 {
-		data = append(data, []string{"UUID", "SecurityGroup", "Direction", "EtherType", "Proto", "IP Range", "Port"})
-		for _, sg := range groups {
-			for _, rule := range sg.Rules {
-				cols := make([]string, 0, 7)
-				cols = append(cols, rule.ID, sg.Name, rule.Direction, rule.EtherType)
+	fmt.Fprintf(os.Stdout, "Snapshot: %s (%s)\n", snap.Name, snap.Created.Local().Format(time.RFC3339))
+	if restoreErr != nil {
+		fmt.Fprintln(os.Stdout, "Restoring failed halfway. The changes below have been applied.")
+	}
+	if len(data) > 1 {
+		if err = outputTable(data); err != nil {
+			return err
+		}
+	} else if restoreErr == nil {
+		fmt.Fprintln(os.Stdout, "No changes.")
+	}
+	return restoreErr
+}
 
-				jsoncols := map[string]interface{}{
-					"uuid":           rule.ID,
-					"security-group": sg.Name,
-					"direction":      rule.Direction,
-					"ether-type":     rule.EtherType,
-					"proto":          "",
-					"ip-range":       "",
-					"port":           "",
-				}
+func cmdDiff(c *cli.Context) (err error) {
+	if c.NArg() != 2 {
+		return fmt.Errorf(`Please specify two snapshot names. The second one can be "live".`)
+	}
 
-				if rule.Protocol != "" {
-					cols = append(cols, rule.Protocol)
-					jsoncols["proto"] = rule.Protocol
-				} else {
-					cols = append(cols, "ALL")
-					jsoncols["proto"] = "ALL"
-				}
-				cols = append(cols, rule.RemoteIPPrefix)
-				jsoncols["ip-range"] = rule.RemoteIPPrefix
+	from, err := conoha.LoadSnapshot(c.Args()[0])
+	if err != nil {
+		return err
+	}
 
-				if rule.PortRangeMin == 0 && rule.PortRangeMax == 0 {
-					cols = append(cols, "ALL")
-					jsoncols["port"] = "ALL"
-				} else {
-					fmt.Sprintf("%d - %d", rule.PortRangeMin, rule.PortRangeMax)
-					cols = append(cols, fmt.Sprintf("%d - %d", rule.PortRangeMin, rule.PortRangeMax))
-					jsoncols["port"] = map[string]int{
-						"min": rule.PortRangeMin,
-						"max": rule.PortRangeMax,
-					}
-				}
-				data = append(data, cols)
-				jsondata = append(jsondata, jsoncols)
-			}
+	var d *conoha.SnapshotDiff
+	if c.Args()[1] == "live" {
+		openstack, err = newOpenStack(c)
+		if err != nil {
+			return err
+		}
+		if d, err = conoha.DiffLive(openstack, from); err != nil {
+			return err
 		}
 
 	} else {
-		data = append(data, []string{"No security groups found"})
+		to, err := conoha.LoadSnapshot(c.Args()[1])
+		if err != nil {
+			return err
+		}
+		d = conoha.DiffSnapshots(from, to)
 	}
 
 	if c.GlobalString("output") == "json" {
-		return outputJson(jsondata)
-	} else {
-		return outputTable(data)
+		return outputJson(map[string]interface{}{
+			"from":    d.From.Name,
+			"to":      d.To.Name,
+			"changes": d.Changes,
+		})
 	}
+
+	fmt.Fprint(os.Stdout, d.Unified())
+	return nil
 }
 
-func cmdCreateGroup(c *cli.Context) (err error) {
-	openstack, err = conoha.NewOpenStack()
-	if err != nil {
-		return err
+func cmdWatch(c *cli.Context) (err error) {
+	if c.Duration("interval") <= 0 {
+		return fmt.Errorf("Interval must be positive. [%s]", c.Duration("interval"))
 	}
 
-	// description
-	description := c.String("description")
-
-	// security group name to create
-	if c.NArg() == 0 {
-		err = fmt.Errorf("Please specify the security group name")
-		return err
+	specs := c.StringSlice("notify")
+	if len(specs) == 0 {
+		specs = []string{"stdout"}
+	}
+	notifiers := make([]conoha.Notifier, 0, len(specs))
+	for _, spec := range specs {
+		n, err := conoha.NewNotifier(spec)
+		if err != nil {
+			return err
+		}
+		notifiers = append(notifiers, n)
 	}
-	name := c.Args()[0]
 
-	created, err := conoha.CreateGroup(openstack, name, description)
+	openstack, err = newOpenStack(c)
 	if err != nil {
 		return err
 	}
 
-	if c.GlobalString("output") == "json" {
-		return outputJson(map[string]string{"uuid": created.ID})
+	var baseline *conoha.Snapshot
+	if name := c.String("baseline"); name != "" {
+		if baseline, err = conoha.LoadSnapshot(name); err != nil {
+			return err
+		}
 	} else {
-		return outputTable([][]string{[]string{created.ID}})
+		snaps, err := conoha.ListSnapshots()
+		if err != nil {
+			return err
+		}
+		if len(snaps) > 0 {
+			baseline = snaps[len(snaps)-1]
+		} else if baseline, err = conoha.TakeSnapshot(openstack, "start"); err != nil {
+			return err
+		}
 	}
-}
+	logrus.Infof("Watching the drift from %s.", baseline.Name)
 
-func cmdDeleteGroup(c *cli.Context) (err error) {
-	openstack, err = conoha.NewOpenStack()
-	if err != nil {
-		return err
+	w := &conoha.Watcher{
+		Baseline:  baseline,
+		Policy:    openstack.Policy,
+		Notifiers: notifiers,
+		Remediate: c.Bool("remediate"),
 	}
 
-	// security group name to delete
-	if c.NArg() == 0 {
-		err = fmt.Errorf("Please specify the security group name")
+	if c.Bool("once") {
+		_, err = w.Check(openstack)
 		return err
 	}
-	name := c.Args()[0]
 
-	return conoha.DeleteGroup(openstack, name)
+	stop := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		close(stop)
+	}()
+
+	w.Run(openstack, c.Duration("interval"), stop)
+	return nil
 }
 
-func cmdList(c *cli.Context) (err error) {
-	openstack, err = conoha.NewOpenStack()
+// Return the summary of the changed rule or port groups of the record.
+func journalDetail(r conoha.JournalRecord) string {
+	var expr conoha.RuleCreateOpts
+	detail := ""
+	switch {
+	case r.Before != nil && r.Before.Rule != nil:
+		expr.FromSecGroupRule(*r.Before.Rule)
+		detail = expr.String()
+	case r.After != nil && r.After.Rule != nil:
+		expr.FromSecGroupRule(*r.After.Rule)
+		detail = expr.String()
+	case r.Before != nil && r.Before.Port != nil && r.After != nil && r.After.Port != nil:
+		detail = fmt.Sprintf("port %s: %d -> %d groups", r.Before.Port.ID, len(r.Before.Port.SecurityGroups), len(r.After.Port.SecurityGroups))
+	case r.Before != nil && r.Before.Group != nil:
+		detail = fmt.Sprintf("%d rules", len(r.Before.Group.Rules))
+		if len(r.Before.Referrers) > 0 {
+			detail += fmt.Sprintf(", %d rules of other groups", len(r.Before.Referrers))
+		}
+	}
+
+	if r.Error != "" {
+		detail = strings.TrimSpace(detail + " " + r.Error)
+	}
+	return detail
+}
+
+func cmdAuditLog(c *cli.Context) (err error) {
+	journal, err := conoha.DefaultJournal()
 	if err != nil {
 		return err
 	}
 
-	vpss, err := conoha.ListVps(openstack, nil)
+	var q conoha.JournalQuery
+	now := time.Now()
+	if s := c.String("since"); s != "" {
+		if q.Since, err = conoha.ParseJournalTime(s, now); err != nil {
+			return err
+		}
+	}
+	if s := c.String("until"); s != "" {
+		if q.Until, err = conoha.ParseJournalTime(s, now); err != nil {
+			return err
+		}
+	}
+	q.Group = c.String("group")
+	q.Vps = c.String("vps")
+	q.Operation = c.String("operation")
+
+	records, err := journal.Query(q)
 	if err != nil {
 		return err
 	}
 
-	numVps := len(vpss)
-	data := make([][]string, 0, numVps)
-	jsondata := make([]map[string]interface{}, 0, numVps)
+	if c.GlobalString("output") == "json" {
+		return outputJson(records)
+	}
 
-	data = append(data, []string{"NameTag", "IPv4", "IPv6", "SecurityGroups"})
-	for _, vps := range vpss {
-		var buf bytes.Buffer
-		var i = 0
-		sgs := make([]string, 0, len(vps.SecurityGroups))
-		for _, sg := range vps.SecurityGroups {
-			sgs = append(sgs, sg.Name)
-			buf.WriteString(sg.Name)
-			i++
-			if len(vps.SecurityGroups) != i {
-				buf.WriteString(", ")
-			}
+	data := make([][]string, 0, len(records)+1)
+	data = append(data, []string{"ID", "Time", "User", "Operation", "SecurityGroup", "VPS", "Result", "Detail"})
+	for _, r := range records {
+		vps := r.Vps
+		if vps == "" {
+			vps = r.VpsID
 		}
-
 		data = append(data, []string{
-			vps.NameTag,
-			vps.ExternalIPv4Address.String(),
-			vps.ExternalIPv6Address.String(),
-			buf.String(),
-		})
-
-		jsondata = append(jsondata, map[string]interface{}{
-			"name-tag":        vps.NameTag,
-			"ipv4":            vps.ExternalIPv4Address.String(),
-			"ipv6":            vps.ExternalIPv6Address.String(),
-			"security-groups": sgs,
+			r.ID,
+			r.Time.Local().Format(time.RFC3339),
+			r.User,
+			r.Operation,
+			r.Group,
+			vps,
+			r.Result,
+			journalDetail(r),
 		})
 	}
-
-	if c.GlobalString("output") == "json" {
-		return outputJson(jsondata)
-	} else {
-		return outputTable(data)
-	}
+	return outputTable(data)
 }
 
-func cmdAttachOrDetach(c *cli.Context, mode string) (err error) {
-	var vps *conoha.Vps
-	var secGroup string
-
-	// security group name to attach or detach
-	if c.NArg() == 0 {
-		err = fmt.Errorf("Please specify the security group name")
-		goto ON_ERROR
+func cmdUndo(c *cli.Context) (err error) {
+	if c.NArg() > 1 {
+		return fmt.Errorf("Too many arguments.")
 	}
-	secGroup = c.Args()[0]
 
-	// initialize openstack
-	openstack, err = conoha.NewOpenStack()
+	openstack, err = newOpenStack(c)
 	if err != nil {
-		goto ON_ERROR
+		return err
 	}
 
-	// detect vps to attach or detach
-	vps, err = queryVps(c)
+	records, err := openstack.Journal.Read()
 	if err != nil {
-		goto ON_ERROR
+		return err
 	}
 
-	// fetch details of port and security groups
-	if err := vps.PopulateSecurityGroups(openstack); err != nil {
-		goto ON_ERROR
+	r, err := conoha.FindUndoTarget(records, openstack.Journal.Profile, c.Args().First())
+	if err != nil {
+		return err
 	}
-	if err := vps.PopulatePorts(openstack); err != nil {
-		goto ON_ERROR
+	if err = conoha.Undo(openstack, r); err != nil {
+		return err
 	}
 
-	// run
-	if mode != "attach" && mode != "detach" {
-		err = fmt.Errorf(`"mode" has to be either "attach" or "detach"`)
-		goto ON_ERROR
+	if c.GlobalString("output") == "json" {
+		return outputJson(r)
 	}
 
-	if mode == "attach" {
-		var fixedIps, allowedAddressPairs []string = nil, nil
-
-		if c.IsSet("fixed-ips") {
-			fixedIps = strings.Split(c.String("fixed-ips"), ",")
-		}
-
-		if c.IsSet("allowed-address-pairs") {
-			allowedAddressPairs = strings.Split(c.String("allowed-address-pairs"), ",")
-		}
-
-		attached, err := conoha.Attach(openstack, vps, secGroup, fixedIps, allowedAddressPairs)
-		if err != nil {
-			goto ON_ERROR
-		}
-
-		if c.GlobalString("output") == "json" {
-			return outputJson(map[string]interface{}{"uuid": attached.ID})
-		} else {
-			return outputTable([][]string{[]string{attached.ID}})
-		}
-
-	} else {
-		detached, err := conoha.Detach(openstack, vps, secGroup)
-		if err != nil {
-			goto ON_ERROR
-		}
-		if c.GlobalString("output") == "json" {
-			return outputJson(map[string]interface{}{"uuid": detached.ID})
-		} else {
-			return outputTable([][]string{[]string{detached.ID}})
-		}
+	vps := r.Vps
+	if vps == "" {
+		vps = r.VpsID
 	}
-
-ON_ERROR:
-	return err
+	return outputTable([][]string{
+		{"ID", "Time", "Operation", "SecurityGroup", "VPS", "Detail"},
+		{r.ID, r.Time.Local().Format(time.RFC3339), r.Operation, r.Group, vps, journalDetail(*r)},
+	})
 }
 
 func outputJson(data interface{}) error {
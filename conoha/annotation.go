@@ -0,0 +1,227 @@
+package conoha
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+)
+
+// Max length of the description of security groups and rules in Neutron.
+const MAX_DESCRIPTION_LENGTH = 255
+
+var labelKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+
+// Description of security groups and rules that has key=value labels.
+//
+// Labels are stored at the end of the description in brackets,
+// such as "Allow vendor access [owner=payments ticket=OPS-123]".
+// Values are escaped as URL query, so that they can contain spaces and brackets.
+type Annotation struct {
+	Text   string
+	Labels map[string]string
+}
+
+// Parse a description of security group or rule.
+// The description that has no labels is returned as Text.
+func ParseAnnotation(description string) Annotation {
+	a := Annotation{
+		Text:   description,
+		Labels: map[string]string{},
+	}
+
+	trimmed := strings.TrimSpace(description)
+	if !strings.HasSuffix(trimmed, "]") {
+		return a
+	}
+	p := strings.LastIndex(trimmed, "[")
+	if p < 0 {
+		return a
+	}
+
+	labels := map[string]string{}
+	for _, token := range strings.Fields(trimmed[p+1 : len(trimmed)-1]) {
+		key, value, err := ParseLabel(token)
+		if err != nil {
+			// not labels
+			return a
+		}
+		if value, err = url.QueryUnescape(value); err != nil {
+			return a
+		}
+		labels[key] = value
+	}
+	if len(labels) == 0 {
+		return a
+	}
+
+	a.Text = strings.TrimSpace(trimmed[:p])
+	a.Labels = labels
+	return a
+}
+
+// Format the annotation as a description.
+func (a Annotation) String() string {
+	if len(a.Labels) == 0 {
+		return a.Text
+	}
+
+	keys := make([]string, 0, len(a.Labels))
+	for k := range a.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	tokens := make([]string, 0, len(keys))
+	for _, k := range keys {
+		tokens = append(tokens, k+"="+url.QueryEscape(a.Labels[k]))
+	}
+
+	labels := "[" + strings.Join(tokens, " ") + "]"
+	if a.Text == "" {
+		return labels
+	}
+	return a.Text + " " + labels
+}
+
+// Parse a label in "key=value" format.
+func ParseLabel(label string) (key string, value string, err error) {
+	p := strings.Index(label, "=")
+	if p < 0 {
+		return "", "", fmt.Errorf(`Label must be "key=value" format. [%s]`, label)
+	}
+
+	key = label[:p]
+	value = label[p+1:]
+	if !labelKeyRegexp.MatchString(key) {
+		return "", "", fmt.Errorf("Invalid label key. [%s]", key)
+	}
+	return key, value, nil
+}
+
+// Build a description from the text and labels in "key=value" format.
+func BuildDescription(text string, labels []string) (string, error) {
+	a := Annotation{
+		Text:   strings.TrimSpace(text),
+		Labels: make(map[string]string, len(labels)),
+	}
+	for _, l := range labels {
+		k, v, err := ParseLabel(l)
+		if err != nil {
+			return "", err
+		}
+		a.Labels[k] = v
+	}
+
+	// The text that looks like labels would be parsed as labels.
+	if len(a.Labels) == 0 && len(ParseAnnotation(a.Text).Labels) > 0 {
+		a.Text += " []"
+	}
+
+	description := a.String()
+	if len(description) > MAX_DESCRIPTION_LENGTH {
+		return "", fmt.Errorf("Description is too long. It must be %d characters or less. [%s]", MAX_DESCRIPTION_LENGTH, description)
+	}
+	return description, nil
+}
+
+// Label selector to filter security groups and rules.
+// For example "owner=payments", "env!=prod" or "ticket" (has the key).
+type Selector []selectorTerm
+
+type selectorTerm struct {
+	key   string
+	value string
+	op    string
+}
+
+// Parse comma-separated label selectors.
+func ParseSelector(selector string) (Selector, error) {
+	s := Selector{}
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		t := selectorTerm{}
+		if p := strings.Index(term, "!="); p >= 0 {
+			t.key, t.value, t.op = term[:p], term[p+2:], "!="
+		} else if p := strings.Index(term, "="); p >= 0 {
+			t.key, t.value, t.op = term[:p], term[p+1:], "="
+		} else if strings.HasPrefix(term, "!") {
+			t.key, t.op = term[1:], "!"
+		} else {
+			t.key, t.op = term, ""
+		}
+
+		if !labelKeyRegexp.MatchString(t.key) {
+			return nil, fmt.Errorf("Invalid label key in the selector. [%s]", term)
+		}
+		s = append(s, t)
+	}
+	return s, nil
+}
+
+// Return whether the labels match all selector terms.
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, t := range s {
+		v, ok := labels[t.key]
+		switch t.op {
+		case "=":
+			if !ok || v != t.value {
+				return false
+			}
+		case "!=":
+			if ok && v == t.value {
+				return false
+			}
+		case "!":
+			if ok {
+				return false
+			}
+		default:
+			if !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Return the labels of the rule. Labels of the group are inherited and overridden by the rule.
+func MergeLabels(groupDescription string, ruleDescription string) map[string]string {
+	merged := map[string]string{}
+	for k, v := range ParseAnnotation(groupDescription).Labels {
+		merged[k] = v
+	}
+	for k, v := range ParseAnnotation(ruleDescription).Labels {
+		merged[k] = v
+	}
+	return merged
+}
+
+// Return the security groups that have only the rules matching the selector.
+// Labels of the group are inherited by the rules.
+// The group that has no matching rules is removed unless the group itself matches.
+func (s Selector) Filter(sgs []groups.SecGroup) []groups.SecGroup {
+	filtered := make([]groups.SecGroup, 0, len(sgs))
+	for _, sg := range sgs {
+		matched := make([]rules.SecGroupRule, 0, len(sg.Rules))
+		for _, rule := range sg.Rules {
+			if s.Matches(MergeLabels(sg.Description, rule.Description)) {
+				matched = append(matched, rule)
+			}
+		}
+
+		if len(matched) > 0 || s.Matches(ParseAnnotation(sg.Description).Labels) {
+			sg.Rules = matched
+			filtered = append(filtered, sg)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,93 @@
+package conoha
+
+import (
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+)
+
+func TestAnnotation(t *testing.T) {
+	description, err := BuildDescription("Allow vendor access", []string{"owner=payments", "ticket=OPS-123", "note=see [wiki]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if description != "Allow vendor access [note=see+%5Bwiki%5D owner=payments ticket=OPS-123]" {
+		t.Errorf("unexpected description. %s", description)
+	}
+
+	a := ParseAnnotation(description)
+	if a.Text != "Allow vendor access" {
+		t.Errorf("unexpected text. %s", a.Text)
+	}
+	if a.Labels["owner"] != "payments" || a.Labels["ticket"] != "OPS-123" || a.Labels["note"] != "see [wiki]" {
+		t.Errorf("unexpected labels. %v", a.Labels)
+	}
+
+	// descriptions without labels
+	for _, d := range []string{"", "plain text", "text [not labels]", "[]"} {
+		a = ParseAnnotation(d)
+		if a.Text != d || len(a.Labels) != 0 {
+			t.Errorf("%s: should not have labels. %v", d, a)
+		}
+	}
+
+	// text that looks like labels
+	description, err = BuildDescription("[owner=nobody]", nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ParseAnnotation(description).Labels) != 0 {
+		t.Errorf("text should not be parsed as labels. %s", description)
+	}
+
+	if _, err = BuildDescription("", []string{"no-value"}); err == nil {
+		t.Errorf("label without value should be rejected")
+	}
+	if _, err = BuildDescription("", []string{"=value"}); err == nil {
+		t.Errorf("label without key should be rejected")
+	}
+}
+
+func TestSelector(t *testing.T) {
+	labels := map[string]string{"owner": "payments", "env": "prod"}
+
+	datasets := map[string]bool{
+		"owner=payments":           true,
+		"owner=payments,env=prod":  true,
+		"owner=payments,env!=prod": false,
+		"owner":                    true,
+		"!owner":                   false,
+		"ticket":                   false,
+		"!ticket":                  true,
+		"owner=web":                false,
+		"":                         true,
+	}
+	for selector, expected := range datasets {
+		s, err := ParseSelector(selector)
+		if err != nil {
+			t.Errorf("%s: %v", selector, err)
+		} else if s.Matches(labels) != expected {
+			t.Errorf("%s: should be %v", selector, expected)
+		}
+	}
+
+	sgs := []groups.SecGroup{
+		{
+			Name:        "web",
+			Description: "[owner=payments]",
+			Rules: []rules.SecGroupRule{
+				{ID: "1"},
+				{ID: "2", Description: "[owner=web]"},
+			},
+		},
+		{
+			Name:  "db",
+			Rules: []rules.SecGroupRule{{ID: "3", Description: "[owner=payments]"}, {ID: "4"}},
+		},
+	}
+	s, _ := ParseSelector("owner=payments")
+	filtered := s.Filter(sgs)
+	if len(filtered) != 2 || len(filtered[0].Rules) != 1 || filtered[0].Rules[0].ID != "1" || len(filtered[1].Rules) != 1 || filtered[1].Rules[0].ID != "3" {
+		t.Errorf("unexpected filtered groups. %v", filtered)
+	}
+}
@@ -0,0 +1,352 @@
+package conoha
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+)
+
+// Well-known ports that should not be reachable from the internet.
+var SENSITIVE_PORTS = map[int]string{
+	22:    "ssh",
+	3306:  "mysql",
+	5432:  "postgresql",
+	6379:  "redis",
+	9200:  "elasticsearch",
+	27017: "mongodb",
+}
+
+// Addresses that are not reachable from the internet.
+var privateAddresses, _ = NewCIDRSet(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+// A service of VPS that is reachable from any address (0.0.0.0/0 or ::/0).
+type Exposure struct {
+	Severity     string
+	EtherType    string
+	Protocol     string
+	PortRangeMin int
+	PortRangeMax int
+
+	// Sensitive ports in the port range
+	SensitivePorts []int
+
+	// Rules that allow the service
+	Rules []ExposedRule
+}
+
+// A rule that allows the access from any address.
+type ExposedRule struct {
+	Group groups.SecGroup
+	Rule  rules.SecGroupRule
+}
+
+// Result of the audit for VPS.
+type VpsAudit struct {
+	Vps       Vps
+	Ports     []ports.Port
+	Groups    []groups.SecGroup
+	Exposures []Exposure
+}
+
+// Result of the audit.
+type AuditReport struct {
+	Generated time.Time
+	Vps       []VpsAudit
+}
+
+// Return whether the port has a global address.
+func isInternetFacing(p ports.Port) bool {
+	for _, fip := range p.FixedIPs {
+		ip := net.ParseIP(fip.IPAddress)
+		if ip != nil && !privateAddresses.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the description of the port range. (e.g. "22", "80-90", "all", "echo-request")
+func formatPortRange(protocol string, min int, max int) string {
+	if isICMP(protocol) {
+		if s := formatICMPTypeCode(protocol, min, max); s != "" {
+			return s
+		}
+		return "all"
+	} else if min == 0 && max == 0 {
+		return "all"
+	} else if min == max {
+		return fmt.Sprintf("%d", min)
+	}
+	return fmt.Sprintf("%d-%d", min, max)
+}
+
+// Return the port range of the exposure.
+func (e Exposure) PortRange() string {
+	return formatPortRange(e.Protocol, e.PortRangeMin, e.PortRangeMax)
+}
+
+// Compute the effective ingress policy of VPS across all groups attached to the internet-facing ports
+// (including the system groups), and return the services reachable from any address.
+func AuditVps(vps Vps, sgs []groups.SecGroup, ps []ports.Port) VpsAudit {
+	audit := VpsAudit{
+		Vps:       vps,
+		Ports:     []ports.Port{},
+		Groups:    []groups.SecGroup{},
+		Exposures: []Exposure{},
+	}
+
+	seen := map[string]bool{}
+	for _, p := range ps {
+		if p.DeviceID != vps.ID || !isInternetFacing(p) {
+			continue
+		}
+		audit.Ports = append(audit.Ports, p)
+
+		for _, id := range p.SecurityGroups {
+			sg, err := FindGroup(sgs, id)
+			if err != nil || seen[sg.ID] {
+				continue
+			}
+			seen[sg.ID] = true
+			audit.Groups = append(audit.Groups, *sg)
+		}
+	}
+
+	// Rules from any address grouped by ether type and protocol
+	type service struct {
+		etherType string
+		protocol  string
+	}
+	exposed := map[service][]ExposedRule{}
+	order := make([]service, 0)
+	for _, sg := range audit.Groups {
+		for _, rule := range sg.Rules {
+			if rule.Direction != "ingress" || rule.RemoteGroupID != "" || !isAnyPrefix(rule.RemoteIPPrefix) {
+				continue
+			}
+
+			s := service{rule.EtherType, ProtocolName(rule.Protocol)}
+			if _, ok := exposed[s]; !ok {
+				order = append(order, s)
+			}
+			exposed[s] = append(exposed[s], ExposedRule{Group: sg, Rule: rule})
+		}
+	}
+
+	for _, s := range order {
+		for _, e := range mergeExposures(s.protocol, exposed[s]) {
+			e.EtherType = s.etherType
+			e.Protocol = s.protocol
+			e.SensitivePorts = sensitivePorts(e.Protocol, e.PortRangeMin, e.PortRangeMax)
+			if len(e.SensitivePorts) > 0 {
+				e.Severity = SEVERITY_ERROR
+			} else {
+				e.Severity = SEVERITY_WARNING
+			}
+			audit.Exposures = append(audit.Exposures, e)
+		}
+	}
+
+	sort.SliceStable(audit.Exposures, func(i, j int) bool {
+		a, b := audit.Exposures[i], audit.Exposures[j]
+		la, _ := SeverityLevel(a.Severity)
+		lb, _ := SeverityLevel(b.Severity)
+		if la != lb {
+			return la > lb
+		} else if a.EtherType != b.EtherType {
+			return a.EtherType < b.EtherType
+		} else if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		return a.PortRangeMin < b.PortRangeMin
+	})
+	return audit
+}
+
+// Merge the overlapping and adjacent port ranges of the rules.
+func mergeExposures(protocol string, rs []ExposedRule) []Exposure {
+	items := make([]Exposure, 0, len(rs))
+	for _, r := range rs {
+		min, max := r.Rule.PortRangeMin, r.Rule.PortRangeMax
+		if hasPorts(protocol) && min == 0 && max == 0 {
+			min, max = 1, 65535
+		}
+		items = append(items, Exposure{PortRangeMin: min, PortRangeMax: max, Rules: []ExposedRule{r}})
+	}
+
+	if protocol == "all" {
+		// All ports are exposed.
+		merged := Exposure{Rules: []ExposedRule{}}
+		for _, item := range items {
+			merged.Rules = append(merged.Rules, item.Rules...)
+		}
+		return []Exposure{merged}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool { return items[i].PortRangeMin < items[j].PortRangeMin })
+
+	merged := make([]Exposure, 0, len(items))
+	for _, item := range items {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			if isICMP(protocol) || !hasPorts(protocol) {
+				// ICMP type and code are not ranges.
+				if last.PortRangeMin == item.PortRangeMin && last.PortRangeMax == item.PortRangeMax {
+					last.Rules = append(last.Rules, item.Rules...)
+					continue
+				}
+			} else if item.PortRangeMin <= last.PortRangeMax+1 {
+				if item.PortRangeMax > last.PortRangeMax {
+					last.PortRangeMax = item.PortRangeMax
+				}
+				last.Rules = append(last.Rules, item.Rules...)
+				continue
+			}
+		}
+		merged = append(merged, item)
+	}
+
+	// "any port" is shown as "all".
+	for i := range merged {
+		if hasPorts(protocol) && merged[i].PortRangeMin == 1 && merged[i].PortRangeMax == 65535 {
+			merged[i].PortRangeMin, merged[i].PortRangeMax = 0, 0
+		}
+	}
+	return merged
+}
+
+// Return the sensitive ports in the port range.
+func sensitivePorts(protocol string, min int, max int) []int {
+	if protocol != "all" && protocol != "tcp" {
+		return nil
+	}
+
+	found := make([]int, 0)
+	for port := range SENSITIVE_PORTS {
+		if protocol == "all" || (min == 0 && max == 0) || (min <= port && port <= max) {
+			found = append(found, port)
+		}
+	}
+	sort.Ints(found)
+	return found
+}
+
+// Audit all VPS.
+func Audit(os *OpenStack) (*AuditReport, error) {
+	vpss, err := ListVps(os, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	sgs, err := ListGroup(os)
+	if err != nil {
+		return nil, err
+	}
+
+	ps, err := ListPorts(os)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &AuditReport{
+		Generated: time.Now(),
+		Vps:       make([]VpsAudit, 0, len(vpss)),
+	}
+	for _, vps := range vpss {
+		report.Vps = append(report.Vps, AuditVps(vps, sgs, ps))
+	}
+	return report, nil
+}
+
+// Format the report as Markdown.
+func (r *AuditReport) Markdown() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "# Security exposure audit\n\n")
+	fmt.Fprintf(&buf, "Generated at %s\n\n", r.Generated.Format(time.RFC3339))
+
+	// Summary
+	fmt.Fprintf(&buf, "| VPS | Sensitive | Exposed |\n")
+	fmt.Fprintf(&buf, "|---|---|---|\n")
+	for _, a := range r.Vps {
+		sensitive := 0
+		for _, e := range a.Exposures {
+			if e.Severity == SEVERITY_ERROR {
+				sensitive++
+			}
+		}
+		fmt.Fprintf(&buf, "| %s | %d | %d |\n", markdownEscape(a.Vps.NameTag), sensitive, len(a.Exposures))
+	}
+
+	for _, a := range r.Vps {
+		fmt.Fprintf(&buf, "\n## %s\n\n", markdownEscape(a.Vps.NameTag))
+
+		addrs := make([]string, 0, 2)
+		for _, ip := range []net.IP{a.Vps.ExternalIPv4Address, a.Vps.ExternalIPv6Address} {
+			if ip != nil {
+				addrs = append(addrs, ip.String())
+			}
+		}
+		if len(addrs) > 0 {
+			fmt.Fprintf(&buf, "- Address: %s\n", strings.Join(addrs, ", "))
+		}
+
+		names := make([]string, 0, len(a.Groups))
+		for _, sg := range a.Groups {
+			names = append(names, markdownEscape(sg.Name))
+		}
+		fmt.Fprintf(&buf, "- Security groups: %s\n\n", strings.Join(names, ", "))
+
+		if len(a.Ports) == 0 {
+			fmt.Fprintf(&buf, "No internet-facing ports.\n")
+			continue
+		} else if len(a.Exposures) == 0 {
+			fmt.Fprintf(&buf, "No services are reachable from any address.\n")
+			continue
+		}
+
+		fmt.Fprintf(&buf, "| Severity | EtherType | Protocol | Port | Sensitive | Rules |\n")
+		fmt.Fprintf(&buf, "|---|---|---|---|---|---|\n")
+		for _, e := range a.Exposures {
+			sensitive := make([]string, 0, len(e.SensitivePorts))
+			for _, port := range e.SensitivePorts {
+				sensitive = append(sensitive, fmt.Sprintf("%d (%s)", port, SENSITIVE_PORTS[port]))
+			}
+
+			rs := make([]string, 0, len(e.Rules))
+			for _, er := range e.Rules {
+				var opts RuleCreateOpts
+				opts.FromSecGroupRule(er.Rule)
+				rs = append(rs, fmt.Sprintf("%s: `%s`", markdownEscape(er.Group.Name), opts.String()))
+			}
+
+			fmt.Fprintf(&buf, "| %s | %s | %s | %s | %s | %s |\n",
+				e.Severity,
+				e.EtherType,
+				e.Protocol,
+				e.PortRange(),
+				strings.Join(sensitive, ", "),
+				strings.Join(rs, "<br>"),
+			)
+		}
+	}
+	return buf.String()
+}
+
+// Escape the characters that break Markdown tables.
+func markdownEscape(s string) string {
+	return strings.NewReplacer("|", `\|`, "`", "\\`", "*", `\*`, "_", `\_`).Replace(s)
+}
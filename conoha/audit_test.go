@@ -0,0 +1,109 @@
+package conoha
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+)
+
+func TestAuditVps(t *testing.T) {
+	sgs := []groups.SecGroup{
+		{
+			ID:   "gncs",
+			Name: "gncs-ipv4-ssh",
+			Rules: []rules.SecGroupRule{
+				testRule("1", "in tcp/22 from 0.0.0.0/0"),
+			},
+		},
+		{
+			ID:   "web",
+			Name: "web",
+			Rules: []rules.SecGroupRule{
+				testRule("2", "in tcp/80"),
+				testRule("3", "in tcp/81-443 from 0.0.0.0/0"),
+				testRule("4", "in ipv6 tcp/443"),
+				testRule("5", "in tcp/5432 from 10.0.0.0/8"),
+				testRule("6", "in icmp/echo-request"),
+				testRule("7", "out tcp/3306"),
+			},
+		},
+		{
+			ID:   "db",
+			Name: "db",
+			Rules: []rules.SecGroupRule{
+				testRule("8", "in tcp/6379"),
+			},
+		},
+	}
+	ps := []ports.Port{
+		{
+			ID:             "ext",
+			DeviceID:       "vps1",
+			FixedIPs:       []ports.IP{{IPAddress: "203.0.113.10"}, {IPAddress: "2001:db8::10"}},
+			SecurityGroups: []string{"gncs", "web"},
+		},
+		{
+			// private port is not internet-facing
+			ID:             "private",
+			DeviceID:       "vps1",
+			FixedIPs:       []ports.IP{{IPAddress: "192.168.0.10"}},
+			SecurityGroups: []string{"db"},
+		},
+	}
+
+	a := AuditVps(Vps{ID: "vps1", NameTag: "web1"}, sgs, ps)
+	if len(a.Ports) != 1 || len(a.Groups) != 2 {
+		t.Fatalf("1 port and 2 groups should be audited. %v %v", a.Ports, a.Groups)
+	}
+
+	expected := []struct {
+		severity  string
+		etherType string
+		protocol  string
+		portRange string
+		rules     int
+	}{
+		{SEVERITY_ERROR, "IPv4", "tcp", "22", 1},
+		{SEVERITY_WARNING, "IPv4", "icmp", "echo-request", 1},
+		{SEVERITY_WARNING, "IPv4", "tcp", "80-443", 2},
+		{SEVERITY_WARNING, "IPv6", "tcp", "443", 1},
+	}
+	if len(a.Exposures) != len(expected) {
+		t.Fatalf("%d exposures should be found, but %v", len(expected), a.Exposures)
+	}
+	for i, e := range expected {
+		actual := a.Exposures[i]
+		if actual.Severity != e.severity || actual.EtherType != e.etherType || actual.Protocol != e.protocol ||
+			actual.PortRange() != e.portRange || len(actual.Rules) != e.rules {
+			t.Errorf("exposure should be %v, but %v", e, actual)
+		}
+	}
+
+	// Markdown
+	report := &AuditReport{Generated: time.Now(), Vps: []VpsAudit{a}}
+	md := report.Markdown()
+	for _, s := range []string{"## web1", "| web1 | 1 | 4 |", "22 (ssh)", "gncs-ipv4-ssh: `in tcp/22 from 0.0.0.0/0`"} {
+		if !strings.Contains(md, s) {
+			t.Errorf("Markdown should contain %q.\n%s", s, md)
+		}
+	}
+}
+
+func TestSensitivePorts(t *testing.T) {
+	if ps := sensitivePorts("tcp", 0, 0); len(ps) != len(SENSITIVE_PORTS) {
+		t.Errorf("any port should contain all sensitive ports. %v", ps)
+	}
+	if ps := sensitivePorts("all", 0, 0); len(ps) != len(SENSITIVE_PORTS) {
+		t.Errorf("all protocols should contain all sensitive ports. %v", ps)
+	}
+	if ps := sensitivePorts("tcp", 3000, 6000); len(ps) != 2 || ps[0] != 3306 || ps[1] != 5432 {
+		t.Errorf("unexpected sensitive ports. %v", ps)
+	}
+	if ps := sensitivePorts("udp", 22, 22); len(ps) != 0 {
+		t.Errorf("udp should not be sensitive. %v", ps)
+	}
+}
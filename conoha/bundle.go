@@ -0,0 +1,225 @@
+package conoha
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+)
+
+// Label of the rules that are managed as a unit.
+const LABEL_BUNDLE = "bundle"
+
+// Split the rule into the rules that allow the remote IP prefix except the prefixes.
+//
+// Since security groups are allow-only, "deny" is emulated with the complement of the prefixes.
+// If RemoteIPPrefix is empty, any address (0.0.0.0/0 and/or ::/0 according to EtherType) is used.
+// The prefixes must be of the IP versions of the remote.
+func (r *RuleCreateOpts) Except(prefixes []string) ([]RuleCreateOpts, error) {
+	if r.RemoteGroupID != "" {
+		return nil, ruleFieldError("RemoteGroupID", r.RemoteGroupID, "can't be used with the excepted prefixes")
+	}
+
+	except, err := NewCIDRSet(prefixes...)
+	if err != nil {
+		return nil, err
+	}
+
+	var base *CIDRSet
+	if r.RemoteIPPrefix != "" {
+		base, err = NewCIDRSet(r.RemoteIPPrefix)
+	} else if strings.EqualFold(r.EtherType, ETHER_TYPE_BOTH) {
+		base, err = NewCIDRSet("0.0.0.0/0", "::/0")
+	} else if strings.EqualFold(r.EtherType, "IPv6") {
+		base, err = NewCIDRSet("::/0")
+	} else if r.EtherType == "" && len(except.v4) == 0 && len(except.v6) > 0 {
+		base, err = NewCIDRSet("::/0")
+	} else {
+		base, err = NewCIDRSet("0.0.0.0/0")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The excepted prefixes of the IP version that is not allowed would be ignored.
+	if (len(except.v4) > 0 && len(base.v4) == 0) || (len(except.v6) > 0 && len(base.v6) == 0) {
+		return nil, ruleFieldError("EtherType", r.EtherType, `can't except the prefixes of the other IP version. Use "%s" to except both [%s]`, ETHER_TYPE_BOTH, strings.Join(prefixes, ", "))
+	}
+
+	allowed := base.Subtract(except).Prefixes()
+	if len(allowed) == 0 {
+		return nil, ruleFieldError("RemoteIPPrefix", r.RemoteIPPrefix, "all addresses are excepted")
+	}
+
+	rs := make([]RuleCreateOpts, 0, len(allowed))
+	for _, prefix := range allowed {
+		e := *r
+		e.RemoteIPPrefix = prefix
+		if strings.EqualFold(e.EtherType, ETHER_TYPE_BOTH) {
+			// detected from the prefix
+			e.EtherType = ""
+		}
+		rs = append(rs, e)
+	}
+	return rs, nil
+}
+
+// Return the rules of the bundle in the security group.
+func BundleRules(sg groups.SecGroup, bundle string) []rules.SecGroupRule {
+	found := make([]rules.SecGroupRule, 0)
+	for _, rule := range sg.Rules {
+		a := ParseAnnotation(rule.Description)
+		if a.IsManaged() && a.Labels[LABEL_BUNDLE] == bundle {
+			found = append(found, rule)
+		}
+	}
+	return found
+}
+
+// Return the description added the labels of the bundle.
+func bundleDescription(description string, bundle string) (string, error) {
+	a := ParseAnnotation(description)
+	labels := make([]string, 0, len(a.Labels)+2)
+	for k, v := range a.Labels {
+		labels = append(labels, k+"="+v)
+	}
+	labels = append(labels,
+		LABEL_MANAGED_BY+"="+MANAGED_BY_CONOHA_NET,
+		LABEL_BUNDLE+"="+bundle,
+	)
+	return BuildDescription(a.Text, labels)
+}
+
+// Create or update the bundle of rules in the security group.
+//
+// The rules that already exist in the bundle with the same content are retained.
+// New rules are created before the old rules are deleted, so that the connectivity is not interrupted.
+// The retained rules whose descriptions differ (e.g. the expiry of TTL) are deleted and created again,
+// since the description of the rule can't be updated.
+// It returns the created rules and the deleted rules.
+func ApplyBundle(os *OpenStack, groupName string, bundle string, rs []RuleCreateOpts) (created []*rules.SecGroupRule, deleted []rules.SecGroupRule, err error) {
+	deleted = make([]rules.SecGroupRule, 0)
+	if bundle == "" {
+		return nil, nil, fmt.Errorf("Must specify the bundle name.")
+	}
+
+	sgs, err := ListGroup(os)
+	if err != nil {
+		return nil, nil, err
+	}
+	group, err := FindGroup(sgs, groupName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	existing := map[string]rules.SecGroupRule{}
+	for _, rule := range BundleRules(*group, bundle) {
+		existing[RuleContentKey(rule)] = rule
+	}
+
+	// Rules to create
+	retained := map[string]bool{}
+	creates := make([]RuleCreateOpts, 0, len(rs))
+	renews := make([]rules.CreateOpts, 0)
+	for _, r := range rs {
+		r.SecurityGroupName = group.ID
+		if r.Description, err = bundleDescription(r.Description, bundle); err != nil {
+			return nil, nil, err
+		}
+
+		expanded, err := r.Expand()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, e := range expanded {
+			opts, err := e.resolve(sgs)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			key := RuleContentKey(ruleFromCreateOpts(opts))
+			if rule, ok := existing[key]; ok {
+				retained[key] = true
+				if rule.Description != opts.Description {
+					renews = append(renews, opts)
+				}
+				continue
+			}
+			creates = append(creates, e)
+		}
+	}
+	if err = checkRulePolicy(os, sgs, renews); err != nil {
+		return nil, nil, err
+	}
+
+	if len(creates) > 0 {
+		created, err = CreateRuleSet(os, creates)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Renew the descriptions of the retained rules
+	for _, opts := range renews {
+		old := existing[RuleContentKey(ruleFromCreateOpts(opts))]
+		if err = DeleteRule(os, old.ID); err != nil {
+			return created, deleted, err
+		}
+		deleted = append(deleted, old)
+
+		rule, err := createRule(os, opts)
+		if err != nil {
+			// Rollback
+			restored, cerr := createRule(os, createOptsFromRule(old, old.SecGroupID))
+			if cerr != nil {
+				return created, deleted, fmt.Errorf("%s (and failed to rollback the rule. [%s])", err, old.ID)
+			}
+			return append(created, restored), deleted, err
+		}
+		created = append(created, rule)
+	}
+
+	// Delete old rules
+	failed := make([]string, 0)
+	for key, rule := range existing {
+		if retained[key] {
+			continue
+		}
+		err := DeleteRule(os, rule.ID)
+		if _, ok := err.(gophercloud.ErrDefault404); err != nil && !ok {
+			failed = append(failed, fmt.Sprintf("%s: %s", rule.ID, err))
+			continue
+		}
+		deleted = append(deleted, rule)
+	}
+	if len(failed) > 0 {
+		return created, deleted, fmt.Errorf("Failed to delete the old rules of the bundle. [%s]", strings.Join(failed, ", "))
+	}
+
+	return created, deleted, nil
+}
+
+// Delete all rules of the bundle in the security group, and return the deleted rules.
+func DeleteBundle(os *OpenStack, groupName string, bundle string) ([]rules.SecGroupRule, error) {
+	group, err := GetGroup(os, groupName)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := BundleRules(*group, bundle)
+	if len(rs) == 0 {
+		return nil, fmt.Errorf("The bundle not found. [%s]", bundle)
+	}
+
+	deleted := make([]rules.SecGroupRule, 0, len(rs))
+	for _, rule := range rs {
+		err := DeleteRule(os, rule.ID)
+		if _, ok := err.(gophercloud.ErrDefault404); err != nil && !ok {
+			return deleted, err
+		}
+		deleted = append(deleted, rule)
+	}
+	return deleted, nil
+}
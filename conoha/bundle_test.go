@@ -0,0 +1,107 @@
+package conoha
+
+import (
+	"testing"
+)
+
+func TestExcept(t *testing.T) {
+	rule := RuleCreateOpts{
+		SecurityGroupName: "test",
+		Direction:         "ingress",
+		Protocol:          "tcp",
+		PortRange:         "22",
+	}
+
+	rs, err := rule.Except([]string{"0.0.0.0/1"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(rs) != 1 || rs[0].RemoteIPPrefix != "128.0.0.0/1" {
+		t.Errorf("unexpected rules. %v", rs)
+	}
+
+	// 203.0.113.0/24 is excepted from 0.0.0.0/0 with 24 prefixes
+	rs, err = rule.Except([]string{"203.0.113.0/24"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(rs) != 24 {
+		t.Errorf("24 rules should be created, but %d", len(rs))
+	}
+	for _, r := range rs {
+		if r.PortRange != "22" || r.Protocol != "tcp" || r.Direction != "ingress" {
+			t.Errorf("other fields should be copied. %v", r)
+		}
+		if _, _, err = r.ToCreateOpts(); err != nil {
+			t.Errorf("%v", err)
+		}
+	}
+
+	// IPv6 is detected from the excepted prefixes
+	rs, err = rule.Except([]string{"8000::/1"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(rs) != 1 || rs[0].RemoteIPPrefix != "::/1" {
+		t.Errorf("unexpected rules. %v", rs)
+	}
+
+	// both
+	both := rule
+	both.EtherType = ETHER_TYPE_BOTH
+	rs, err = both.Except([]string{"128.0.0.0/1", "8000::/1"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(rs) != 2 || rs[0].RemoteIPPrefix != "0.0.0.0/1" || rs[1].RemoteIPPrefix != "::/1" || rs[0].EtherType != "" {
+		t.Errorf("unexpected rules. %v", rs)
+	}
+
+	// from the remote IP prefix
+	prefixed := rule
+	prefixed.RemoteIPPrefix = "10.0.0.0/24"
+	rs, err = prefixed.Except([]string{"10.0.0.1"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := []string{"10.0.0.0/32", "10.0.0.2/31", "10.0.0.4/30", "10.0.0.8/29", "10.0.0.16/28", "10.0.0.32/27", "10.0.0.64/26", "10.0.0.128/25"}
+	if len(rs) != len(expected) {
+		t.Fatalf("unexpected rules. %v", rs)
+	}
+	for i, r := range rs {
+		if r.RemoteIPPrefix != expected[i] {
+			t.Errorf("prefix should be %s, but %s", expected[i], r.RemoteIPPrefix)
+		}
+	}
+
+	// errors
+	if _, err = rule.Except([]string{"203.0.113.0/24", "2001:db8::/32"}); err == nil {
+		t.Errorf("excepting both IP versions without both should be an error")
+	}
+	if _, err = prefixed.Except([]string{"2001:db8::/32"}); err == nil {
+		t.Errorf("excepting IPv6 from IPv4 prefix should be an error")
+	}
+	if _, err = prefixed.Except([]string{"10.0.0.0/8"}); err == nil {
+		t.Errorf("excepting all addresses should be an error")
+	}
+	grouped := rule
+	grouped.RemoteGroupID = "web"
+	if _, err = grouped.Except([]string{"10.0.0.0/8"}); err == nil {
+		t.Errorf("remote group should be an error")
+	}
+	if _, err = rule.Except([]string{"invalid"}); err == nil {
+		t.Errorf("invalid prefix should be an error")
+	}
+}
+
+func TestBundleDescription(t *testing.T) {
+	d, err := bundleDescription("Allow SSH [owner=ops]", "b1")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	a := ParseAnnotation(d)
+	if a.Text != "Allow SSH" || a.Labels["owner"] != "ops" || a.Labels[LABEL_BUNDLE] != "b1" || !a.IsManaged() {
+		t.Errorf("unexpected description. %s", d)
+	}
+}
@@ -0,0 +1,340 @@
+package conoha
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Set of IP addresses that supports union, intersection and subtraction.
+// IPv4 and IPv6 addresses are held separately, and never overlap each other.
+// The zero value is an empty set.
+type CIDRSet struct {
+	v4 []ipRange
+	v6 []ipRange
+}
+
+// 128 bit unsigned integer for IP addresses.
+type uint128 struct {
+	hi, lo uint64
+}
+
+// Range of IP addresses. Both of start and end are inclusive.
+type ipRange struct {
+	start, end uint128
+}
+
+func (a uint128) cmp(b uint128) int {
+	if a.hi < b.hi || (a.hi == b.hi && a.lo < b.lo) {
+		return -1
+	} else if a == b {
+		return 0
+	}
+	return 1
+}
+
+func (a uint128) add1() uint128 {
+	lo, carry := bits.Add64(a.lo, 1, 0)
+	return uint128{a.hi + carry, lo}
+}
+
+func (a uint128) sub1() uint128 {
+	lo, borrow := bits.Sub64(a.lo, 1, 0)
+	return uint128{a.hi - borrow, lo}
+}
+
+func (a uint128) and(b uint128) uint128 {
+	return uint128{a.hi & b.hi, a.lo & b.lo}
+}
+
+func (a uint128) or(b uint128) uint128 {
+	return uint128{a.hi | b.hi, a.lo | b.lo}
+}
+
+// Return the mask of lower n bits.
+func hostMask(n uint) uint128 {
+	switch {
+	case n == 0:
+		return uint128{}
+	case n < 64:
+		return uint128{0, 1<<n - 1}
+	case n < 128:
+		return uint128{1<<(n-64) - 1, ^uint64(0)}
+	default:
+		return uint128{^uint64(0), ^uint64(0)}
+	}
+}
+
+func (a uint128) trailingZeros() uint {
+	if a.lo != 0 {
+		return uint(bits.TrailingZeros64(a.lo))
+	} else if a.hi != 0 {
+		return 64 + uint(bits.TrailingZeros64(a.hi))
+	}
+	return 128
+}
+
+func ipToUint128(ip net.IP) uint128 {
+	if ip4 := ip.To4(); ip4 != nil {
+		return uint128{0, uint64(binary.BigEndian.Uint32(ip4))}
+	}
+	ip16 := ip.To16()
+	return uint128{binary.BigEndian.Uint64(ip16[:8]), binary.BigEndian.Uint64(ip16[8:])}
+}
+
+func uint128ToIP(a uint128, v4 bool) net.IP {
+	if v4 {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, uint32(a.lo))
+		return ip
+	}
+	ip := make(net.IP, 16)
+	binary.BigEndian.PutUint64(ip[:8], a.hi)
+	binary.BigEndian.PutUint64(ip[8:], a.lo)
+	return ip
+}
+
+// Parse a prefix in CIDR notation or an IP address (as a host prefix).
+func parseRange(prefix string) (r ipRange, v4 bool, err error) {
+	prefix = strings.TrimSpace(prefix)
+	if !strings.Contains(prefix, "/") {
+		ip := net.ParseIP(prefix)
+		if ip == nil {
+			return r, false, fmt.Errorf("Invalid IP address or CIDR. [%s]", prefix)
+		}
+		if ip.To4() != nil {
+			prefix += "/32"
+		} else {
+			prefix += "/128"
+		}
+	}
+
+	_, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return r, false, fmt.Errorf("Invalid IP address or CIDR. [%s]", prefix)
+	}
+
+	ones, size := ipnet.Mask.Size()
+	r.start = ipToUint128(ipnet.IP)
+	r.end = r.start.or(hostMask(uint(size - ones)))
+	return r, size == 32, nil
+}
+
+// Sort ranges and merge the overlapping or adjacent ones.
+func normalizeRanges(rs []ipRange) []ipRange {
+	if len(rs) == 0 {
+		return nil
+	}
+
+	sorted := make([]ipRange, len(rs))
+	copy(sorted, rs)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].start.cmp(sorted[j].start) < 0 })
+
+	merged := make([]ipRange, 0, len(sorted))
+	cur := sorted[0]
+	for _, r := range sorted[1:] {
+		// cur.end + 1 >= r.start (careful about overflow)
+		if cur.end.cmp(r.start) >= 0 || cur.end.add1() == r.start {
+			if r.end.cmp(cur.end) > 0 {
+				cur.end = r.end
+			}
+			continue
+		}
+		merged = append(merged, cur)
+		cur = r
+	}
+	return append(merged, cur)
+}
+
+func intersectRanges(a, b []ipRange) []ipRange {
+	result := make([]ipRange, 0)
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		start := a[i].start
+		if b[j].start.cmp(start) > 0 {
+			start = b[j].start
+		}
+		end := a[i].end
+		if b[j].end.cmp(end) < 0 {
+			end = b[j].end
+		}
+		if start.cmp(end) <= 0 {
+			result = append(result, ipRange{start, end})
+		}
+
+		if a[i].end.cmp(b[j].end) < 0 {
+			i++
+		} else {
+			j++
+		}
+	}
+	return result
+}
+
+func subtractRanges(a, b []ipRange) []ipRange {
+	result := make([]ipRange, 0, len(a))
+	for _, r := range a {
+		cur := r
+		empty := false
+		for _, s := range b {
+			if s.end.cmp(cur.start) < 0 || s.start.cmp(cur.end) > 0 {
+				continue
+			}
+
+			if s.start.cmp(cur.start) > 0 {
+				result = append(result, ipRange{cur.start, s.start.sub1()})
+			}
+			if s.end.cmp(cur.end) >= 0 {
+				empty = true
+				break
+			}
+			cur.start = s.end.add1()
+		}
+		if !empty {
+			result = append(result, cur)
+		}
+	}
+	return result
+}
+
+// Split the range into the minimal prefixes.
+func rangeToPrefixes(r ipRange, v4 bool) []string {
+	maxBits := uint(128)
+	if v4 {
+		maxBits = 32
+	}
+
+	prefixes := make([]string, 0, 1)
+	start := r.start
+	for {
+		// The largest block that starts at "start" and doesn't exceed "end"
+		host := start.trailingZeros()
+		if host > maxBits {
+			host = maxBits
+		}
+		for host > 0 && start.or(hostMask(host)).cmp(r.end) > 0 {
+			host--
+		}
+
+		last := start.or(hostMask(host))
+		prefixes = append(prefixes, fmt.Sprintf("%s/%d", uint128ToIP(start, v4), maxBits-host))
+
+		if last.cmp(r.end) >= 0 {
+			break
+		}
+		start = last.add1()
+	}
+	return prefixes
+}
+
+// Create a set from prefixes in CIDR notation or IP addresses.
+func NewCIDRSet(prefixes ...string) (*CIDRSet, error) {
+	s := &CIDRSet{}
+	for _, p := range prefixes {
+		if err := s.Add(p); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Add a prefix in CIDR notation or an IP address to the set.
+func (s *CIDRSet) Add(prefix string) error {
+	r, v4, err := parseRange(prefix)
+	if err != nil {
+		return err
+	}
+
+	if v4 {
+		s.v4 = normalizeRanges(append(s.v4, r))
+	} else {
+		s.v6 = normalizeRanges(append(s.v6, r))
+	}
+	return nil
+}
+
+// Return the union of the sets.
+func (s *CIDRSet) Union(o *CIDRSet) *CIDRSet {
+	return &CIDRSet{
+		v4: normalizeRanges(append(append([]ipRange{}, s.v4...), o.v4...)),
+		v6: normalizeRanges(append(append([]ipRange{}, s.v6...), o.v6...)),
+	}
+}
+
+// Return the intersection of the sets.
+func (s *CIDRSet) Intersect(o *CIDRSet) *CIDRSet {
+	return &CIDRSet{
+		v4: intersectRanges(s.v4, o.v4),
+		v6: intersectRanges(s.v6, o.v6),
+	}
+}
+
+// Return the addresses in s but not in o.
+func (s *CIDRSet) Subtract(o *CIDRSet) *CIDRSet {
+	return &CIDRSet{
+		v4: subtractRanges(s.v4, o.v4),
+		v6: subtractRanges(s.v6, o.v6),
+	}
+}
+
+// Return whether the set is empty.
+func (s *CIDRSet) IsEmpty() bool {
+	return len(s.v4) == 0 && len(s.v6) == 0
+}
+
+// Return whether the set contains the IP address.
+func (s *CIDRSet) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	rs := s.v6
+	if ip.To4() != nil {
+		rs = s.v4
+	}
+	a := ipToUint128(ip)
+	for _, r := range rs {
+		if r.start.cmp(a) <= 0 && r.end.cmp(a) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Return whether the set contains all addresses of o.
+func (s *CIDRSet) ContainsSet(o *CIDRSet) bool {
+	return o.Subtract(s).IsEmpty()
+}
+
+// Return whether the set has common addresses with o.
+func (s *CIDRSet) Overlaps(o *CIDRSet) bool {
+	return !s.Intersect(o).IsEmpty()
+}
+
+// Return the minimal prefixes that represent the set. IPv4 prefixes come first.
+func (s *CIDRSet) Prefixes() []string {
+	prefixes := make([]string, 0, len(s.v4)+len(s.v6))
+	for _, r := range s.v4 {
+		prefixes = append(prefixes, rangeToPrefixes(r, true)...)
+	}
+	for _, r := range s.v6 {
+		prefixes = append(prefixes, rangeToPrefixes(r, false)...)
+	}
+	return prefixes
+}
+
+func (s *CIDRSet) String() string {
+	return strings.Join(s.Prefixes(), ", ")
+}
+
+// Aggregate the prefixes into the minimal prefixes.
+func AggregatePrefixes(prefixes []string) ([]string, error) {
+	s, err := NewCIDRSet(prefixes...)
+	if err != nil {
+		return nil, err
+	}
+	return s.Prefixes(), nil
+}
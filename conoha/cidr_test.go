@@ -0,0 +1,92 @@
+package conoha
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func mustCIDRSet(t *testing.T, prefixes ...string) *CIDRSet {
+	s, err := NewCIDRSet(prefixes...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestAggregatePrefixes(t *testing.T) {
+	datasets := []struct {
+		input    []string
+		expected []string
+	}{
+		{[]string{"192.168.0.0/25", "192.168.0.128/25"}, []string{"192.168.0.0/24"}},
+		{[]string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.0"}, []string{"10.0.0.0/30"}},
+		{[]string{"10.0.0.0/8", "10.1.0.0/16"}, []string{"10.0.0.0/8"}},
+		{[]string{"10.0.0.1/32", "10.0.0.2/32"}, []string{"10.0.0.1/32", "10.0.0.2/32"}},
+		{[]string{"2001:db8::/33", "2001:db8:8000::/33", "10.0.0.0/24"}, []string{"10.0.0.0/24", "2001:db8::/32"}},
+		{[]string{"0.0.0.0/1", "128.0.0.0/1"}, []string{"0.0.0.0/0"}},
+		{[]string{"::/1", "8000::/1"}, []string{"::/0"}},
+	}
+
+	for _, d := range datasets {
+		prefixes, err := AggregatePrefixes(d.input)
+		if err != nil {
+			t.Error(err)
+		} else if !reflect.DeepEqual(prefixes, d.expected) {
+			t.Errorf("%v should be aggregated to %v, but %v", d.input, d.expected, prefixes)
+		}
+	}
+
+	if _, err := AggregatePrefixes([]string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("invalid prefix should be rejected")
+	}
+}
+
+func TestCIDRSetSubtract(t *testing.T) {
+	all := mustCIDRSet(t, "0.0.0.0/0")
+	except := mustCIDRSet(t, "203.0.113.0/24")
+
+	allowed := all.Subtract(except)
+	prefixes := allowed.Prefixes()
+	if len(prefixes) != 24 {
+		t.Errorf("24 prefixes should be returned, but %d. %v", len(prefixes), prefixes)
+	}
+	if allowed.Contains(net.ParseIP("203.0.113.10")) {
+		t.Errorf("excluded address should not be contained")
+	}
+	if !allowed.Contains(net.ParseIP("203.0.112.255")) || !allowed.Contains(net.ParseIP("203.0.114.0")) {
+		t.Errorf("neighbor addresses should be contained")
+	}
+	if !allowed.Union(except).ContainsSet(all) {
+		t.Errorf("union should restore the original set")
+	}
+
+	v6 := mustCIDRSet(t, "2001:db8::/32").Subtract(mustCIDRSet(t, "2001:db8::/33"))
+	if !reflect.DeepEqual(v6.Prefixes(), []string{"2001:db8:8000::/33"}) {
+		t.Errorf("unexpected prefixes. %v", v6.Prefixes())
+	}
+
+	if !mustCIDRSet(t, "10.0.0.0/24").Subtract(mustCIDRSet(t, "10.0.0.0/8")).IsEmpty() {
+		t.Errorf("subtraction by the larger set should be empty")
+	}
+}
+
+func TestCIDRSetIntersect(t *testing.T) {
+	a := mustCIDRSet(t, "10.0.0.0/16", "192.168.0.0/24", "2001:db8::/32")
+	b := mustCIDRSet(t, "10.0.128.0/17", "172.16.0.0/12", "::/0")
+
+	i := a.Intersect(b)
+	expected := []string{"10.0.128.0/17", "2001:db8::/32"}
+	if !reflect.DeepEqual(i.Prefixes(), expected) {
+		t.Errorf("intersection should be %v, but %v", expected, i.Prefixes())
+	}
+
+	if !a.Overlaps(b) || a.Overlaps(mustCIDRSet(t, "172.16.0.0/12")) {
+		t.Errorf("unexpected overlap")
+	}
+
+	// IPv4 and IPv6 never overlap
+	if mustCIDRSet(t, "0.0.0.0/0").Overlaps(mustCIDRSet(t, "::/0")) {
+		t.Errorf("IPv4 and IPv6 should not overlap")
+	}
+}
@@ -0,0 +1,240 @@
+package conoha
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+)
+
+// Kinds and operations of the differences.
+const (
+	DIFF_GROUP      = "group"
+	DIFF_RULE       = "rule"
+	DIFF_ATTACHMENT = "attachment"
+
+	DIFF_ADDED    = "added"
+	DIFF_REMOVED  = "removed"
+	DIFF_MODIFIED = "modified"
+)
+
+// A difference between two snapshots.
+type DiffChange struct {
+	Kind  string `json:"kind"`
+	Op    string `json:"op"`
+	Group string `json:"group"`
+
+	// Rule expression with the remote group name
+	Rule string `json:"rule"`
+
+	// Port of the attachment
+	Port   string `json:"port"`
+	Device string `json:"device"`
+
+	// Description of the group or the rule
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// Differences between two snapshots.
+type SnapshotDiff struct {
+	From    *Snapshot
+	To      *Snapshot
+	Changes []DiffChange
+}
+
+// Return the rules of the group by the portable content key.
+func rulesByKey(sgs []groups.SecGroup, sg *groups.SecGroup) map[string]rules.SecGroupRule {
+	m := map[string]rules.SecGroupRule{}
+	if sg == nil {
+		return m
+	}
+	for _, rule := range sg.Rules {
+		key := portableRuleKey(sgs, rule)
+		if _, ok := m[key]; !ok {
+			m[key] = rule
+		}
+	}
+	return m
+}
+
+// Return the rule expression with the remote group name.
+func portableRuleExpression(sgs []groups.SecGroup, rule rules.SecGroupRule) string {
+	var expr RuleCreateOpts
+	expr.FromSecGroupRule(rule)
+	if rule.RemoteGroupID != "" {
+		expr.RemoteGroupID = remoteGroupName(sgs, rule)
+	}
+	return expr.String()
+}
+
+// Find the group by name.
+func findGroupByName(sgs []groups.SecGroup, name string) *groups.SecGroup {
+	for i := range sgs {
+		if sgs[i].Name == name {
+			return &sgs[i]
+		}
+	}
+	return nil
+}
+
+// Compare the snapshots. Groups are matched by name, rules by content and attachments by port ID.
+func DiffSnapshots(a *Snapshot, b *Snapshot) *SnapshotDiff {
+	d := &SnapshotDiff{
+		From:    a,
+		To:      b,
+		Changes: []DiffChange{},
+	}
+
+	// Groups and rules
+	names := map[string]bool{}
+	for _, sg := range append(append([]groups.SecGroup{}, a.Groups...), b.Groups...) {
+		names[sg.Name] = true
+	}
+	for _, name := range sortedKeys(names) {
+		ga, gb := findGroupByName(a.Groups, name), findGroupByName(b.Groups, name)
+		switch {
+		case ga == nil:
+			d.Changes = append(d.Changes, DiffChange{Kind: DIFF_GROUP, Op: DIFF_ADDED, Group: name, After: gb.Description})
+		case gb == nil:
+			d.Changes = append(d.Changes, DiffChange{Kind: DIFF_GROUP, Op: DIFF_REMOVED, Group: name, Before: ga.Description})
+		case ga.Description != gb.Description:
+			d.Changes = append(d.Changes, DiffChange{Kind: DIFF_GROUP, Op: DIFF_MODIFIED, Group: name, Before: ga.Description, After: gb.Description})
+		}
+
+		ra, rb := rulesByKey(a.Groups, ga), rulesByKey(b.Groups, gb)
+		changes := []DiffChange{}
+		for key, rule := range ra {
+			if other, ok := rb[key]; !ok {
+				changes = append(changes, DiffChange{Kind: DIFF_RULE, Op: DIFF_REMOVED, Group: name, Rule: portableRuleExpression(a.Groups, rule), Before: rule.Description})
+			} else if other.Description != rule.Description {
+				changes = append(changes, DiffChange{Kind: DIFF_RULE, Op: DIFF_MODIFIED, Group: name, Rule: portableRuleExpression(a.Groups, rule), Before: rule.Description, After: other.Description})
+			}
+		}
+		for key, rule := range rb {
+			if _, ok := ra[key]; !ok {
+				changes = append(changes, DiffChange{Kind: DIFF_RULE, Op: DIFF_ADDED, Group: name, Rule: portableRuleExpression(b.Groups, rule), After: rule.Description})
+			}
+		}
+		sort.Slice(changes, func(i, j int) bool {
+			if changes[i].Rule != changes[j].Rule {
+				return changes[i].Rule < changes[j].Rule
+			}
+			return changes[i].Op < changes[j].Op
+		})
+		d.Changes = append(d.Changes, changes...)
+	}
+
+	// Attachments
+	pa, pb := map[string]SnapshotPort{}, map[string]SnapshotPort{}
+	ids := map[string]bool{}
+	for _, p := range a.Ports {
+		pa[p.ID] = p
+		ids[p.ID] = true
+	}
+	for _, p := range b.Ports {
+		pb[p.ID] = p
+		ids[p.ID] = true
+	}
+	for _, id := range sortedKeys(ids) {
+		before, after := map[string]bool{}, map[string]bool{}
+		device := pb[id].DeviceID
+		for _, name := range pa[id].SecurityGroups {
+			before[name] = true
+		}
+		for _, name := range pb[id].SecurityGroups {
+			after[name] = true
+		}
+		if device == "" {
+			device = pa[id].DeviceID
+		}
+
+		all := map[string]bool{}
+		for name := range before {
+			all[name] = true
+		}
+		for name := range after {
+			all[name] = true
+		}
+		for _, name := range sortedKeys(all) {
+			if !after[name] {
+				d.Changes = append(d.Changes, DiffChange{Kind: DIFF_ATTACHMENT, Op: DIFF_REMOVED, Group: name, Port: id, Device: device})
+			} else if !before[name] {
+				d.Changes = append(d.Changes, DiffChange{Kind: DIFF_ATTACHMENT, Op: DIFF_ADDED, Group: name, Port: id, Device: device})
+			}
+		}
+	}
+	return d
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Compare the saved snapshot with the current groups and attachments.
+func DiffLive(os *OpenStack, snap *Snapshot) (*SnapshotDiff, error) {
+	live, err := TakeSnapshot(os, "live")
+	if err != nil {
+		return nil, err
+	}
+	return DiffSnapshots(snap, live), nil
+}
+
+// Format the differences like unified diff.
+func (d *SnapshotDiff) Unified() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "--- %s\t%s\n", d.From.Name, d.From.Created.Local().Format(time.RFC3339))
+	fmt.Fprintf(&buf, "+++ %s\t%s\n", d.To.Name, d.To.Created.Local().Format(time.RFC3339))
+
+	signs := map[string]string{
+		DIFF_ADDED:   "+",
+		DIFF_REMOVED: "-",
+	}
+	hunk := ""
+	for _, c := range d.Changes {
+		h := "group " + c.Group
+		if c.Kind == DIFF_ATTACHMENT {
+			h = fmt.Sprintf("port %s (device %s)", c.Port, c.Device)
+		}
+		if h != hunk {
+			fmt.Fprintf(&buf, "@@ %s @@\n", h)
+			hunk = h
+		}
+
+		switch c.Kind {
+		case DIFF_GROUP:
+			if c.Op == DIFF_MODIFIED {
+				fmt.Fprintf(&buf, "-description %q\n+description %q\n", c.Before, c.After)
+			} else {
+				fmt.Fprintf(&buf, "%sgroup %s %q\n", signs[c.Op], c.Group, c.Before+c.After)
+			}
+
+		case DIFF_RULE:
+			// The description is shown as a comment.
+			comment := func(desc string) string {
+				if desc == "" {
+					return ""
+				}
+				return "  # " + desc
+			}
+			if c.Op == DIFF_MODIFIED {
+				fmt.Fprintf(&buf, "-%s%s\n+%s%s\n", c.Rule, comment(c.Before), c.Rule, comment(c.After))
+			} else {
+				fmt.Fprintf(&buf, "%s%s%s\n", signs[c.Op], c.Rule, comment(c.Before+c.After))
+			}
+
+		case DIFF_ATTACHMENT:
+			fmt.Fprintf(&buf, "%s%s\n", signs[c.Op], c.Group)
+		}
+	}
+	return buf.String()
+}
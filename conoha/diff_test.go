@@ -0,0 +1,73 @@
+package conoha
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	sgs, ps := snapshotTestData()
+	a := NewSnapshot("before", sgs, ps)
+
+	// app was recreated with new UUID, a rule of db was replaced and described,
+	// a group was added, and the attachments were changed.
+	db := testRule("db-3", "in tcp/5432 from group:app")
+	db.RemoteGroupID = "app-id2"
+	described := testRule("db-4", "in tcp/22 from 10.0.0.0/8")
+	described.Description = "ssh"
+
+	current := []groups.SecGroup{
+		{ID: "app-id2", Name: "app", Description: "[owner=web]", Rules: []rules.SecGroupRule{testRule("app-2", "out all")}},
+		{ID: "db-id", Name: "db", Description: "database", Rules: []rules.SecGroupRule{db, described, testRule("db-5", "in tcp/3306")}},
+		{ID: "sys-id", Name: "default", Rules: []rules.SecGroupRule{testRule("sys-1", "in all")}},
+		{ID: "web-id", Name: "web", Rules: []rules.SecGroupRule{}},
+	}
+	currentPorts := []ports.Port{
+		{ID: "p1", DeviceID: "vps1", SecurityGroups: []string{"db-id", "web-id"}},
+	}
+	b := NewSnapshot("live", current, currentPorts)
+
+	d := DiffSnapshots(a, b)
+	expected := []DiffChange{
+		{Kind: DIFF_GROUP, Op: DIFF_MODIFIED, Group: "db", Before: "", After: "database"},
+		{Kind: DIFF_RULE, Op: DIFF_MODIFIED, Group: "db", Rule: "in tcp/22 from 10.0.0.0/8", Before: "", After: "ssh"},
+		{Kind: DIFF_RULE, Op: DIFF_ADDED, Group: "db", Rule: "in tcp/3306"},
+		{Kind: DIFF_GROUP, Op: DIFF_ADDED, Group: "web"},
+		{Kind: DIFF_ATTACHMENT, Op: DIFF_REMOVED, Group: "default", Port: "p1", Device: "vps1"},
+		{Kind: DIFF_ATTACHMENT, Op: DIFF_ADDED, Group: "web", Port: "p1", Device: "vps1"},
+		{Kind: DIFF_ATTACHMENT, Op: DIFF_REMOVED, Group: "app", Port: "p2", Device: "vps2"},
+	}
+	if len(d.Changes) != len(expected) {
+		t.Fatalf("%d changes should be found. %v", len(expected), d.Changes)
+	}
+	for i, c := range d.Changes {
+		if c != expected[i] {
+			t.Errorf("unexpected change.\n%v\n%v", expected[i], c)
+		}
+	}
+
+	unified := d.Unified()
+	lines := []string{
+		"--- before\t",
+		"+++ live\t",
+		"@@ group db @@\n-description \"\"\n+description \"database\"\n",
+		"-in tcp/22 from 10.0.0.0/8\n+in tcp/22 from 10.0.0.0/8  # ssh\n",
+		"+in tcp/3306\n",
+		"@@ group web @@\n+group web \"\"\n",
+		"@@ port p1 (device vps1) @@\n-default\n+web\n",
+		"@@ port p2 (device vps2) @@\n-app\n",
+	}
+	for _, l := range lines {
+		if !strings.Contains(unified, l) {
+			t.Errorf("%q should be in the diff.\n%s", l, unified)
+		}
+	}
+
+	if d = DiffSnapshots(a, a); len(d.Changes) != 0 {
+		t.Errorf("same snapshots should have no changes. %v", d.Changes)
+	}
+}
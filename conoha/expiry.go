@@ -0,0 +1,132 @@
+package conoha
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+)
+
+// Labels to manage security groups and rules by conoha-net.
+const (
+	LABEL_MANAGED_BY = "managed-by"
+	LABEL_EXPIRES    = "expires"
+
+	MANAGED_BY_CONOHA_NET = "conoha-net"
+)
+
+// Parse TTL such as "30m", "2h" or "7d".
+func ParseTTL(ttl string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+
+	if strings.HasSuffix(ttl, "d") {
+		var days int
+		days, err = strconv.Atoi(strings.TrimSuffix(ttl, "d"))
+		d = time.Duration(days) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(ttl)
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf(`Invalid TTL. (e.g. "30m", "2h", "7d") [%s]`, ttl)
+	} else if d <= 0 {
+		return 0, fmt.Errorf("TTL must be positive. [%s]", ttl)
+	}
+	return d, nil
+}
+
+// Return the labels to make the rule managed by conoha-net and expire at the time.
+func ExpiryLabels(expires time.Time) []string {
+	return []string{
+		LABEL_MANAGED_BY + "=" + MANAGED_BY_CONOHA_NET,
+		LABEL_EXPIRES + "=" + expires.UTC().Format(time.RFC3339),
+	}
+}
+
+// Return whether the annotation is managed by conoha-net.
+func (a Annotation) IsManaged() bool {
+	return a.Labels[LABEL_MANAGED_BY] == MANAGED_BY_CONOHA_NET
+}
+
+// Return the expiry of the annotation.
+func (a Annotation) Expiry() (expires time.Time, ok bool) {
+	v, ok := a.Labels[LABEL_EXPIRES]
+	if !ok {
+		return expires, false
+	}
+
+	expires, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return expires, false
+	}
+	return expires, true
+}
+
+// A rule that has expired.
+type ExpiredRule struct {
+	Group   groups.SecGroup
+	Rule    rules.SecGroupRule
+	Expires time.Time
+}
+
+// Return the rules managed by conoha-net that have expired at now.
+// Labels of the groups are not inherited, so only rules stamped the expiry are returned.
+func ExpiredRules(sgs []groups.SecGroup, now time.Time) []ExpiredRule {
+	expired := make([]ExpiredRule, 0)
+	for _, sg := range sgs {
+		for _, rule := range sg.Rules {
+			a := ParseAnnotation(rule.Description)
+			if !a.IsManaged() {
+				continue
+			}
+
+			expires, ok := a.Expiry()
+			if ok && !expires.After(now) {
+				expired = append(expired, ExpiredRule{
+					Group:   sg,
+					Rule:    rule,
+					Expires: expires,
+				})
+			}
+		}
+	}
+	return expired
+}
+
+// Delete the rules managed by conoha-net that have expired at now, and return them.
+// If dryRun is true, the rules are not deleted.
+// Rules that have already been deleted (e.g. by another process) are ignored.
+func Reap(os *OpenStack, now time.Time, dryRun bool) ([]ExpiredRule, error) {
+	sgs, err := ListGroup(os)
+	if err != nil {
+		return nil, err
+	}
+
+	expired := ExpiredRules(sgs, now)
+	if dryRun {
+		return expired, nil
+	}
+
+	reaped := make([]ExpiredRule, 0, len(expired))
+	failed := make([]string, 0)
+	for _, e := range expired {
+		err := DeleteRule(os, e.Rule.ID)
+		if _, ok := err.(gophercloud.ErrDefault404); ok {
+			continue
+		} else if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", e.Rule.ID, err))
+			continue
+		}
+		reaped = append(reaped, e)
+	}
+
+	if len(failed) > 0 {
+		return reaped, fmt.Errorf("Failed to delete the expired rules. [%s]", strings.Join(failed, ", "))
+	}
+	return reaped, nil
+}
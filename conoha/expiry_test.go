@@ -0,0 +1,59 @@
+package conoha
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+)
+
+func TestParseTTL(t *testing.T) {
+	datasets := map[string]time.Duration{
+		"30m": 30 * time.Minute,
+		"2h":  2 * time.Hour,
+		"7d":  7 * 24 * time.Hour,
+	}
+	for input, expected := range datasets {
+		d, err := ParseTTL(input)
+		if err != nil {
+			t.Errorf("%s: %v", input, err)
+		} else if d != expected {
+			t.Errorf("%s: should be %s, but %s", input, expected, d)
+		}
+	}
+
+	for _, input := range []string{"", "2", "-1h", "0d", "xd"} {
+		if _, err := ParseTTL(input); err == nil {
+			t.Errorf("%s should be invalid", input)
+		}
+	}
+}
+
+func TestExpiredRules(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	expired, _ := BuildDescription("vendor", ExpiryLabels(now.Add(-time.Minute)))
+	alive, _ := BuildDescription("vendor", ExpiryLabels(now.Add(time.Minute)))
+	unmanaged, _ := BuildDescription("manual", []string{"expires=" + now.Add(-time.Hour).Format(time.RFC3339)})
+
+	sgs := []groups.SecGroup{
+		{
+			Name: "web",
+			Rules: []rules.SecGroupRule{
+				{ID: "expired", Description: expired},
+				{ID: "alive", Description: alive},
+				{ID: "unmanaged", Description: unmanaged},
+				{ID: "plain"},
+			},
+		},
+	}
+
+	rs := ExpiredRules(sgs, now)
+	if len(rs) != 1 || rs[0].Rule.ID != "expired" || rs[0].Group.Name != "web" {
+		t.Errorf("only the expired managed rule should be returned. %v", rs)
+	}
+	if !rs[0].Expires.Equal(now.Add(-time.Minute)) {
+		t.Errorf("unexpected expiry. %s", rs[0].Expires)
+	}
+}
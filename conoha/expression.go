@@ -0,0 +1,191 @@
+package conoha
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+)
+
+// Prefix of remote group in rule expressions. (e.g. "in tcp/22 from group:web")
+const RULE_EXPR_GROUP_PREFIX = "group:"
+
+// Parse a one-line rule expression and return RuleCreateOpts.
+//
+// The syntax is:
+//
+//	<in|out> [ipv4|ipv6|both] <protocol>[/<port-range>] [<from|to> <cidr|group:name|any>]
+//
+// For example "in tcp/22 from 1.2.3.0/24", "out udp/53 to ::/0" or "in icmp from group:web".
+// SecurityGroupName of the returned value is empty.
+// If the ether type is omitted, it is detected from the remote IP prefix (IPv4 by default).
+func ParseRule(expr string) (r RuleCreateOpts, err error) {
+	tokens := strings.Fields(strings.ToLower(expr))
+	if len(tokens) == 0 {
+		return r, fmt.Errorf("Empty rule expression.")
+	}
+	next := func() string {
+		if len(tokens) == 0 {
+			return ""
+		}
+		t := tokens[0]
+		tokens = tokens[1:]
+		return t
+	}
+
+	// direction
+	switch t := next(); t {
+	case "in", "ingress":
+		r.Direction = "ingress"
+	case "out", "egress":
+		r.Direction = "egress"
+	default:
+		return r, fmt.Errorf(`Rule expression must start with "in" or "out". [%s]`, t)
+	}
+
+	// ether type (optional)
+	t := next()
+	switch t {
+	case "ipv4":
+		r.EtherType = "IPv4"
+		t = next()
+	case "ipv6":
+		r.EtherType = "IPv6"
+		t = next()
+	case ETHER_TYPE_BOTH:
+		r.EtherType = ETHER_TYPE_BOTH
+		t = next()
+	}
+
+	// protocol and port range
+	if t == "" {
+		return r, fmt.Errorf("Protocol is missing in the rule expression. [%s]", expr)
+	}
+	if p := strings.Index(t, "/"); p >= 0 {
+		r.Protocol = t[:p]
+		r.PortRange = t[p+1:]
+		if r.PortRange == "" {
+			return r, fmt.Errorf("Port range is missing in the rule expression. [%s]", expr)
+		}
+	} else {
+		r.Protocol = t
+	}
+	if r.Protocol == "any" {
+		r.Protocol = "all"
+	}
+
+	// remote
+	if t = next(); t != "" {
+		if t != "from" && t != "to" {
+			return r, fmt.Errorf(`Expected "from" or "to", but got "%s". [%s]`, t, expr)
+		}
+
+		remote := next()
+		if remote == "" {
+			return r, fmt.Errorf(`Remote is missing after "%s". [%s]`, t, expr)
+		}
+
+		if strings.HasPrefix(remote, RULE_EXPR_GROUP_PREFIX) {
+			// restore the case of group name
+			r.RemoteGroupID = originalToken(expr, remote)[len(RULE_EXPR_GROUP_PREFIX):]
+			if r.RemoteGroupID == "" {
+				return r, fmt.Errorf("Group name is missing. [%s]", expr)
+			}
+		} else if remote != "any" {
+			r.RemoteIPPrefix = remote
+		}
+	}
+
+	if len(tokens) > 0 {
+		return r, fmt.Errorf("Unexpected token in the rule expression. [%s]", strings.Join(tokens, " "))
+	}
+
+	if r.EtherType == "" {
+		if strings.Contains(r.RemoteIPPrefix, ":") {
+			r.EtherType = "IPv6"
+		} else {
+			r.EtherType = "IPv4"
+		}
+	}
+	return r, nil
+}
+
+// Return the token in expr that matches lowered token case-insensitively.
+func originalToken(expr string, lowered string) string {
+	for _, t := range strings.Fields(expr) {
+		if strings.ToLower(t) == lowered {
+			return t
+		}
+	}
+	return lowered
+}
+
+// Set the fields from a security group rule.
+// SecurityGroupName is not changed since rules.SecGroupRule has only the group ID.
+func (r *RuleCreateOpts) FromSecGroupRule(rule rules.SecGroupRule) {
+	r.Direction = rule.Direction
+	r.EtherType = rule.EtherType
+	r.Protocol = ProtocolName(rule.Protocol)
+
+	r.PortRange = ""
+	if isICMP(r.Protocol) {
+		r.PortRange = formatICMPTypeCode(r.Protocol, rule.PortRangeMin, rule.PortRangeMax)
+	} else if rule.PortRangeMin != 0 || rule.PortRangeMax != 0 {
+		if rule.PortRangeMin == rule.PortRangeMax {
+			r.PortRange = fmt.Sprintf("%d", rule.PortRangeMin)
+		} else {
+			r.PortRange = fmt.Sprintf("%d-%d", rule.PortRangeMin, rule.PortRangeMax)
+		}
+	}
+
+	r.RemoteGroupID = rule.RemoteGroupID
+	r.RemoteIPPrefix = rule.RemoteIPPrefix
+	r.Description = rule.Description
+}
+
+// Format the rule as a one-line rule expression that can be parsed by ParseRule.
+func (r RuleCreateOpts) String() string {
+	var buf []string
+
+	if r.Direction == "egress" {
+		buf = append(buf, "out")
+	} else {
+		buf = append(buf, "in")
+	}
+
+	// The ether type is omitted if it can be detected from the remote IP prefix.
+	if strings.EqualFold(r.EtherType, ETHER_TYPE_BOTH) {
+		buf = append(buf, ETHER_TYPE_BOTH)
+	} else if r.RemoteIPPrefix == "" || r.RemoteGroupID != "" {
+		if r.EtherType == "IPv6" {
+			buf = append(buf, "ipv6")
+		}
+	} else if strings.Contains(r.RemoteIPPrefix, ":") != (r.EtherType == "IPv6") {
+		buf = append(buf, strings.ToLower(r.EtherType))
+	}
+
+	proto := r.Protocol
+	if proto == "" {
+		proto = "all"
+	}
+	if r.PortRange != "" {
+		proto += "/" + strings.Replace(strings.Replace(r.PortRange, ":", "-", -1), " ", "", -1)
+	}
+	buf = append(buf, proto)
+
+	if r.RemoteGroupID != "" || r.RemoteIPPrefix != "" {
+		if r.Direction == "egress" {
+			buf = append(buf, "to")
+		} else {
+			buf = append(buf, "from")
+		}
+
+		if r.RemoteGroupID != "" {
+			buf = append(buf, RULE_EXPR_GROUP_PREFIX+r.RemoteGroupID)
+		} else {
+			buf = append(buf, r.RemoteIPPrefix)
+		}
+	}
+
+	return strings.Join(buf, " ")
+}
@@ -0,0 +1,116 @@
+package conoha
+
+import (
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+)
+
+func TestParseRule(t *testing.T) {
+	datasets := map[string]RuleCreateOpts{
+		"in tcp/22 from 1.2.3.0/24": {
+			Direction:      "ingress",
+			EtherType:      "IPv4",
+			Protocol:       "tcp",
+			PortRange:      "22",
+			RemoteIPPrefix: "1.2.3.0/24",
+		},
+		"out udp/53 to ::/0": {
+			Direction:      "egress",
+			EtherType:      "IPv6",
+			Protocol:       "udp",
+			PortRange:      "53",
+			RemoteIPPrefix: "::/0",
+		},
+		"in icmp from group:Web": {
+			Direction:     "ingress",
+			EtherType:     "IPv4",
+			Protocol:      "icmp",
+			RemoteGroupID: "Web",
+		},
+		"IN ipv6 tcp/8000-8100": {
+			Direction: "ingress",
+			EtherType: "IPv6",
+			Protocol:  "tcp",
+			PortRange: "8000-8100",
+		},
+		"egress any to any": {
+			Direction: "egress",
+			EtherType: "IPv4",
+			Protocol:  "all",
+		},
+	}
+
+	for expr, expected := range datasets {
+		r, err := ParseRule(expr)
+		if err != nil {
+			t.Errorf("%s: %v", expr, err)
+			continue
+		}
+		if r != expected {
+			t.Errorf("%s: unexpected result. %#v", expr, r)
+		}
+	}
+
+	invalids := []string{
+		"",
+		"sideways tcp/22",
+		"in",
+		"in tcp/",
+		"in tcp/22 via 1.2.3.0/24",
+		"in tcp/22 from",
+		"in tcp/22 from group:",
+		"in tcp/22 from 1.2.3.0/24 extra",
+	}
+	for _, expr := range invalids {
+		if _, err := ParseRule(expr); err == nil {
+			t.Errorf("%s: should be invalid", expr)
+		}
+	}
+}
+
+func TestRuleString(t *testing.T) {
+	exprs := []string{
+		"in tcp/22 from 1.2.3.0/24",
+		"out udp/53 to ::/0",
+		"in icmp from group:web",
+		"in ipv6 tcp/8000-8100",
+		"out all",
+		"in ipv4 all from ::/0",
+		"in both tcp/80,443",
+	}
+
+	for _, expr := range exprs {
+		r, err := ParseRule(expr)
+		if err != nil {
+			t.Errorf("%s: %v", expr, err)
+			continue
+		}
+		if r.String() != expr {
+			t.Errorf("%s: formatted as %s", expr, r.String())
+		}
+	}
+}
+
+func TestFromSecGroupRule(t *testing.T) {
+	var r RuleCreateOpts
+	r.FromSecGroupRule(rules.SecGroupRule{
+		Direction:      "ingress",
+		EtherType:      "IPv4",
+		Protocol:       "tcp",
+		PortRangeMin:   80,
+		PortRangeMax:   8080,
+		RemoteIPPrefix: "192.168.0.0/24",
+	})
+	if r.String() != "in tcp/80-8080 from 192.168.0.0/24" {
+		t.Errorf("unexpected expression. %s", r.String())
+	}
+
+	r.FromSecGroupRule(rules.SecGroupRule{
+		Direction: "egress",
+		EtherType: "IPv6",
+	})
+	if r.String() != "out ipv6 all" {
+		t.Errorf("unexpected expression. %s", r.String())
+	}
+}
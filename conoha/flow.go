@@ -0,0 +1,360 @@
+package conoha
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+)
+
+// A packet to be evaluated against the security groups of a port.
+// Security groups are stateful, so only the direction that initiates the connection is evaluated.
+type Flow struct {
+	// "ingress" (from Remote to the port) or "egress" (from the port to Remote)
+	Direction string
+
+	// Protocol name or number. (e.g. "tcp", "icmp", "gre")
+	Protocol string
+
+	// Destination port. For ICMP, the type and code (0 for unspecified code).
+	Port int
+	Code int
+
+	// Address of the other end
+	Remote net.IP
+}
+
+// Parse and validate the flow.
+// The port is the port number, or the ICMP type and code. (e.g. "5432", "echo-request", "3/4")
+func NewFlow(direction string, protocol string, port string, remote string) (Flow, error) {
+	var f Flow
+	var err error
+	if f.Direction, err = NormalizeDirection(direction); err != nil {
+		return f, err
+	}
+
+	if f.Protocol, err = NormalizeProtocol(protocol); err != nil {
+		return f, err
+	} else if f.Protocol == "" {
+		return f, fmt.Errorf("Must specify the protocol of the flow.")
+	}
+
+	if isICMP(f.Protocol) {
+		if f.Port, f.Code, err = parseICMPTypeCode(f.Protocol, port); err != nil {
+			return f, err
+		}
+	} else if hasPorts(f.Protocol) {
+		if f.Port, err = strconv.Atoi(port); err != nil || f.Port < 1 || f.Port > 65535 {
+			return f, fmt.Errorf("Port must be between 1 and 65535. [%s]", port)
+		}
+	}
+
+	if f.Remote = net.ParseIP(remote); f.Remote == nil {
+		return f, fmt.Errorf("Invalid IP address. [%s]", remote)
+	}
+	return f, nil
+}
+
+// Return the ether type of the flow.
+func (f Flow) EtherType() string {
+	if f.Remote.To4() != nil {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+func (f Flow) String() string {
+	arrow := "from"
+	if f.Direction == "egress" {
+		arrow = "to"
+	}
+
+	port := ""
+	if hasPorts(f.Protocol) || isICMP(f.Protocol) {
+		port = fmt.Sprintf("/%d", f.Port)
+		if isICMP(f.Protocol) && f.Code != 0 {
+			port += fmt.Sprintf("/%d", f.Code)
+		}
+	}
+	return fmt.Sprintf("%s %s%s %s %s", f.Direction, f.Protocol, port, arrow, f.Remote)
+}
+
+// A rule that permits the flow.
+type FlowMatch struct {
+	Group groups.SecGroup
+	Rule  rules.SecGroupRule
+
+	// VPS of the remote group that have the remote address
+	Members []Vps
+}
+
+// Result of the flow evaluation.
+type FlowResult struct {
+	Flow    Flow
+	Allowed bool
+	Groups  []groups.SecGroup
+	Matches []FlowMatch
+}
+
+// Return the addresses of VPS.
+func (v *Vps) Addresses() []net.IP {
+	addrs := make([]net.IP, 0, 2)
+	seen := map[string]bool{}
+	add := func(ip net.IP) {
+		if ip != nil && !seen[ip.String()] {
+			seen[ip.String()] = true
+			addrs = append(addrs, ip)
+		}
+	}
+
+	add(v.ExternalIPv4Address)
+	add(v.ExternalIPv6Address)
+	for _, p := range v.Ports {
+		for _, fip := range p.FixedIPs {
+			add(net.ParseIP(fip.IPAddress))
+		}
+	}
+	return addrs
+}
+
+// Return whether the groups of the ports are known.
+func (v *Vps) hasPortGroups() bool {
+	for _, p := range v.Ports {
+		if p.SecurityGroups != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Return whether VPS is a member of the security group.
+// If the groups of the ports are known, VPS is a member when one of the ports has the group.
+func (v *Vps) HasGroup(sg groups.SecGroup) bool {
+	if v.hasPortGroups() {
+		for _, p := range v.Ports {
+			if p.hasGroup(sg) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, g := range v.SecurityGroups {
+		if (g.ID != "" && g.ID == sg.ID) || (g.ID == "" && g.Name == sg.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *AttachedPort) hasGroup(sg groups.SecGroup) bool {
+	for _, id := range p.SecurityGroups {
+		if id == sg.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the addresses of VPS that are the members of the security group.
+// Only the addresses of the ports that have the group are members, because the group is bound to the port.
+// If the groups of the ports are unknown, all addresses are returned for the member VPS.
+func (v *Vps) GroupAddresses(sg groups.SecGroup) []net.IP {
+	if !v.hasPortGroups() {
+		if v.HasGroup(sg) {
+			return v.Addresses()
+		}
+		return nil
+	}
+
+	addrs := make([]net.IP, 0, 2)
+	for _, p := range v.Ports {
+		if !p.hasGroup(sg) {
+			continue
+		}
+		for _, fip := range p.FixedIPs {
+			if ip := net.ParseIP(fip.IPAddress); ip != nil {
+				addrs = append(addrs, ip)
+			}
+		}
+	}
+	return addrs
+}
+
+// Return whether the rule matches the flow except the remote.
+func (f Flow) matchesRule(rule rules.SecGroupRule) bool {
+	if rule.Direction != f.Direction || rule.EtherType != f.EtherType() {
+		return false
+	}
+
+	proto := ProtocolName(rule.Protocol)
+	if proto == "all" {
+		return true
+	} else if proto != f.Protocol {
+		return false
+	}
+
+	min, max := rule.PortRangeMin, rule.PortRangeMax
+	if isICMP(proto) {
+		// Type 0 means any type, and code 0 means any code.
+		return (min == 0 || min == f.Port) && (max == 0 || max == f.Code)
+	} else if hasPorts(proto) && !(min == 0 && max == 0) {
+		return min <= f.Port && f.Port <= max
+	}
+	return true
+}
+
+// Evaluate the flow against the security groups bound to the port.
+//
+// sgs are all security groups to look up the remote groups, and vpss are all VPS
+// whose addresses are the members of the remote groups.
+func EvaluateFlow(flow Flow, bound []groups.SecGroup, sgs []groups.SecGroup, vpss []Vps) FlowResult {
+	result := FlowResult{
+		Flow:    flow,
+		Groups:  bound,
+		Matches: []FlowMatch{},
+	}
+
+	for _, sg := range bound {
+		for _, rule := range sg.Rules {
+			if !flow.matchesRule(rule) {
+				continue
+			}
+
+			members, ok := matchesRemote(rule, flow.Remote, sgs, vpss)
+			if !ok {
+				continue
+			}
+			result.Matches = append(result.Matches, FlowMatch{Group: sg, Rule: rule, Members: members})
+		}
+	}
+
+	result.Allowed = len(result.Matches) > 0
+	return result
+}
+
+// Return whether the remote prefix or the remote group of the rule contains the address.
+// For the remote group, VPS whose ports of the group have the address are returned.
+func matchesRemote(rule rules.SecGroupRule, remote net.IP, sgs []groups.SecGroup, vpss []Vps) (members []Vps, ok bool) {
+	if rule.RemoteGroupID != "" {
+		sg, err := FindGroup(sgs, rule.RemoteGroupID)
+		if err != nil {
+			// dangling reference
+			return nil, false
+		}
+		for _, vps := range vpss {
+			for _, ip := range vps.GroupAddresses(*sg) {
+				if ip.Equal(remote) {
+					members = append(members, vps)
+					break
+				}
+			}
+		}
+		return members, len(members) > 0
+
+	} else if rule.RemoteIPPrefix != "" {
+		_, ipnet, err := net.ParseCIDR(rule.RemoteIPPrefix)
+		return nil, err == nil && ipnet.Contains(remote)
+	}
+	return nil, true
+}
+
+// Set the ports of VPS from all ports of the tenant, so that their addresses are available without calling API for each VPS.
+func PopulateVpsPorts(vpss []Vps, ps []ports.Port) {
+	for i := range vpss {
+		vpss[i].Ports = make([]AttachedPort, 0, 1)
+		for _, p := range ps {
+			if p.DeviceID == vpss[i].ID {
+				vpss[i].Ports = append(vpss[i].Ports, AttachedPort{
+					PortId:    p.ID,
+					PortState: p.Status,
+					FixedIPs:  p.FixedIPs,
+
+					SecurityGroups: append([]string{}, p.SecurityGroups...),
+				})
+			}
+		}
+	}
+}
+
+// Return the port of VPS that the flow passes.
+// The port that has a private address is chosen for a private remote address,
+// and the internet-facing port is chosen for a global one.
+func FlowPort(ps []ports.Port, vps *Vps, remote net.IP) (*ports.Port, error) {
+	var fallback *ports.Port
+	private := privateAddresses.Contains(remote)
+	v4 := remote.To4() != nil
+
+	for i := range ps {
+		p := &ps[i]
+		if p.DeviceID != vps.ID {
+			continue
+		}
+		if fallback == nil {
+			fallback = p
+		}
+
+		for _, fip := range p.FixedIPs {
+			ip := net.ParseIP(fip.IPAddress)
+			if ip == nil || (ip.To4() != nil) != v4 {
+				continue
+			}
+			if privateAddresses.Contains(ip) == private {
+				return p, nil
+			}
+		}
+	}
+
+	if fallback == nil {
+		return nil, fmt.Errorf("VPS has no ports. [%s]", vps.NameTag)
+	}
+	return fallback, nil
+}
+
+// Evaluate the flow against the security groups of the port of VPS.
+// If portID is empty, the port is chosen by FlowPort.
+func CheckFlow(os *OpenStack, vps *Vps, flow Flow, portID string) (*FlowResult, *ports.Port, error) {
+	sgs, err := ListGroup(os)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vpss, err := ListVps(os, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ps, err := ListPorts(os)
+	if err != nil {
+		return nil, nil, err
+	}
+	PopulateVpsPorts(vpss, ps)
+
+	var port *ports.Port
+	if portID != "" {
+		for i := range ps {
+			if ps[i].ID == portID && ps[i].DeviceID == vps.ID {
+				port = &ps[i]
+			}
+		}
+		if port == nil {
+			return nil, nil, fmt.Errorf("The port is not attached to VPS. [%s]", portID)
+		}
+	} else if port, err = FlowPort(ps, vps, flow.Remote); err != nil {
+		return nil, nil, err
+	}
+
+	bound := make([]groups.SecGroup, 0, len(port.SecurityGroups))
+	for _, id := range port.SecurityGroups {
+		sg, err := FindGroup(sgs, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		bound = append(bound, *sg)
+	}
+
+	result := EvaluateFlow(flow, bound, sgs, vpss)
+	return &result, port, nil
+}
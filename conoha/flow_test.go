@@ -0,0 +1,168 @@
+package conoha
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/secgroups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+)
+
+func flowTestData() ([]groups.SecGroup, []Vps) {
+	db := testRule("db-1", "in tcp/5432 from group:app")
+	db.RemoteGroupID = "app-id"
+
+	sgs := []groups.SecGroup{
+		{
+			ID:   "db-id",
+			Name: "db",
+			Rules: []rules.SecGroupRule{
+				db,
+				testRule("db-2", "in tcp/22 from 10.1.0.0/16"),
+				testRule("db-3", "in icmp/echo-request"),
+				testRule("db-4", "out all"),
+			},
+		},
+		{
+			ID:    "app-id",
+			Name:  "app",
+			Rules: []rules.SecGroupRule{},
+		},
+	}
+
+	vpss := []Vps{
+		{
+			ID:             "app1",
+			NameTag:        "app1",
+			SecurityGroups: []secgroups.SecurityGroup{{Name: "app"}},
+			Ports: []AttachedPort{
+				{PortId: "app1-private", FixedIPs: []ports.IP{{IPAddress: "10.1.2.3"}}},
+			},
+		},
+		{
+			ID:                  "web1",
+			NameTag:             "web1",
+			ExternalIPv4Address: net.ParseIP("203.0.113.20"),
+			SecurityGroups:      []secgroups.SecurityGroup{{Name: "web"}},
+		},
+	}
+	return sgs, vpss
+}
+
+func TestEvaluateFlow(t *testing.T) {
+	sgs, vpss := flowTestData()
+	bound := sgs[:1]
+
+	tests := []struct {
+		direction string
+		protocol  string
+		port      string
+		remote    string
+		allowed   bool
+		rule      string
+	}{
+		{"ingress", "tcp", "5432", "10.1.2.3", true, "db-1"},
+		{"ingress", "tcp", "5432", "203.0.113.20", false, ""},
+		{"ingress", "tcp", "22", "10.1.2.3", true, "db-2"},
+		{"ingress", "tcp", "22", "10.2.0.1", false, ""},
+		{"ingress", "udp", "22", "10.1.2.3", false, ""},
+		{"ingress", "icmp", "8", "198.51.100.1", true, "db-3"},
+		{"ingress", "icmp", "3/4", "198.51.100.1", false, ""},
+		{"egress", "udp", "53", "8.8.8.8", true, "db-4"},
+		{"egress", "udp", "53", "2001:db8::1", false, ""},
+	}
+
+	for _, test := range tests {
+		flow, err := NewFlow(test.direction, test.protocol, test.port, test.remote)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		result := EvaluateFlow(flow, bound, sgs, vpss)
+		if result.Allowed != test.allowed {
+			t.Errorf("%s should be allowed=%v", flow, test.allowed)
+			continue
+		}
+		if test.allowed && (len(result.Matches) != 1 || result.Matches[0].Rule.ID != test.rule) {
+			t.Errorf("%s should be permitted by %s. %v", flow, test.rule, result.Matches)
+		}
+	}
+
+	// Members of the remote group
+	flow, _ := NewFlow("ingress", "tcp", "5432", "10.1.2.3")
+	result := EvaluateFlow(flow, bound, sgs, vpss)
+	if len(result.Matches[0].Members) != 1 || result.Matches[0].Members[0].NameTag != "app1" {
+		t.Errorf("app1 should be the member of the remote group. %v", result.Matches[0].Members)
+	}
+
+	// Only the addresses of the ports that have the remote group are members
+	PopulateVpsPorts(vpss, []ports.Port{
+		{ID: "app1-private", DeviceID: "app1", SecurityGroups: []string{"app-id"}, FixedIPs: []ports.IP{{IPAddress: "10.1.2.3"}}},
+		{ID: "app1-ext", DeviceID: "app1", SecurityGroups: []string{}, FixedIPs: []ports.IP{{IPAddress: "203.0.113.10"}}},
+	})
+	if result = EvaluateFlow(flow, bound, sgs, vpss); !result.Allowed {
+		t.Errorf("%s should be allowed by the port of the remote group", flow)
+	}
+	flow, _ = NewFlow("ingress", "tcp", "5432", "203.0.113.10")
+	if result = EvaluateFlow(flow, bound, sgs, vpss); result.Allowed {
+		t.Errorf("%s should not be allowed, because the port doesn't have the remote group. %v", flow, result.Matches)
+	}
+}
+
+func TestNewFlow(t *testing.T) {
+	invalid := []struct {
+		direction string
+		protocol  string
+		port      string
+		remote    string
+	}{
+		{"sideways", "tcp", "22", "10.0.0.1"},
+		{"ingress", "all", "22", "10.0.0.1"},
+		{"ingress", "tcp", "0", "10.0.0.1"},
+		{"ingress", "tcp", "70000", "10.0.0.1"},
+		{"ingress", "icmp", "300", "10.0.0.1"},
+		{"ingress", "tcp", "22", "10.0.0.0/8"},
+	}
+	for _, test := range invalid {
+		if _, err := NewFlow(test.direction, test.protocol, test.port, test.remote); err == nil {
+			t.Errorf("%v should be an error", test)
+		}
+	}
+
+	flow, err := NewFlow("in", "GRE", "", "10.0.0.1")
+	if err != nil {
+		t.Fatalf("%v", err)
+	} else if flow.String() != "ingress gre from 10.0.0.1" {
+		t.Errorf("unexpected flow. %s", flow)
+	}
+}
+
+func TestFlowPort(t *testing.T) {
+	ps := []ports.Port{
+		{ID: "other", DeviceID: "other", FixedIPs: []ports.IP{{IPAddress: "10.0.0.2"}}},
+		{ID: "ext", DeviceID: "db1", FixedIPs: []ports.IP{{IPAddress: "203.0.113.10"}, {IPAddress: "2001:db8::10"}}},
+		{ID: "private", DeviceID: "db1", FixedIPs: []ports.IP{{IPAddress: "10.0.0.1"}}},
+	}
+	vps := &Vps{ID: "db1"}
+
+	tests := map[string]string{
+		"10.1.2.3":     "private",
+		"198.51.100.1": "ext",
+		"2001:db8::1":  "ext",
+		"fd00::1":      "ext", // fallback
+	}
+	for remote, expected := range tests {
+		p, err := FlowPort(ps, vps, net.ParseIP(remote))
+		if err != nil {
+			t.Fatalf("%v", err)
+		} else if p.ID != expected {
+			t.Errorf("port for %s should be %s, but %s", remote, expected, p.ID)
+		}
+	}
+
+	if _, err := FlowPort(ps, &Vps{ID: "none"}, net.ParseIP("10.0.0.1")); err == nil {
+		t.Errorf("VPS without ports should be an error")
+	}
+}
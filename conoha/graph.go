@@ -0,0 +1,291 @@
+package conoha
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+)
+
+// Kinds of the graph nodes and edges.
+const (
+	GRAPH_NODE_VPS   = "vps"
+	GRAPH_NODE_GROUP = "group"
+	GRAPH_NODE_CIDR  = "cidr"
+
+	GRAPH_EDGE_ATTACH = "attach"
+	GRAPH_EDGE_RULE   = "rule"
+)
+
+// Diagram of VPS, security groups and the remote addresses of the rules.
+//
+// Attachment edges go from a group to VPS. Rule edges go from the source to the destination,
+// so an ingress rule is an edge from the remote group or CIDR to the group.
+type Graph struct {
+	Nodes []GraphNode
+	Edges []GraphEdge
+
+	nodes map[string]int
+	edges map[string]int
+}
+
+type GraphNode struct {
+	ID    string
+	Kind  string
+	Label string
+
+	// Additional lines of the label. (e.g. IP addresses of VPS)
+	Details []string
+}
+
+type GraphEdge struct {
+	From string
+	To   string
+	Kind string
+
+	// Services of the rules (e.g. "tcp/22", "all")
+	Labels []string
+}
+
+// Options to build the graph.
+type GraphOptions struct {
+	// Draw the system groups as a single node without their rules.
+	CollapseSystemGroups bool
+
+	// Draw only the VPS and its groups if not nil.
+	Vps *Vps
+}
+
+func newGraph() *Graph {
+	return &Graph{
+		Nodes: []GraphNode{},
+		Edges: []GraphEdge{},
+		nodes: map[string]int{},
+		edges: map[string]int{},
+	}
+}
+
+// Add the node unless it exists, and return its ID.
+func (g *Graph) addNode(id string, kind string, label string, details ...string) string {
+	if _, ok := g.nodes[id]; !ok {
+		g.nodes[id] = len(g.Nodes)
+		g.Nodes = append(g.Nodes, GraphNode{ID: id, Kind: kind, Label: label, Details: details})
+	}
+	return id
+}
+
+// Add the edge, or the label to the existing edge.
+func (g *Graph) addEdge(from string, to string, kind string, label string) {
+	key := from + "|" + to + "|" + kind
+	i, ok := g.edges[key]
+	if !ok {
+		i = len(g.Edges)
+		g.edges[key] = i
+		g.Edges = append(g.Edges, GraphEdge{From: from, To: to, Kind: kind, Labels: []string{}})
+	}
+
+	if label == "" {
+		return
+	}
+	for _, l := range g.Edges[i].Labels {
+		if l == label {
+			return
+		}
+	}
+	g.Edges[i].Labels = append(g.Edges[i].Labels, label)
+}
+
+// Return the service of the rule. (e.g. "tcp/22", "icmp/echo-request", "all")
+func ruleService(rule rules.SecGroupRule) string {
+	proto := ProtocolName(rule.Protocol)
+	if !hasPorts(proto) && !isICMP(proto) {
+		return proto
+	}
+
+	ports := formatPortRange(proto, rule.PortRangeMin, rule.PortRangeMax)
+	if ports == "all" {
+		return proto
+	}
+	return proto + "/" + ports
+}
+
+// Build the graph of VPS and security groups.
+// VPS should have been populated the ports by PopulateVpsPorts to show the private addresses.
+func BuildGraph(vpss []Vps, sgs []groups.SecGroup, opts GraphOptions) *Graph {
+	g := newGraph()
+
+	groupNode := func(sg groups.SecGroup) string {
+		if opts.CollapseSystemGroups && IsSystemGroup(sg.Name) {
+			return g.addNode("system", GRAPH_NODE_GROUP, "(system groups)")
+		}
+		return g.addNode("group:"+sg.ID, GRAPH_NODE_GROUP, sg.Name)
+	}
+
+	// groups whose rules are drawn
+	shown := make([]groups.SecGroup, 0, len(sgs))
+	seen := map[string]bool{}
+	show := func(sg groups.SecGroup) {
+		if !seen[sg.ID] {
+			seen[sg.ID] = true
+			shown = append(shown, sg)
+		}
+	}
+
+	for _, vps := range vpss {
+		if opts.Vps != nil && vps.ID != opts.Vps.ID {
+			continue
+		}
+
+		addrs := make([]string, 0, 2)
+		for _, ip := range vps.Addresses() {
+			addrs = append(addrs, ip.String())
+		}
+		v := g.addNode("vps:"+vps.ID, GRAPH_NODE_VPS, vps.NameTag, addrs...)
+
+		for _, attached := range vps.SecurityGroups {
+			query := attached.ID
+			if query == "" {
+				query = attached.Name
+			}
+			sg, err := FindGroup(sgs, query)
+			if err != nil {
+				continue
+			}
+			g.addEdge(groupNode(*sg), v, GRAPH_EDGE_ATTACH, "")
+			show(*sg)
+		}
+	}
+
+	if opts.Vps == nil {
+		// unattached groups
+		for _, sg := range sgs {
+			groupNode(sg)
+			show(sg)
+		}
+	}
+
+	for _, sg := range shown {
+		if opts.CollapseSystemGroups && IsSystemGroup(sg.Name) {
+			continue
+		}
+		node := groupNode(sg)
+
+		for _, rule := range sg.Rules {
+			var remote string
+			if rule.RemoteGroupID != "" {
+				if rsg, err := FindGroup(sgs, rule.RemoteGroupID); err == nil {
+					remote = groupNode(*rsg)
+				} else {
+					// dangling reference
+					remote = g.addNode("group:"+rule.RemoteGroupID, GRAPH_NODE_GROUP, rule.RemoteGroupID)
+				}
+			} else {
+				prefix := rule.RemoteIPPrefix
+				if prefix == "" {
+					prefix = anyAddress(rule.EtherType)
+				} else if normalized, _, err := ParsePrefix(prefix); err == nil {
+					prefix = normalized
+				}
+				remote = g.addNode("cidr:"+prefix, GRAPH_NODE_CIDR, prefix)
+			}
+
+			if rule.Direction == "ingress" {
+				g.addEdge(remote, node, GRAPH_EDGE_RULE, ruleService(rule))
+			} else {
+				g.addEdge(node, remote, GRAPH_EDGE_RULE, ruleService(rule))
+			}
+		}
+	}
+	return g
+}
+
+// Build the graph of all VPS and security groups.
+func DrawGraph(os *OpenStack, opts GraphOptions) (*Graph, error) {
+	vpss, err := ListVps(os, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	sgs, err := ListGroup(os)
+	if err != nil {
+		return nil, err
+	}
+
+	ps, err := ListPorts(os)
+	if err != nil {
+		return nil, err
+	}
+	PopulateVpsPorts(vpss, ps)
+
+	return BuildGraph(vpss, sgs, opts), nil
+}
+
+// Format the graph as Graphviz DOT.
+func (g *Graph) DOT() string {
+	var buf bytes.Buffer
+
+	shapes := map[string]string{
+		GRAPH_NODE_VPS:   "box",
+		GRAPH_NODE_GROUP: "ellipse",
+		GRAPH_NODE_CIDR:  "note",
+	}
+
+	buf.WriteString("digraph conoha {\n")
+	buf.WriteString("  rankdir=LR;\n")
+	for _, n := range g.Nodes {
+		label := strings.Replace(dotQuote(strings.Join(append([]string{n.Label}, n.Details...), "\n")), "\n", `\n`, -1)
+		fmt.Fprintf(&buf, "  %s [label=%s, shape=%s];\n", dotQuote(n.ID), label, shapes[n.Kind])
+	}
+	for _, e := range g.Edges {
+		attrs := ""
+		if e.Kind == GRAPH_EDGE_ATTACH {
+			attrs = " [style=dashed]"
+		} else if len(e.Labels) > 0 {
+			attrs = fmt.Sprintf(" [label=%s]", dotQuote(strings.Join(e.Labels, ", ")))
+		}
+		fmt.Fprintf(&buf, "  %s -> %s%s;\n", dotQuote(e.From), dotQuote(e.To), attrs)
+	}
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+// Format the graph as Mermaid flowchart.
+func (g *Graph) Mermaid() string {
+	var buf bytes.Buffer
+
+	// Mermaid IDs can't have the symbols.
+	ids := make(map[string]string, len(g.Nodes))
+	for i, n := range g.Nodes {
+		ids[n.ID] = fmt.Sprintf("n%d", i)
+	}
+
+	buf.WriteString("flowchart LR\n")
+	for _, n := range g.Nodes {
+		label := mermaidQuote(strings.Join(append([]string{n.Label}, n.Details...), "<br/>"))
+		switch n.Kind {
+		case GRAPH_NODE_VPS:
+			fmt.Fprintf(&buf, "  %s[%s]\n", ids[n.ID], label)
+		case GRAPH_NODE_CIDR:
+			fmt.Fprintf(&buf, "  %s>%s]\n", ids[n.ID], label)
+		default:
+			fmt.Fprintf(&buf, "  %s([%s])\n", ids[n.ID], label)
+		}
+	}
+	for _, e := range g.Edges {
+		if e.Kind == GRAPH_EDGE_ATTACH {
+			fmt.Fprintf(&buf, "  %s -.-> %s\n", ids[e.From], ids[e.To])
+		} else if len(e.Labels) > 0 {
+			fmt.Fprintf(&buf, "  %s -->|%s| %s\n", ids[e.From], mermaidQuote(strings.Join(e.Labels, ", ")), ids[e.To])
+		} else {
+			fmt.Fprintf(&buf, "  %s --> %s\n", ids[e.From], ids[e.To])
+		}
+	}
+	return buf.String()
+}
+
+// Quote the string as a Mermaid label.
+func mermaidQuote(s string) string {
+	return `"` + strings.Replace(s, `"`, "#quot;", -1) + `"`
+}
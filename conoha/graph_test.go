@@ -0,0 +1,121 @@
+package conoha
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/secgroups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+)
+
+func graphTestData() ([]Vps, []groups.SecGroup) {
+	db := testRule("db-1", "in tcp/5432 from group:app")
+	db.RemoteGroupID = "app-id"
+
+	sgs := []groups.SecGroup{
+		{
+			ID:   "db-id",
+			Name: "db",
+			Rules: []rules.SecGroupRule{
+				db,
+				testRule("db-2", "in tcp/22 from 10.0.0.0/8"),
+				testRule("db-3", "in tcp/80-90 from 10.0.0.0/8"),
+			},
+		},
+		{
+			ID:    "app-id",
+			Name:  "app",
+			Rules: []rules.SecGroupRule{testRule("app-1", "out all")},
+		},
+		{
+			ID:    "sys1",
+			Name:  "gncs-ipv4-all",
+			Rules: []rules.SecGroupRule{testRule("sys1-1", "in all")},
+		},
+		{
+			ID:    "sys2",
+			Name:  "default",
+			Rules: []rules.SecGroupRule{testRule("sys2-1", "out all")},
+		},
+	}
+
+	vpss := []Vps{
+		{
+			ID:                  "db1",
+			NameTag:             "db1",
+			ExternalIPv4Address: net.ParseIP("203.0.113.1"),
+			SecurityGroups:      []secgroups.SecurityGroup{{Name: "db"}, {Name: "gncs-ipv4-all"}, {Name: "default"}},
+		},
+		{
+			ID:             "app1",
+			NameTag:        "app1",
+			SecurityGroups: []secgroups.SecurityGroup{{Name: "app"}},
+		},
+	}
+	return vpss, sgs
+}
+
+func TestBuildGraph(t *testing.T) {
+	vpss, sgs := graphTestData()
+
+	g := BuildGraph(vpss, sgs, GraphOptions{})
+	if len(g.Nodes) != 8 {
+		t.Errorf("8 nodes should be drawn. %v", g.Nodes)
+	}
+
+	dot := g.DOT()
+	expected := []string{
+		`"vps:db1" [label="db1\n203.0.113.1", shape=box];`,
+		`"cidr:10.0.0.0/8" [label="10.0.0.0/8", shape=note];`,
+		`"group:db-id" -> "vps:db1" [style=dashed];`,
+		`"group:app-id" -> "group:db-id" [label="tcp/5432"];`,
+		`"cidr:10.0.0.0/8" -> "group:db-id" [label="tcp/22, tcp/80-90"];`,
+		`"group:app-id" -> "cidr:0.0.0.0/0" [label="all"];`,
+		`"cidr:0.0.0.0/0" -> "group:sys1" [label="all"];`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(dot, e) {
+			t.Errorf("%s should be in dot. %s", e, dot)
+		}
+	}
+
+	// Collapse the system groups
+	g = BuildGraph(vpss, sgs, GraphOptions{CollapseSystemGroups: true})
+	dot = g.DOT()
+	if !strings.Contains(dot, `"system" -> "vps:db1" [style=dashed];`) || strings.Contains(dot, "group:sys") {
+		t.Errorf("system groups should be collapsed. %s", dot)
+	}
+	if strings.Count(dot, `"system" -> "vps:db1"`) != 1 {
+		t.Errorf("attachment edges to the system groups should be merged. %s", dot)
+	}
+
+	// Filter to VPS
+	g = BuildGraph(vpss, sgs, GraphOptions{Vps: &vpss[1], CollapseSystemGroups: true})
+	dot = g.DOT()
+	if strings.Contains(dot, "vps:db1") || strings.Contains(dot, "group:db-id") || !strings.Contains(dot, `"group:app-id" -> "vps:app1"`) {
+		t.Errorf("only app1 should be drawn. %s", dot)
+	}
+}
+
+func TestGraphMermaid(t *testing.T) {
+	vpss, sgs := graphTestData()
+	sgs[0].Name = `d"b`
+	vpss[0].SecurityGroups[0].Name = `d"b`
+
+	mermaid := BuildGraph(vpss, sgs, GraphOptions{CollapseSystemGroups: true}).Mermaid()
+	expected := []string{
+		"flowchart LR\n",
+		`n0["db1<br/>203.0.113.1"]`,
+		`n1(["d#quot;b"])`,
+		`n1 -.-> n0`,
+		`>"10.0.0.0/8"]`,
+		`-->|"tcp/22, tcp/80-90"| n1`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(mermaid, e) {
+			t.Errorf("%s should be in mermaid. %s", e, mermaid)
+		}
+	}
+}
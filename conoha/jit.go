@@ -0,0 +1,288 @@
+package conoha
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	osuser "os/user"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+)
+
+// Labels of the just-in-time access groups created by AllowMe.
+const (
+	LABEL_JIT_USER = "jit-user"
+	LABEL_JIT_VPS  = "jit-vps"
+)
+
+// Default service that returns the caller's public IP address as plain text.
+const DEFAULT_IP_SERVICE = "https://api.ipify.org"
+
+var invalidUserChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Return the name of the current OS user that can be used in labels and group names.
+func CurrentUser() (string, error) {
+	u, err := osuser.Current()
+	if err != nil {
+		return "", err
+	}
+
+	name := u.Username
+	if p := strings.LastIndex(name, `\`); p >= 0 {
+		// Windows (DOMAIN\user)
+		name = name[p+1:]
+	}
+	name = strings.Trim(invalidUserChars.ReplaceAllString(name, "-"), "-")
+	if name == "" {
+		return "", fmt.Errorf("Can't detect the user name. [%s]", u.Username)
+	}
+	return name, nil
+}
+
+// Determine the caller's public IP address with the service that returns it as plain text.
+func PublicIP(service string) (net.IP, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(service)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Can't determine the public IP address. [%s: %s]", service, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid IP address returned. [%s]", service)
+	}
+	return ip, nil
+}
+
+// Options of AllowMe.
+type AllowMeOpts struct {
+	User      string
+	IP        net.IP
+	Protocol  string
+	PortRange string
+	TTL       time.Duration
+}
+
+// Result of AllowMe.
+type AllowMeResult struct {
+	Group        *groups.SecGroup
+	GroupCreated bool
+	Attached     bool
+	Rules        []*rules.SecGroupRule
+	Expires      time.Time
+
+	// Rules of the same access deleted to renew the expiry
+	Renewed []rules.SecGroupRule
+}
+
+// Return the name of the just-in-time access group for the user and VPS.
+func JitGroupName(user string, vps *Vps) string {
+	return fmt.Sprintf("jit-%s-%s", user, vps.NameTag)
+}
+
+// Return the just-in-time access groups of the user and VPS.
+func findJitGroups(sgs []groups.SecGroup, user string, vps *Vps) []groups.SecGroup {
+	found := make([]groups.SecGroup, 0, 1)
+	for _, sg := range sgs {
+		a := ParseAnnotation(sg.Description)
+		if a.IsManaged() && a.Labels[LABEL_JIT_USER] == user && a.Labels[LABEL_JIT_VPS] == vps.ID {
+			found = append(found, sg)
+		}
+	}
+	return found
+}
+
+// Allow the access from the IP address to VPS temporarily.
+//
+// The dedicated group for the user and VPS is created if not exists, and attached to VPS.
+// The rules are stamped the expiry, and deleted by Reap after TTL.
+// The rules of the same access allowed before are replaced to renew the expiry.
+// If it fails, the group or the rules created by it are deleted.
+// VPS must have been populated the security groups and ports.
+func AllowMe(os *OpenStack, vps *Vps, opts AllowMeOpts) (*AllowMeResult, error) {
+	if opts.User == "" || opts.IP == nil {
+		return nil, fmt.Errorf("Must specify the user and IP address.")
+	} else if opts.TTL <= 0 {
+		return nil, fmt.Errorf("TTL must be positive.")
+	}
+
+	bits := 128
+	if opts.IP.To4() != nil {
+		bits = 32
+	}
+	result := &AllowMeResult{
+		Expires: time.Now().Add(opts.TTL),
+	}
+
+	// Find or create the group
+	sgs, err := ListGroup(os)
+	if err != nil {
+		return nil, err
+	}
+	if found := findJitGroups(sgs, opts.User, vps); len(found) > 0 {
+		result.Group = &found[0]
+
+	} else {
+		description, err := BuildDescription("Just-in-time access", []string{
+			LABEL_MANAGED_BY + "=" + MANAGED_BY_CONOHA_NET,
+			LABEL_JIT_USER + "=" + opts.User,
+			LABEL_JIT_VPS + "=" + vps.ID,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		result.Group, err = CreateGroup(os, JitGroupName(opts.User, vps), description)
+		if err != nil {
+			return nil, err
+		}
+		result.GroupCreated = true
+	}
+
+	// Create the rules
+	labels := append(ExpiryLabels(result.Expires), LABEL_JIT_USER+"="+opts.User)
+	description, err := BuildDescription("Just-in-time access", labels)
+	if err != nil {
+		return nil, err
+	}
+
+	rule := RuleCreateOpts{
+		SecurityGroupName: result.Group.ID,
+		Direction:         "ingress",
+		Protocol:          opts.Protocol,
+		PortRange:         opts.PortRange,
+		RemoteIPPrefix:    fmt.Sprintf("%s/%d", opts.IP, bits),
+		Description:       description,
+	}
+
+	// The same rules of the earlier access are replaced, since Neutron rejects the duplicate rules
+	// and the description of the rule can't be updated.
+	renewed, err := findJitRules(*result.Group, rule)
+	if err != nil {
+		return nil, rollbackAllowMe(os, result, err)
+	}
+	for _, r := range renewed {
+		if err = DeleteRule(os, r.ID); err != nil {
+			return nil, rollbackAllowMe(os, result, err)
+		}
+		result.Renewed = append(result.Renewed, r)
+	}
+
+	result.Rules, err = CreateRules(os, rule)
+	if err != nil {
+		return nil, rollbackAllowMe(os, result, err)
+	}
+
+	// Attach the group
+	for _, sg := range vps.SecurityGroups {
+		if sg.ID == result.Group.ID {
+			return result, nil
+		}
+	}
+	if _, err = Attach(os, vps, result.Group.ID, nil, nil); err != nil {
+		return nil, rollbackAllowMe(os, result, err)
+	}
+	result.Attached = true
+
+	return result, nil
+}
+
+// Return the rules of the group that allow the same access as the rule.
+func findJitRules(sg groups.SecGroup, rule RuleCreateOpts) ([]rules.SecGroupRule, error) {
+	expanded, err := rule.Expand()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]bool{}
+	for _, e := range expanded {
+		_, opts, err := e.ToCreateOpts()
+		if err != nil {
+			return nil, err
+		}
+		keys[RuleContentKey(ruleFromCreateOpts(opts))] = true
+	}
+
+	found := make([]rules.SecGroupRule, 0, len(expanded))
+	for _, r := range sg.Rules {
+		if keys[RuleContentKey(r)] {
+			found = append(found, r)
+		}
+	}
+	return found, nil
+}
+
+// Delete the group or the rules created by AllowMe, and create the renewed rules again.
+// The error is returned with the resources failed to rollback.
+func rollbackAllowMe(os *OpenStack, result *AllowMeResult, err error) error {
+	remains := make([]string, 0)
+	if result.GroupCreated {
+		// The rules are deleted with the group.
+		if derr := DeleteGroup(os, result.Group.ID); derr != nil {
+			remains = append(remains, result.Group.ID)
+		}
+	} else {
+		for _, rule := range result.Rules {
+			if derr := DeleteRule(os, rule.ID); derr != nil {
+				remains = append(remains, rule.ID)
+			}
+		}
+		for _, rule := range result.Renewed {
+			if _, cerr := createRule(os, createOptsFromRule(rule, rule.SecGroupID)); cerr != nil {
+				remains = append(remains, rule.ID)
+			}
+		}
+	}
+
+	if len(remains) > 0 {
+		return fmt.Errorf("%s (and failed to rollback. [%s])", err, strings.Join(remains, ", "))
+	}
+	return err
+}
+
+// Revoke the accesses allowed by AllowMe.
+// The groups of the user and VPS are detached from VPS and deleted with their rules.
+// VPS must have been populated the security groups and ports.
+func RevokeMe(os *OpenStack, vps *Vps, user string) ([]groups.SecGroup, error) {
+	sgs, err := ListGroup(os)
+	if err != nil {
+		return nil, err
+	}
+
+	found := findJitGroups(sgs, user, vps)
+	for _, sg := range found {
+		for _, attached := range vps.SecurityGroups {
+			if attached.ID != sg.ID {
+				continue
+			}
+			if _, err = Detach(os, vps, sg.ID); err != nil {
+				return nil, err
+			}
+			if err = vps.PopulateSecurityGroups(os); err != nil {
+				return nil, err
+			}
+			break
+		}
+
+		if err = DeleteGroup(os, sg.ID); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,81 @@
+package conoha
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+)
+
+func TestPublicIP(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "198.51.100.7")
+	}))
+	defer ts.Close()
+
+	ip, err := PublicIP(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	} else if ip.String() != "198.51.100.7" {
+		t.Errorf("unexpected IP address. %s", ip)
+	}
+
+	ng := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "<html>not an address</html>")
+	}))
+	defer ng.Close()
+
+	if _, err = PublicIP(ng.URL); err == nil {
+		t.Errorf("invalid response should be an error")
+	}
+}
+
+func TestFindJitGroups(t *testing.T) {
+	vps := &Vps{ID: "vps-1", NameTag: "web1"}
+
+	mine, _ := BuildDescription("", []string{"managed-by=conoha-net", "jit-user=alice", "jit-vps=vps-1"})
+	other, _ := BuildDescription("", []string{"managed-by=conoha-net", "jit-user=bob", "jit-vps=vps-1"})
+	unmanaged, _ := BuildDescription("", []string{"jit-user=alice", "jit-vps=vps-1"})
+
+	sgs := []groups.SecGroup{
+		{ID: "1", Description: mine},
+		{ID: "2", Description: other},
+		{ID: "3", Description: unmanaged},
+	}
+
+	found := findJitGroups(sgs, "alice", vps)
+	if len(found) != 1 || found[0].ID != "1" {
+		t.Errorf("unexpected groups. %v", found)
+	}
+	if JitGroupName("alice", vps) != "jit-alice-web1" {
+		t.Errorf("unexpected group name. %s", JitGroupName("alice", vps))
+	}
+}
+
+func TestFindJitRules(t *testing.T) {
+	sg := groups.SecGroup{
+		ID: "1",
+		Rules: []rules.SecGroupRule{
+			testRule("r1", "in tcp/22 from 203.0.113.5/32"),
+			testRule("r2", "in tcp/22 from 203.0.113.6/32"),
+			testRule("r3", "in tcp/80 from 203.0.113.5/32"),
+		},
+	}
+	sg.Rules[0].Description = "Just-in-time access [expires=2026-10-19T00:00:00Z]"
+
+	rule := RuleCreateOpts{
+		SecurityGroupName: "1",
+		Direction:         "ingress",
+		Protocol:          "tcp",
+		PortRange:         "22",
+		RemoteIPPrefix:    "203.0.113.5/32",
+		Description:       "Just-in-time access [expires=2026-10-20T00:00:00Z]",
+	}
+	found, err := findJitRules(sg, rule)
+	if err != nil || len(found) != 1 || found[0].ID != "r1" {
+		t.Errorf("r1 should be renewed. %v %v", found, err)
+	}
+}
@@ -0,0 +1,298 @@
+package conoha
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	goos "os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"github.com/sirupsen/logrus"
+)
+
+// Operations recorded in the journal.
+const (
+	JOURNAL_CREATE_GROUP = "create-group"
+	JOURNAL_DELETE_GROUP = "delete-group"
+	JOURNAL_CREATE_RULE  = "create-rule"
+	JOURNAL_DELETE_RULE  = "delete-rule"
+	JOURNAL_ATTACH       = "attach"
+	JOURNAL_DETACH       = "detach"
+
+	// The groups of the port were replaced by snapshot restore.
+	JOURNAL_UPDATE_PORT = "update-port"
+)
+
+// Results of the operations.
+const (
+	JOURNAL_OK     = "ok"
+	JOURNAL_FAILED = "failed"
+)
+
+// Security groups of the port.
+type JournalPort struct {
+	ID             string   `json:"id"`
+	DeviceID       string   `json:"device_id"`
+	SecurityGroups []string `json:"security_groups"`
+}
+
+// State of the resource changed by the operation.
+type JournalState struct {
+	Group *groups.SecGroup    `json:"group,omitempty"`
+	Rule  *rules.SecGroupRule `json:"rule,omitempty"`
+	Port  *JournalPort        `json:"port,omitempty"`
+
+	// Rules of the other groups that refer to the deleted group as the remote group.
+	// They are deleted together with the group.
+	Referrers []rules.SecGroupRule `json:"referrers,omitempty"`
+}
+
+// A record of the operation.
+type JournalRecord struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	User      string    `json:"user"`
+	Profile   string    `json:"profile"`
+	Operation string    `json:"operation"`
+
+	// Security group and VPS of the operation
+	Group   string `json:"group"`
+	GroupID string `json:"group_id"`
+	Vps     string `json:"vps,omitempty"`
+	VpsID   string `json:"vps_id,omitempty"`
+
+	Before *JournalState `json:"before,omitempty"`
+	After  *JournalState `json:"after,omitempty"`
+	Result string        `json:"result"`
+	Error  string        `json:"error,omitempty"`
+
+	// ID of the record undone by the operation
+	Undo string `json:"undo,omitempty"`
+}
+
+// Append-only journal of the changes in JSON lines.
+type Journal struct {
+	File string
+
+	// OS user and the API profile written to the records
+	User    string
+	Profile string
+
+	// ID of the record being undone
+	undo string
+
+	mu sync.Mutex
+}
+
+// Return the journal in the data directory.
+func DefaultJournal() (*Journal, error) {
+	dir, err := DataDir()
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := CurrentUser()
+	if err != nil {
+		user = goos.Getenv("USER")
+	}
+
+	return &Journal{
+		File:    filepath.Join(dir, "journal.jsonl"),
+		User:    user,
+		Profile: CurrentProfile(),
+	}, nil
+}
+
+// Return the API user and the tenant of the credentials in the environment.
+func CurrentProfile() string {
+	tenant := goos.Getenv("OS_TENANT_NAME")
+	if tenant == "" {
+		tenant = goos.Getenv("OS_TENANT_ID")
+	}
+	return fmt.Sprintf("%s@%s", goos.Getenv("OS_USERNAME"), tenant)
+}
+
+func newJournalID(t time.Time) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return t.UTC().Format("20060102-150405-") + hex.EncodeToString(b)
+}
+
+// Append the record. The ID, time, user, profile and the record being undone are set if they're empty.
+func (j *Journal) Append(r *JournalRecord) error {
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	if r.ID == "" {
+		r.ID = newJournalID(r.Time)
+	}
+	if r.User == "" {
+		r.User = j.User
+	}
+	if r.Profile == "" {
+		r.Profile = j.Profile
+	}
+	if r.Undo == "" {
+		r.Undo = j.undo
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err = goos.MkdirAll(filepath.Dir(j.File), 0700); err != nil {
+		return err
+	}
+	f, err := goos.OpenFile(j.File, goos.O_APPEND|goos.O_CREATE|goos.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// Read all records in the order of appending. The journal that doesn't exist yet is empty.
+func (j *Journal) Read() ([]JournalRecord, error) {
+	records := []JournalRecord{}
+
+	f, err := goos.Open(j.File)
+	if goos.IsNotExist(err) {
+		return records, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var r JournalRecord
+		if err = json.Unmarshal([]byte(line), &r); err != nil {
+			return nil, fmt.Errorf("Invalid journal record. [%s line %d: %s]", j.File, n, err)
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+// Conditions to query the journal. Zero values match any record.
+type JournalQuery struct {
+	Since time.Time
+	Until time.Time
+
+	// Name or UUID
+	Group string
+	Vps   string
+
+	Operation string
+}
+
+// Return whether the record meets the conditions.
+func (q *JournalQuery) Matches(r JournalRecord) bool {
+	if !q.Since.IsZero() && r.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !r.Time.Before(q.Until) {
+		return false
+	}
+	if q.Group != "" && q.Group != r.Group && q.Group != r.GroupID {
+		return false
+	}
+	if q.Vps != "" && q.Vps != r.Vps && q.Vps != r.VpsID {
+		return false
+	}
+	if q.Operation != "" && q.Operation != r.Operation {
+		return false
+	}
+	return true
+}
+
+// Parse the time of the query. It's either RFC3339, a date ("2006-01-02" in local time),
+// or a duration before now such as "30m", "2h" or "7d".
+func ParseJournalTime(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := ParseTTL(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf(`Invalid time. (e.g. "2006-01-02T15:04:05+09:00", "2006-01-02", "24h", "7d") [%s]`, s)
+}
+
+// Return the records that meet the conditions.
+func (j *Journal) Query(q JournalQuery) ([]JournalRecord, error) {
+	records, err := j.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	matched := make([]JournalRecord, 0, len(records))
+	for _, r := range records {
+		if q.Matches(r) {
+			matched = append(matched, r)
+		}
+	}
+	return matched, nil
+}
+
+// Record the operation to the journal if it's enabled.
+// The failure is logged instead of being returned, because the operation has already been done.
+func (os *OpenStack) record(r *JournalRecord, err error) {
+	if os.Journal == nil {
+		return
+	}
+
+	r.Result = JOURNAL_OK
+	if err != nil {
+		r.Result = JOURNAL_FAILED
+		r.Error = err.Error()
+	}
+	if jerr := os.Journal.Append(r); jerr != nil {
+		logrus.Errorf("Failed to write the journal: %s", jerr)
+	}
+}
+
+// Return the name of the group for the journal. The empty string is returned if it's not found.
+func (os *OpenStack) journalGroupName(id string) string {
+	if os.Journal == nil {
+		return ""
+	}
+	sg, err := groups.Get(os.Network, id).Extract()
+	if err != nil {
+		return ""
+	}
+	return sg.Name
+}
+
+// Record the update of the groups of the port. The requested groups are recorded if the update fails.
+func (os *OpenStack) recordPortUpdate(r *JournalRecord, portID string, before []string, requested []string, updated *ports.Port, err error) {
+	after := requested
+	if updated != nil {
+		after = updated.SecurityGroups
+	}
+	r.Before = &JournalState{Port: &JournalPort{ID: portID, DeviceID: r.VpsID, SecurityGroups: before}}
+	r.After = &JournalState{Port: &JournalPort{ID: portID, DeviceID: r.VpsID, SecurityGroups: after}}
+	os.record(r, err)
+}
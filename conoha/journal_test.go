@@ -0,0 +1,171 @@
+package conoha
+
+import (
+	"errors"
+	"io/ioutil"
+	goos "os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+)
+
+// Use a journal in a temporary directory during the test.
+func withJournal(t *testing.T) (*Journal, func()) {
+	dir, err := ioutil.TempDir("", "conoha-net")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	j := &Journal{
+		File:    filepath.Join(dir, "journal", "journal.jsonl"),
+		User:    "alice",
+		Profile: "api-user@tenant",
+	}
+	return j, func() { goos.RemoveAll(dir) }
+}
+
+func TestJournal(t *testing.T) {
+	j, cleanup := withJournal(t)
+	defer cleanup()
+
+	// Empty
+	records, err := j.Read()
+	if err != nil || len(records) != 0 {
+		t.Fatalf("journal should be empty. %v %v", records, err)
+	}
+
+	rule := testRule("r1", "in tcp/22 from 10.0.0.0/8")
+	rule.SecGroupID = "web-id"
+	rule.Description = "ssh"
+
+	base := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	appended := []*JournalRecord{
+		{Time: base, Operation: JOURNAL_CREATE_GROUP, Group: "web", GroupID: "web-id", After: &JournalState{Group: &groups.SecGroup{ID: "web-id", Name: "web"}}},
+		{Time: base.Add(time.Hour), Operation: JOURNAL_DELETE_RULE, Group: "web", GroupID: "web-id", Before: &JournalState{Rule: &rule}},
+		{Time: base.Add(2 * time.Hour), Operation: JOURNAL_ATTACH, Group: "web", GroupID: "web-id", Vps: "web1", VpsID: "vps-id",
+			Before: &JournalState{Port: &JournalPort{ID: "p1", DeviceID: "vps-id", SecurityGroups: []string{"sys-id"}}},
+			After:  &JournalState{Port: &JournalPort{ID: "p1", DeviceID: "vps-id", SecurityGroups: []string{"sys-id", "web-id"}}}},
+		{Time: base.Add(3 * time.Hour), Operation: JOURNAL_CREATE_GROUP, Group: "db", GroupID: "db-id"},
+	}
+	for _, r := range appended {
+		if err = j.Append(r); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	records, err = j.Read()
+	if err != nil || len(records) != 4 {
+		t.Fatalf("4 records should be read. %v %v", records, err)
+	}
+	r := records[1]
+	if r.ID == "" || r.ID == records[0].ID || r.User != "alice" || r.Profile != "api-user@tenant" {
+		t.Errorf("ID, user and profile should be set. %v", r)
+	}
+	if r.Before.Rule.ID != "r1" || r.Before.Rule.Description != "ssh" || r.Before.Rule.RemoteIPPrefix != "10.0.0.0/8" || r.Before.Rule.PortRangeMax != 22 {
+		t.Errorf("rule should be recorded. %v", r.Before.Rule)
+	}
+
+	queries := []struct {
+		query    JournalQuery
+		expected int
+	}{
+		{JournalQuery{}, 4},
+		{JournalQuery{Since: base.Add(time.Hour)}, 3},
+		{JournalQuery{Since: base.Add(time.Hour), Until: base.Add(3 * time.Hour)}, 2},
+		{JournalQuery{Group: "web"}, 3},
+		{JournalQuery{Group: "db-id"}, 1},
+		{JournalQuery{Vps: "web1"}, 1},
+		{JournalQuery{Vps: "vps-id", Group: "db"}, 0},
+		{JournalQuery{Operation: JOURNAL_CREATE_GROUP}, 2},
+	}
+	for _, q := range queries {
+		matched, err := j.Query(q.query)
+		if err != nil || len(matched) != q.expected {
+			t.Errorf("%d records should be matched. %v %v %v", q.expected, q.query, matched, err)
+		}
+	}
+
+	// Broken journal
+	f, _ := goos.OpenFile(j.File, goos.O_APPEND|goos.O_WRONLY, 0600)
+	f.WriteString("{broken\n")
+	f.Close()
+	if _, err = j.Read(); err == nil {
+		t.Errorf("broken record should be an error")
+	}
+}
+
+func TestRecord(t *testing.T) {
+	j, cleanup := withJournal(t)
+	defer cleanup()
+
+	// Disabled
+	os := &OpenStack{}
+	os.record(&JournalRecord{Operation: JOURNAL_DELETE_GROUP}, nil)
+	if _, err := goos.Stat(j.File); !goos.IsNotExist(err) {
+		t.Errorf("journal should not be written. %v", err)
+	}
+
+	os.Journal = j
+	os.record(&JournalRecord{Operation: JOURNAL_DELETE_GROUP, Group: "web"}, nil)
+	os.recordPortUpdate(&JournalRecord{Operation: JOURNAL_DETACH, Group: "web", VpsID: "vps-id"}, "p1",
+		[]string{"web-id", "sys-id"}, []string{"sys-id"}, nil, errors.New("Port not found."))
+
+	records, err := j.Read()
+	if err != nil || len(records) != 2 {
+		t.Fatalf("2 records should be written. %v %v", records, err)
+	}
+	if records[0].Result != JOURNAL_OK || records[0].Error != "" {
+		t.Errorf("result should be ok. %v", records[0])
+	}
+
+	r := records[1]
+	if r.Result != JOURNAL_FAILED || r.Error != "Port not found." {
+		t.Errorf("result should be failed. %v", r)
+	}
+	if len(r.Before.Port.SecurityGroups) != 2 || len(r.After.Port.SecurityGroups) != 1 || r.After.Port.DeviceID != "vps-id" {
+		t.Errorf("requested groups should be recorded. %v %v", r.Before.Port, r.After.Port)
+	}
+}
+
+func TestJournalRuleRoundTrip(t *testing.T) {
+	j, cleanup := withJournal(t)
+	defer cleanup()
+
+	rule := rules.SecGroupRule{ID: "r1", Direction: "ingress", EtherType: "IPv6", Protocol: "udp", PortRangeMin: 53, PortRangeMax: 53, RemoteGroupID: "app-id", SecGroupID: "dns-id"}
+	if err := j.Append(&JournalRecord{Operation: JOURNAL_CREATE_RULE, After: &JournalState{Rule: &rule}}); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	records, err := j.Read()
+	if err != nil || len(records) != 1 {
+		t.Fatalf("%v %v", records, err)
+	}
+	if *records[0].After.Rule != rule {
+		t.Errorf("rule should be the same.\n%v\n%v", rule, *records[0].After.Rule)
+	}
+}
+
+func TestParseJournalTime(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	cases := map[string]time.Time{
+		"2026-10-01T09:00:00+09:00": time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+		"2026-10-01":                time.Date(2026, 10, 1, 0, 0, 0, 0, time.Local),
+		"30m":                       now.Add(-30 * time.Minute),
+		"7d":                        now.Add(-7 * 24 * time.Hour),
+	}
+	for s, expected := range cases {
+		if tm, err := ParseJournalTime(s, now); err != nil || !tm.Equal(expected) {
+			t.Errorf("%s should be %s. %s %v", s, expected, tm, err)
+		}
+	}
+
+	for _, s := range []string{"", "yesterday", "-1h", "2026/10/01"} {
+		if _, err := ParseJournalTime(s, now); err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package conoha
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+)
+
+// Severity levels of the lint findings.
+const (
+	SEVERITY_INFO    = "info"
+	SEVERITY_WARNING = "warning"
+	SEVERITY_ERROR   = "error"
+)
+
+// Checks of lint.
+const (
+	LINT_DUPLICATE              = "duplicate"
+	LINT_SHADOWED               = "shadowed"
+	LINT_SHADOWED_BY_OTHER      = "shadowed-by-other-group"
+	LINT_EMPTY_GROUP            = "empty-group"
+	LINT_UNATTACHED_GROUP       = "unattached-group"
+	LINT_DEFAULT_EGRESS_REMOVED = "default-egress-removed"
+)
+
+var severityLevels = map[string]int{
+	SEVERITY_INFO:    1,
+	SEVERITY_WARNING: 2,
+	SEVERITY_ERROR:   3,
+}
+
+// Return the level of the severity to compare. It returns an error for the unknown severity.
+func SeverityLevel(severity string) (int, error) {
+	level, ok := severityLevels[strings.ToLower(severity)]
+	if !ok {
+		return 0, fmt.Errorf(`Severity must be "info", "warning" or "error". [%s]`, severity)
+	}
+	return level, nil
+}
+
+// A problem found by lint.
+type LintFinding struct {
+	Severity string
+	Check    string
+	Group    groups.SecGroup
+	Message  string
+
+	// The rule that has the problem, or nil for the problem of the group.
+	Rule *rules.SecGroupRule
+
+	// The broader rule and its group that shadow the rule.
+	By      *rules.SecGroupRule
+	ByGroup *groups.SecGroup
+}
+
+// Analyze the security groups and return the findings.
+// Ports are used to detect the unattached groups and the groups attached to the same port.
+func Lint(sgs []groups.SecGroup, ps []ports.Port) []LintFinding {
+	findings := make([]LintFinding, 0)
+
+	attached := map[string]bool{}
+	for _, p := range ps {
+		for _, id := range p.SecurityGroups {
+			attached[id] = true
+		}
+	}
+
+	// Duplicates and shadowed rules in the same group
+	reported := map[string]bool{}
+	for i := range sgs {
+		sg := &sgs[i]
+		for j := range sg.Rules {
+			rule := &sg.Rules[j]
+			for k := range sg.Rules {
+				other := &sg.Rules[k]
+				if j == k || !ruleCovers(*other, *rule) {
+					continue
+				}
+
+				f := LintFinding{
+					Group:   *sg,
+					Rule:    rule,
+					By:      other,
+					ByGroup: sg,
+				}
+				if ruleCovers(*rule, *other) {
+					// The first one of the duplicates is not reported.
+					if k > j {
+						continue
+					}
+					f.Severity = SEVERITY_ERROR
+					f.Check = LINT_DUPLICATE
+					f.Message = fmt.Sprintf("Duplicate of the rule %s.", other.ID)
+				} else {
+					f.Severity = SEVERITY_WARNING
+					f.Check = LINT_SHADOWED
+					f.Message = fmt.Sprintf("Shadowed by the broader rule %s.", other.ID)
+				}
+				findings = append(findings, f)
+				reported[rule.ID] = true
+				break
+			}
+		}
+	}
+
+	// Rules shadowed by another group attached to the same port
+	index := map[string]int{}
+	for i, sg := range sgs {
+		index[sg.ID] = i
+	}
+	shadowed := map[[2]string]bool{}
+	for _, p := range ps {
+		for _, id := range p.SecurityGroups {
+			sg, err := FindGroup(sgs, id)
+			if err != nil {
+				continue
+			}
+
+			for j := range sg.Rules {
+				rule := &sg.Rules[j]
+				if reported[rule.ID] {
+					continue
+				}
+
+				for _, otherID := range p.SecurityGroups {
+					if otherID == sg.ID || shadowed[[2]string{rule.ID, otherID}] {
+						continue
+					}
+					other, err := FindGroup(sgs, otherID)
+					if err != nil {
+						continue
+					}
+
+					for k := range other.Rules {
+						by := &other.Rules[k]
+						if !ruleCovers(*by, *rule) {
+							continue
+						} else if ruleCovers(*rule, *by) && index[sg.ID] < index[other.ID] {
+							// Only the rule of the latter group is reported for the identical rules.
+							continue
+						}
+
+						findings = append(findings, LintFinding{
+							Severity: SEVERITY_INFO,
+							Check:    LINT_SHADOWED_BY_OTHER,
+							Group:    *sg,
+							Rule:     rule,
+							By:       by,
+							ByGroup:  other,
+							Message:  fmt.Sprintf("Shadowed by the rule %s of the group %s attached to the same port %s.", by.ID, other.Name, p.ID),
+						})
+						shadowed[[2]string{rule.ID, otherID}] = true
+						break
+					}
+				}
+			}
+		}
+	}
+
+	// Custom groups
+	for _, sg := range sgs {
+		if IsSystemGroup(sg.Name) {
+			continue
+		}
+
+		if len(sg.Rules) == 0 {
+			findings = append(findings, LintFinding{
+				Severity: SEVERITY_INFO,
+				Check:    LINT_EMPTY_GROUP,
+				Group:    sg,
+				Message:  "The group has no rules.",
+			})
+		}
+
+		if !attached[sg.ID] {
+			findings = append(findings, LintFinding{
+				Severity: SEVERITY_INFO,
+				Check:    LINT_UNATTACHED_GROUP,
+				Group:    sg,
+				Message:  "The group is not attached to any port.",
+			})
+		}
+
+		for _, etherType := range []string{"IPv4", "IPv6"} {
+			if !hasDefaultEgress(sg, etherType) {
+				findings = append(findings, LintFinding{
+					Severity: SEVERITY_WARNING,
+					Check:    LINT_DEFAULT_EGRESS_REMOVED,
+					Group:    sg,
+					Message:  fmt.Sprintf("The default egress rule of %s has been removed.", etherType),
+				})
+			}
+		}
+	}
+
+	return findings
+}
+
+// Analyze all security groups and return the findings.
+func LintAll(os *OpenStack) ([]LintFinding, error) {
+	sgs, err := ListGroup(os)
+	if err != nil {
+		return nil, err
+	}
+
+	ps, err := ListPorts(os)
+	if err != nil {
+		return nil, err
+	}
+	return Lint(sgs, ps), nil
+}
+
+// Return the number of the findings at or above the severity.
+func CountFindings(findings []LintFinding, severity string) (int, error) {
+	threshold, err := SeverityLevel(severity)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, f := range findings {
+		if level, _ := SeverityLevel(f.Severity); level >= threshold {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Return whether the group has the egress rule that Neutron creates by default.
+func hasDefaultEgress(sg groups.SecGroup, etherType string) bool {
+	for _, rule := range sg.Rules {
+		if rule.Direction == "egress" && rule.EtherType == etherType && rule.Protocol == "" &&
+			rule.RemoteGroupID == "" && isAnyPrefix(rule.RemoteIPPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return whether the prefix matches any address.
+func isAnyPrefix(prefix string) bool {
+	return prefix == "" || prefix == "0.0.0.0/0" || prefix == "::/0"
+}
+
+// Return whether the rule a allows all traffic that the rule b allows.
+func ruleCovers(a rules.SecGroupRule, b rules.SecGroupRule) bool {
+	if a.Direction != b.Direction || a.EtherType != b.EtherType {
+		return false
+	}
+
+	// Protocol and ports
+	pa, pb := ProtocolName(a.Protocol), ProtocolName(b.Protocol)
+	if pa != "all" {
+		if pa != pb {
+			return false
+		}
+
+		ia := &optimizeItem{min: a.PortRangeMin, max: a.PortRangeMax}
+		ib := &optimizeItem{min: b.PortRangeMin, max: b.PortRangeMax}
+		if hasPorts(pa) {
+			for _, i := range []*optimizeItem{ia, ib} {
+				if i.min == 0 && i.max == 0 {
+					i.min, i.max = 1, 65535
+				}
+			}
+		}
+		if !ia.covers(pa, ib) {
+			return false
+		}
+	}
+
+	// Remote
+	if a.RemoteGroupID != "" {
+		return a.RemoteGroupID == b.RemoteGroupID
+	} else if isAnyPrefix(a.RemoteIPPrefix) {
+		return true
+	} else if b.RemoteGroupID != "" {
+		return false
+	}
+
+	prefixB := b.RemoteIPPrefix
+	if prefixB == "" {
+		prefixB = anyAddress(b.EtherType)
+	}
+	sa, err := NewCIDRSet(a.RemoteIPPrefix)
+	if err != nil {
+		return false
+	}
+	sb, err := NewCIDRSet(prefixB)
+	if err != nil {
+		return false
+	}
+	return sa.ContainsSet(sb)
+}
@@ -0,0 +1,140 @@
+package conoha
+
+import (
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+)
+
+func defaultEgressRules(prefix string) []rules.SecGroupRule {
+	return []rules.SecGroupRule{
+		testRule(prefix+"-egress4", "out ipv4 all"),
+		testRule(prefix+"-egress6", "out ipv6 all"),
+	}
+}
+
+func findingsOf(findings []LintFinding, check string) []LintFinding {
+	found := make([]LintFinding, 0)
+	for _, f := range findings {
+		if f.Check == check {
+			found = append(found, f)
+		}
+	}
+	return found
+}
+
+func TestLint(t *testing.T) {
+	sgs := []groups.SecGroup{
+		{
+			ID:   "web",
+			Name: "web",
+			Rules: append(defaultEgressRules("web"),
+				testRule("1", "in tcp/80 from 0.0.0.0/0"),
+				testRule("2", "in tcp/80"),
+				testRule("3", "in tcp/22 from 10.0.0.1/32"),
+				testRule("4", "in tcp/20-30 from 10.0.0.0/24"),
+			),
+		},
+		{
+			ID:   "ssh",
+			Name: "ssh",
+			Rules: append(defaultEgressRules("ssh"),
+				testRule("5", "in tcp from 10.0.0.0/8"),
+				testRule("6", "in udp/53 from 10.0.0.0/8"),
+			),
+		},
+		{
+			ID:    "empty",
+			Name:  "empty",
+			Rules: []rules.SecGroupRule{},
+		},
+		{
+			ID:   "default",
+			Name: "default",
+		},
+	}
+	ps := []ports.Port{
+		{ID: "port1", SecurityGroups: []string{"web", "ssh"}},
+	}
+
+	findings := Lint(sgs, ps)
+
+	dup := findingsOf(findings, LINT_DUPLICATE)
+	if len(dup) != 1 || dup[0].Rule.ID != "2" || dup[0].By.ID != "1" || dup[0].Severity != SEVERITY_ERROR {
+		t.Errorf("rule 2 should be a duplicate of rule 1. %v", dup)
+	}
+
+	shadowed := findingsOf(findings, LINT_SHADOWED)
+	if len(shadowed) != 1 || shadowed[0].Rule.ID != "3" || shadowed[0].By.ID != "4" {
+		t.Errorf("rule 3 should be shadowed by rule 4. %v", shadowed)
+	}
+
+	// rule 3 is reported in the same group, and the default egress rules are identical
+	other := findingsOf(findings, LINT_SHADOWED_BY_OTHER)
+	ids := map[string]bool{}
+	for _, f := range other {
+		ids[f.Rule.ID] = true
+	}
+	if len(other) != 3 || !ids["4"] || !ids["ssh-egress4"] || !ids["ssh-egress6"] {
+		t.Errorf("rule 4 and the egress rules of ssh should be shadowed by the other group. %v", other)
+	}
+
+	empty := findingsOf(findings, LINT_EMPTY_GROUP)
+	if len(empty) != 1 || empty[0].Group.ID != "empty" {
+		t.Errorf("empty group should be reported. %v", empty)
+	}
+
+	unattached := findingsOf(findings, LINT_UNATTACHED_GROUP)
+	if len(unattached) != 1 || unattached[0].Group.ID != "empty" {
+		t.Errorf("unattached group should be reported. %v", unattached)
+	}
+
+	egress := findingsOf(findings, LINT_DEFAULT_EGRESS_REMOVED)
+	if len(egress) != 2 || egress[0].Group.ID != "empty" {
+		t.Errorf("removed egress rules should be reported. %v", egress)
+	}
+
+	n, err := CountFindings(findings, SEVERITY_WARNING)
+	if err != nil {
+		t.Fatalf("%v", err)
+	} else if n != 4 {
+		t.Errorf("4 findings should be warning or above, but %d", n)
+	}
+
+	if _, err = CountFindings(findings, "fatal"); err == nil {
+		t.Errorf("unknown severity should be an error")
+	}
+}
+
+func TestRuleCovers(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		covers bool
+	}{
+		{"in all", "in tcp/22 from 10.0.0.0/8", true},
+		{"in tcp", "in tcp/22", true},
+		{"in tcp/1-65535", "in tcp", true},
+		{"in tcp/22", "in tcp/22-23", false},
+		{"in tcp/22", "in udp/22", false},
+		{"in tcp/22", "out tcp/22", false},
+		{"in tcp/22 from 10.0.0.0/8", "in tcp/22 from 10.1.0.0/16", true},
+		{"in tcp/22 from 10.0.0.0/8", "in tcp/22", false},
+		{"in tcp/22", "in tcp/22 from group:web", true},
+		{"in tcp/22 from 10.0.0.0/8", "in tcp/22 from group:web", false},
+		{"in tcp/22 from group:web", "in tcp/22 from group:web", true},
+		{"in icmp", "in icmp/echo-request", true},
+		{"in icmp/3", "in icmp/3/4", true},
+		{"in icmp/3/4", "in icmp/3", false},
+		{"in ipv4 all", "in ipv6 all", false},
+	}
+
+	for _, test := range tests {
+		a := testRule("a", test.a)
+		b := testRule("b", test.b)
+		if ruleCovers(a, b) != test.covers {
+			t.Errorf("%s covers %s should be %v", test.a, test.b, test.covers)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package conoha
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+)
+
+// Predicate to search security group rules. Empty fields match any rule.
+//
+// Protocol, Port and the prefixes are matched by coverage, so that a rule of protocol "all"
+// or a port range 8000-9000 matches Protocol "tcp" and Port 8080.
+type RuleMatcher struct {
+	// Glob pattern of the group name. (e.g. "web-*")
+	GroupPattern string
+
+	// "ingress" or "egress"
+	Direction string
+
+	// "IPv4" or "IPv6"
+	EtherType string
+
+	// Normalized protocol name. (e.g. "tcp", "icmp")
+	Protocol string
+
+	// Rules that allow the destination port. Rules of the protocols without ports (e.g. ICMP) don't match.
+	Port int
+
+	// Rules whose remote prefix contains the network
+	Contains *net.IPNet
+
+	// Rules whose remote prefix overlaps the network
+	Overlaps *net.IPNet
+
+	// Rules that refer to the remote group (ID or name)
+	RemoteGroup string
+
+	// Whether RemoteGroup has been resolved to the UUID
+	remoteResolved bool
+}
+
+// Normalize the direction. "in" and "out" are accepted.
+func NormalizeDirection(direction string) (string, error) {
+	switch strings.ToLower(direction) {
+	case "in", "ingress":
+		return "ingress", nil
+	case "out", "egress":
+		return "egress", nil
+	}
+	return "", fmt.Errorf(`Direction must be either "ingress" or "egress". [%s]`, direction)
+}
+
+// Normalize the ether type. "4" and "6" are accepted.
+func NormalizeEtherType(etherType string) (string, error) {
+	switch strings.ToLower(etherType) {
+	case "ipv4", "4":
+		return "IPv4", nil
+	case "ipv6", "6":
+		return "IPv6", nil
+	}
+	return "", fmt.Errorf(`Ether type must be either "IPv4" or "IPv6". [%s]`, etherType)
+}
+
+// Parse CIDR or IP address. An IP address is treated as a host prefix.
+func ParseNetwork(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid IP address or CIDR. [%s]", s)
+		} else if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid IP address or CIDR. [%s]", s)
+	}
+	return ipnet, nil
+}
+
+// Return whether the matcher has the conditions on rules, not only on groups.
+func (m *RuleMatcher) hasRuleConditions() bool {
+	return m.Direction != "" || m.EtherType != "" || m.Protocol != "" || m.Port != 0 ||
+		m.Contains != nil || m.Overlaps != nil || m.RemoteGroup != ""
+}
+
+// Return whether the group matches the group pattern.
+func (m *RuleMatcher) MatchesGroup(sg groups.SecGroup) bool {
+	if m.GroupPattern == "" {
+		return true
+	}
+	matched, _ := path.Match(m.GroupPattern, sg.Name)
+	return matched
+}
+
+// Return whether the rule in the group matches.
+// RemoteGroup is compared with the remote group ID of the rule, use Filter to match by name.
+func (m *RuleMatcher) Matches(sg groups.SecGroup, rule rules.SecGroupRule) bool {
+	if !m.MatchesGroup(sg) {
+		return false
+	}
+	if m.Direction != "" && rule.Direction != m.Direction {
+		return false
+	}
+	if m.EtherType != "" && rule.EtherType != m.EtherType {
+		return false
+	}
+
+	proto := ProtocolName(rule.Protocol)
+	if m.Protocol != "" && proto != "all" && proto != m.Protocol {
+		return false
+	}
+	if m.Port != 0 && proto != "all" {
+		if !hasPorts(proto) {
+			return false
+		}
+		min, max := rule.PortRangeMin, rule.PortRangeMax
+		if !(min == 0 && max == 0) && (m.Port < min || max < m.Port) {
+			return false
+		}
+	}
+
+	if m.RemoteGroup != "" && rule.RemoteGroupID != m.RemoteGroup {
+		return false
+	}
+
+	if m.Contains != nil || m.Overlaps != nil {
+		if rule.RemoteGroupID != "" {
+			return false
+		}
+
+		prefix := rule.RemoteIPPrefix
+		if prefix == "" {
+			prefix = anyAddress(rule.EtherType)
+		}
+		_, ipnet, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return false
+		}
+
+		if m.Contains != nil && !networkContains(ipnet, m.Contains) {
+			return false
+		}
+		if m.Overlaps != nil && !networkContains(ipnet, m.Overlaps) && !networkContains(m.Overlaps, ipnet) {
+			return false
+		}
+	}
+	return true
+}
+
+// Return whether the network a contains the network b.
+func networkContains(a *net.IPNet, b *net.IPNet) bool {
+	if (a.IP.To4() != nil) != (b.IP.To4() != nil) {
+		return false
+	}
+	aOnes, _ := a.Mask.Size()
+	bOnes, _ := b.Mask.Size()
+	return aOnes <= bOnes && a.Contains(b.IP)
+}
+
+// Resolve the remote group given by name or ID to the UUID with the groups.
+// It's used when the groups to be filtered don't include the remote group (e.g. the system groups).
+func (m *RuleMatcher) ResolveRemoteGroup(sgs []groups.SecGroup) error {
+	if m.RemoteGroup == "" || m.remoteResolved {
+		return nil
+	}
+	sg, err := FindGroup(sgs, m.RemoteGroup)
+	if err != nil {
+		return err
+	}
+	m.RemoteGroup = sg.ID
+	m.remoteResolved = true
+	return nil
+}
+
+// Return the groups that have the matched rules. Other rules are removed from the groups.
+// If the matcher has no conditions on rules, the groups are matched by the group pattern only.
+// The remote group is resolved with the groups unless ResolveRemoteGroup has been called,
+// and an error is returned if it's not found.
+func (m *RuleMatcher) Filter(sgs []groups.SecGroup) ([]groups.SecGroup, error) {
+	matcher := *m
+	if err := matcher.ResolveRemoteGroup(sgs); err != nil {
+		return nil, err
+	}
+
+	filtered := make([]groups.SecGroup, 0, len(sgs))
+	for _, sg := range sgs {
+		if !matcher.MatchesGroup(sg) {
+			continue
+		}
+		if !matcher.hasRuleConditions() {
+			filtered = append(filtered, sg)
+			continue
+		}
+
+		matched := make([]rules.SecGroupRule, 0, len(sg.Rules))
+		for _, rule := range sg.Rules {
+			if matcher.Matches(sg, rule) {
+				matched = append(matched, rule)
+			}
+		}
+		if len(matched) > 0 {
+			sg.Rules = matched
+			filtered = append(filtered, sg)
+		}
+	}
+	return filtered, nil
+}
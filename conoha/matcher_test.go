@@ -0,0 +1,141 @@
+package conoha
+
+import (
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+)
+
+func TestRuleMatcher(t *testing.T) {
+	lb := testRule("web-5", "in tcp/80 from group:lb")
+	lb.RemoteGroupID = "lb-id"
+
+	web := groups.SecGroup{
+		ID:   "web-id",
+		Name: "web-prod",
+		Rules: []rules.SecGroupRule{
+			testRule("web-1", "in tcp/8000-9000 from 10.0.0.0/8"),
+			testRule("web-2", "in all from 192.168.1.0/24"),
+			testRule("web-3", "in udp/53 from 2001:db8::/32"),
+			testRule("web-4", "out all"),
+			lb,
+		},
+	}
+
+	mustNetwork := func(s string) *RuleMatcher {
+		n, err := ParseNetwork(s)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return &RuleMatcher{Contains: n}
+	}
+
+	tests := []struct {
+		matcher *RuleMatcher
+		rules   []string
+	}{
+		{&RuleMatcher{}, []string{"web-1", "web-2", "web-3", "web-4", "web-5"}},
+		{&RuleMatcher{GroupPattern: "web-*", Direction: "egress"}, []string{"web-4"}},
+		{&RuleMatcher{GroupPattern: "db-*"}, []string{}},
+		{&RuleMatcher{Port: 8080}, []string{"web-1", "web-2", "web-4"}},
+		{&RuleMatcher{Protocol: "tcp", Port: 8080, Direction: "ingress"}, []string{"web-1", "web-2"}},
+		{&RuleMatcher{Protocol: "icmp", Port: 8}, []string{"web-2", "web-4"}},
+		{&RuleMatcher{EtherType: "IPv6"}, []string{"web-3"}},
+		{&RuleMatcher{RemoteGroup: "lb-id"}, []string{"web-5"}},
+		{mustNetwork("10.1.2.3"), []string{"web-1", "web-4"}},
+		{mustNetwork("192.168.0.0/16"), []string{"web-4"}},
+	}
+
+	for i, test := range tests {
+		matched := []string{}
+		for _, rule := range web.Rules {
+			if test.matcher.Matches(web, rule) {
+				matched = append(matched, rule.ID)
+			}
+		}
+		if len(matched) != len(test.rules) {
+			t.Errorf("%d: %v should be matched, but %v", i, test.rules, matched)
+			continue
+		}
+		for j := range matched {
+			if matched[j] != test.rules[j] {
+				t.Errorf("%d: %v should be matched, but %v", i, test.rules, matched)
+				break
+			}
+		}
+	}
+
+	// Overlap
+	n, _ := ParseNetwork("192.168.0.0/16")
+	m := &RuleMatcher{Overlaps: n, Direction: "ingress"}
+	if !m.Matches(web, web.Rules[1]) || m.Matches(web, web.Rules[0]) {
+		t.Errorf("192.168.0.0/16 should overlap with 192.168.1.0/24 only")
+	}
+}
+
+func TestRuleMatcherFilter(t *testing.T) {
+	lb := testRule("web-2", "in tcp/80 from group:lb")
+	lb.RemoteGroupID = "lb-id"
+
+	sgs := []groups.SecGroup{
+		{ID: "web-id", Name: "web", Rules: []rules.SecGroupRule{testRule("web-1", "in tcp/22"), lb}},
+		{ID: "lb-id", Name: "lb", Rules: []rules.SecGroupRule{testRule("lb-1", "in tcp/80")}},
+		{ID: "empty-id", Name: "empty", Rules: []rules.SecGroupRule{}},
+	}
+
+	// by remote group name
+	filtered, err := (&RuleMatcher{RemoteGroup: "lb"}).Filter(sgs)
+	if err != nil || len(filtered) != 1 || len(filtered[0].Rules) != 1 || filtered[0].Rules[0].ID != "web-2" {
+		t.Errorf("web-2 should be matched. %v %v", filtered, err)
+	}
+
+	// remote group that doesn't exist
+	if _, err = (&RuleMatcher{RemoteGroup: "db"}).Filter(sgs); err == nil {
+		t.Errorf("unknown remote group should be an error")
+	}
+
+	// remote group resolved with the other groups
+	m := &RuleMatcher{RemoteGroup: "lb"}
+	if err = m.ResolveRemoteGroup(sgs); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if filtered, err = m.Filter(sgs[:1]); err != nil || len(filtered) != 1 {
+		t.Errorf("web-2 should be matched. %v %v", filtered, err)
+	}
+
+	// groups only
+	filtered, err = (&RuleMatcher{GroupPattern: "*"}).Filter(sgs)
+	if err != nil || len(filtered) != 3 || len(filtered[0].Rules) != 2 {
+		t.Errorf("all groups should be matched with rules. %v %v", filtered, err)
+	}
+
+	// original groups are not modified
+	(&RuleMatcher{Port: 80}).Filter(sgs)
+	if len(sgs[0].Rules) != 2 {
+		t.Errorf("rules of the original group should not be removed")
+	}
+}
+
+func TestParseNetwork(t *testing.T) {
+	tests := map[string]string{
+		"10.0.0.1":       "10.0.0.1/32",
+		"2001:db8::1":    "2001:db8::1/128",
+		"10.1.2.3/8":     "10.0.0.0/8",
+		"2001:db8::1/32": "2001:db8::/32",
+	}
+	for s, expected := range tests {
+		n, err := ParseNetwork(s)
+		if err != nil {
+			t.Errorf("%v", err)
+		} else if n.String() != expected {
+			t.Errorf("%s should be %s, but %s", s, expected, n)
+		}
+	}
+
+	for _, s := range []string{"", "10.0.0", "10.0.0.0/33"} {
+		if _, err := ParseNetwork(s); err == nil {
+			t.Errorf("%q should be an error", s)
+		}
+	}
+}
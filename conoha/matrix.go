@@ -0,0 +1,249 @@
+package conoha
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+)
+
+// Reachability between every pair of VPS for the services.
+type Matrix struct {
+	Vps      []Vps
+	Services []string
+
+	// Allowed[src][dst][service]
+	Allowed [][][]bool
+}
+
+// Parse a service such as "22", "tcp/5432", "udp/53" or "icmp/echo-request".
+// The protocol is TCP if omitted.
+func ParseService(service string) (protocol string, port string, err error) {
+	service = strings.TrimSpace(service)
+	protocol, port = "tcp", service
+	if p := strings.Index(service, "/"); p >= 0 {
+		protocol, port = service[:p], service[p+1:]
+	}
+
+	// validate
+	if _, err = NewFlow("ingress", protocol, port, "127.0.0.1"); err != nil {
+		return "", "", err
+	}
+	return protocol, port, nil
+}
+
+// Return the ports of VPS.
+func vpsPorts(ps []ports.Port, vpsID string) []ports.Port {
+	found := make([]ports.Port, 0, 2)
+	for _, p := range ps {
+		if p.DeviceID == vpsID {
+			found = append(found, p)
+		}
+	}
+	return found
+}
+
+// Return the security groups bound to the port.
+func boundGroups(sgs []groups.SecGroup, p ports.Port) []groups.SecGroup {
+	bound := make([]groups.SecGroup, 0, len(p.SecurityGroups))
+	for _, id := range p.SecurityGroups {
+		if sg, err := FindGroup(sgs, id); err == nil {
+			bound = append(bound, *sg)
+		}
+	}
+	return bound
+}
+
+// Return whether the traffic of the service from src to dst is allowed by both
+// the egress rules of src and the ingress rules of dst.
+//
+// The addresses of the same IP version and the same scope (private or global) are paired.
+func PairAllowed(src Vps, dst Vps, protocol string, port string, sgs []groups.SecGroup, ps []ports.Port, vpss []Vps) (bool, error) {
+	for _, dp := range vpsPorts(ps, dst.ID) {
+		dstGroups := boundGroups(sgs, dp)
+
+		for _, dfip := range dp.FixedIPs {
+			dip := net.ParseIP(dfip.IPAddress)
+			if dip == nil {
+				continue
+			}
+
+			for _, sp := range vpsPorts(ps, src.ID) {
+				srcGroups := boundGroups(sgs, sp)
+
+				for _, sfip := range sp.FixedIPs {
+					sip := net.ParseIP(sfip.IPAddress)
+					if sip == nil || (sip.To4() != nil) != (dip.To4() != nil) ||
+						privateAddresses.Contains(sip) != privateAddresses.Contains(dip) {
+						continue
+					}
+
+					in, err := NewFlow("ingress", protocol, port, sip.String())
+					if err != nil {
+						return false, err
+					}
+					out, err := NewFlow("egress", protocol, port, dip.String())
+					if err != nil {
+						return false, err
+					}
+
+					if EvaluateFlow(in, dstGroups, sgs, vpss).Allowed && EvaluateFlow(out, srcGroups, sgs, vpss).Allowed {
+						return true, nil
+					}
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// Compute the reachability matrix of VPS for the services. (e.g. "22", "tcp/5432", "udp/53")
+// VPS must have been populated the ports by PopulateVpsPorts to resolve the remote groups.
+func ComputeMatrix(vpss []Vps, services []string, sgs []groups.SecGroup, ps []ports.Port) (*Matrix, error) {
+	type service struct {
+		protocol string
+		port     string
+	}
+	parsed := make([]service, 0, len(services))
+	for _, s := range services {
+		protocol, port, err := ParseService(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, service{protocol, port})
+	}
+
+	m := &Matrix{
+		Vps:      vpss,
+		Services: services,
+		Allowed:  make([][][]bool, len(vpss)),
+	}
+	for i, src := range vpss {
+		m.Allowed[i] = make([][]bool, len(vpss))
+		for j, dst := range vpss {
+			m.Allowed[i][j] = make([]bool, len(parsed))
+			if i == j {
+				continue
+			}
+
+			for k, s := range parsed {
+				allowed, err := PairAllowed(src, dst, s.protocol, s.port, sgs, ps, vpss)
+				if err != nil {
+					return nil, err
+				}
+				m.Allowed[i][j][k] = allowed
+			}
+		}
+	}
+	return m, nil
+}
+
+// Compute the reachability matrix of all VPS for the services.
+func ComputeMatrixAll(os *OpenStack, services []string) (*Matrix, error) {
+	vpss, err := ListVps(os, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	sgs, err := ListGroup(os)
+	if err != nil {
+		return nil, err
+	}
+
+	ps, err := ListPorts(os)
+	if err != nil {
+		return nil, err
+	}
+	PopulateVpsPorts(vpss, ps)
+
+	return ComputeMatrix(vpss, services, sgs, ps)
+}
+
+// Return the services allowed from src to dst.
+func (m *Matrix) AllowedServices(src int, dst int) []string {
+	allowed := make([]string, 0, len(m.Services))
+	for k, s := range m.Services {
+		if m.Allowed[src][dst][k] {
+			allowed = append(allowed, s)
+		}
+	}
+	return allowed
+}
+
+// Format the matrix as a table. Rows are the sources and columns are the destinations.
+func (m *Matrix) Table() [][]string {
+	data := make([][]string, 0, len(m.Vps)+1)
+
+	header := []string{"From \\ To"}
+	for _, dst := range m.Vps {
+		header = append(header, dst.NameTag)
+	}
+	data = append(data, header)
+
+	for i, src := range m.Vps {
+		row := []string{src.NameTag}
+		for j := range m.Vps {
+			if i == j {
+				row = append(row, "")
+			} else if allowed := m.AllowedServices(i, j); len(allowed) > 0 {
+				row = append(row, strings.Join(allowed, ","))
+			} else {
+				row = append(row, "-")
+			}
+		}
+		data = append(data, row)
+	}
+	return data
+}
+
+// Format the matrix as CSV that has a line for each source, destination and service.
+func (m *Matrix) CSV() (string, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	w.Write([]string{"from", "to", "service", "allowed"})
+	for i, src := range m.Vps {
+		for j, dst := range m.Vps {
+			if i == j {
+				continue
+			}
+			for k, s := range m.Services {
+				w.Write([]string{src.NameTag, dst.NameTag, s, fmt.Sprintf("%t", m.Allowed[i][j][k])})
+			}
+		}
+	}
+
+	w.Flush()
+	return buf.String(), w.Error()
+}
+
+// Format the matrix as Graphviz DOT. The edges are labeled the allowed services.
+func (m *Matrix) DOT() string {
+	var buf bytes.Buffer
+
+	buf.WriteString("digraph reachability {\n")
+	for _, vps := range m.Vps {
+		fmt.Fprintf(&buf, "  %s;\n", dotQuote(vps.NameTag))
+	}
+	for i, src := range m.Vps {
+		for j, dst := range m.Vps {
+			if i == j {
+				continue
+			}
+			if allowed := m.AllowedServices(i, j); len(allowed) > 0 {
+				fmt.Fprintf(&buf, "  %s -> %s [label=%s];\n", dotQuote(src.NameTag), dotQuote(dst.NameTag), dotQuote(strings.Join(allowed, ",")))
+			}
+		}
+	}
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+// Quote the string as a DOT ID.
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
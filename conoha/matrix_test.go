@@ -0,0 +1,121 @@
+package conoha
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/secgroups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+)
+
+func TestComputeMatrix(t *testing.T) {
+	db := testRule("db-1", "in tcp/5432 from group:app")
+	db.RemoteGroupID = "app-id"
+
+	sgs := []groups.SecGroup{
+		{
+			ID:   "db-id",
+			Name: "db",
+			Rules: []rules.SecGroupRule{
+				db,
+				testRule("db-2", "in tcp/22 from 10.0.0.0/8"),
+				testRule("db-3", "out all"),
+			},
+		},
+		{
+			ID:   "app-id",
+			Name: "app",
+			Rules: []rules.SecGroupRule{
+				testRule("app-1", "out tcp/5432"),
+			},
+		},
+	}
+
+	ps := []ports.Port{
+		{ID: "app1-p", DeviceID: "app1", SecurityGroups: []string{"app-id"}, FixedIPs: []ports.IP{{IPAddress: "10.0.0.1"}}},
+		{ID: "app2-p", DeviceID: "app2", SecurityGroups: []string{"db-id"}, FixedIPs: []ports.IP{{IPAddress: "10.0.0.2"}}},
+		{ID: "db1-p", DeviceID: "db1", SecurityGroups: []string{"db-id"}, FixedIPs: []ports.IP{{IPAddress: "10.0.0.3"}}},
+		{ID: "db1-ext", DeviceID: "db1", SecurityGroups: []string{"db-id"}, FixedIPs: []ports.IP{{IPAddress: "203.0.113.3"}}},
+	}
+
+	vpss := []Vps{
+		{ID: "app1", NameTag: "app1", SecurityGroups: []secgroups.SecurityGroup{{Name: "app"}}},
+		{ID: "app2", NameTag: "app2", SecurityGroups: []secgroups.SecurityGroup{{Name: "db"}}},
+		{ID: "db1", NameTag: "db1", SecurityGroups: []secgroups.SecurityGroup{{Name: "db"}}},
+	}
+	PopulateVpsPorts(vpss, ps)
+
+	m, err := ComputeMatrix(vpss, []string{"22", "tcp/5432"}, sgs, ps)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	tests := []struct {
+		src     int
+		dst     int
+		allowed string
+	}{
+		{0, 2, "tcp/5432"}, // app1 -> db1 by the remote group
+		{0, 1, "tcp/5432"}, // app2 is also in db group
+		{1, 2, "22"},       // app2 -> db1 from the private network
+		{2, 1, "22"},
+		{2, 0, ""}, // ingress of app1 allows nothing
+		{1, 0, ""},
+		{2, 2, ""},
+	}
+	for _, test := range tests {
+		allowed := strings.Join(m.AllowedServices(test.src, test.dst), ",")
+		if allowed != test.allowed {
+			t.Errorf("%s -> %s should allow %q, but %q", vpss[test.src].NameTag, vpss[test.dst].NameTag, test.allowed, allowed)
+		}
+	}
+
+	table := m.Table()
+	if len(table) != 4 || table[1][3] != "tcp/5432" || table[1][1] != "" || table[3][1] != "-" {
+		t.Errorf("unexpected table. %v", table)
+	}
+
+	csv, err := m.CSV()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(csv), "\n"); len(lines) != 13 || lines[0] != "from,to,service,allowed" {
+		t.Errorf("unexpected csv. %s", csv)
+	}
+	if !strings.Contains(csv, "app1,db1,tcp/5432,true\n") || !strings.Contains(csv, "app1,db1,22,false\n") {
+		t.Errorf("unexpected csv. %s", csv)
+	}
+
+	dot := m.DOT()
+	if !strings.Contains(dot, `"app1" -> "db1" [label="tcp/5432"];`) || strings.Contains(dot, `"db1" -> "app1"`) {
+		t.Errorf("unexpected dot. %s", dot)
+	}
+
+	if _, err = ComputeMatrix(vpss, []string{"tcp/99999"}, sgs, ps); err == nil {
+		t.Errorf("invalid service should be an error")
+	}
+}
+
+func TestParseService(t *testing.T) {
+	tests := map[string][2]string{
+		"22":                {"tcp", "22"},
+		"udp/53":            {"udp", "53"},
+		"icmp/echo-request": {"icmp", "echo-request"},
+	}
+	for s, expected := range tests {
+		protocol, port, err := ParseService(s)
+		if err != nil {
+			t.Errorf("%v", err)
+		} else if protocol != expected[0] || port != expected[1] {
+			t.Errorf("%s should be %v, but %s %s", s, expected, protocol, port)
+		}
+	}
+
+	for _, s := range []string{"", "tcp/", "http", "foo/22"} {
+		if _, _, err := ParseService(s); err == nil {
+			t.Errorf("%q should be an error", s)
+		}
+	}
+}
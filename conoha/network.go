@@ -1,13 +1,13 @@
 package conoha
 
 import (
-	"errors"
 	"fmt"
+	"net"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
-	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/secgroups"
 	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
 	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
@@ -20,6 +20,10 @@ const (
 	SYSTEM_SECGROUP_PREFIX  = "gncs"
 )
 
+// Ether type that means both of IPv4 and IPv6.
+// The rule that has it is expanded into the IPv4 and IPv6 rule pair by Expand().
+const ETHER_TYPE_BOTH = "both"
+
 type RuleCreateOpts struct {
 	SecurityGroupName string
 	Direction         string
@@ -28,12 +32,34 @@ type RuleCreateOpts struct {
 	Protocol          string
 	RemoteGroupID     string
 	RemoteIPPrefix    string
+	Description       string
+}
+
+// Error for an invalid field of RuleCreateOpts.
+// Field is the name of the field in RuleCreateOpts. (e.g. "PortRange")
+type RuleFieldError struct {
+	Field  string
+	Value  string
+	Reason string
+}
+
+func (e *RuleFieldError) Error() string {
+	return fmt.Sprintf(`Invalid "%s": %s [%s]`, e.Field, e.Reason, e.Value)
+}
+
+func ruleFieldError(field string, value string, format string, a ...interface{}) *RuleFieldError {
+	return &RuleFieldError{
+		Field:  field,
+		Value:  value,
+		Reason: fmt.Sprintf(format, a...),
+	}
 }
 
 // Convert conoha-net CreateOpts to gophercloud CreateOpts.
+// Every field is validated, and the error is returned as *RuleFieldError.
 func (r *RuleCreateOpts) ToCreateOpts() (name string, opts rules.CreateOpts, err error) {
 	if r.SecurityGroupName == "" {
-		return name, opts, fmt.Errorf(`Must specify "security-group-name".`)
+		return name, opts, ruleFieldError("SecurityGroupName", r.SecurityGroupName, "must specify the security group name")
 	}
 	name = r.SecurityGroupName
 
@@ -44,111 +70,430 @@ func (r *RuleCreateOpts) ToCreateOpts() (name string, opts rules.CreateOpts, err
 		opts.Direction = rules.DirEgress
 
 	} else {
-		return name, opts, fmt.Errorf(`"direction" must be either "ingress" or "egress"`)
+		return name, opts, ruleFieldError("Direction", r.Direction, `must be either "ingress" or "egress"`)
 	}
 
-	if r.EtherType == "IPv4" {
-		opts.EtherType = rules.EtherType4
+	if len(r.Description) > MAX_DESCRIPTION_LENGTH {
+		return name, opts, ruleFieldError("Description", r.Description, "must be %d characters or less", MAX_DESCRIPTION_LENGTH)
+	}
+	opts.Description = r.Description
 
-	} else if r.EtherType == "IPv6" {
-		opts.EtherType = rules.EtherType6
+	// Remote
+	if r.RemoteGroupID != "" && r.RemoteIPPrefix != "" {
+		return name, opts, ruleFieldError("RemoteIPPrefix", r.RemoteIPPrefix, "can't be specified with RemoteGroupID [%s]", r.RemoteGroupID)
+	}
+	opts.RemoteGroupID = r.RemoteGroupID
 
-	} else {
-		return name, opts, fmt.Errorf(`"ether-type" must be either "IPv4" or "IPv6"`)
+	var prefixType string
+	if r.RemoteIPPrefix != "" {
+		opts.RemoteIPPrefix, prefixType, err = ParsePrefix(r.RemoteIPPrefix)
+		if err != nil {
+			return name, opts, err
+		}
 	}
 
-	if r.Protocol == "tcp" {
-		opts.Protocol = rules.ProtocolTCP
+	// Detect the ether type from remote IP prefix if it is omitted.
+	etherType := r.EtherType
+	if etherType == "" {
+		etherType = prefixType
+		if etherType == "" {
+			etherType = "IPv4"
+		}
+	}
 
-	} else if r.Protocol == "udp" {
-		opts.Protocol = rules.ProtocolUDP
+	if strings.EqualFold(etherType, "IPv4") {
+		opts.EtherType = rules.EtherType4
 
-	} else if r.Protocol == "icmp" {
-		opts.Protocol = rules.ProtocolICMP
+	} else if strings.EqualFold(etherType, "IPv6") {
+		opts.EtherType = rules.EtherType6
 
-	} else if r.Protocol == "all" {
-		opts.Protocol = ""
+	} else if strings.EqualFold(etherType, ETHER_TYPE_BOTH) {
+		return name, opts, ruleFieldError("EtherType", r.EtherType, "use Expand() to split it into IPv4 and IPv6 rules")
 
 	} else {
-		return name, opts, fmt.Errorf(`invalid protocol[%s]`, r.Protocol)
+		return name, opts, ruleFieldError("EtherType", r.EtherType, `must be either "IPv4" or "IPv6"`)
+	}
+
+	if prefixType != "" && string(opts.EtherType) != prefixType {
+		return name, opts, ruleFieldError("EtherType", etherType, "doesn't match RemoteIPPrefix, that is %s address [%s]", prefixType, r.RemoteIPPrefix)
 	}
 
+	// Protocol
+	proto, err := NormalizeProtocol(r.Protocol)
+	if err != nil {
+		return name, opts, err
+	}
+	if proto == "icmp" && opts.EtherType == rules.EtherType6 {
+		return name, opts, ruleFieldError("Protocol", r.Protocol, `use "icmpv6" for IPv6`)
+	} else if proto == "icmpv6" && opts.EtherType == rules.EtherType4 {
+		return name, opts, ruleFieldError("Protocol", r.Protocol, `use "icmp" for IPv4`)
+	}
+	opts.Protocol = rules.RuleProtocol(apiProtocol(proto))
+
+	// Port range, or ICMP type and code
 	if r.PortRange != "" {
-		m, err := regexp.MatchString(`^[0-9]+[\-:][0-9]+$`, r.PortRange)
+		if strings.Contains(r.PortRange, ",") {
+			return name, opts, ruleFieldError("PortRange", r.PortRange, "port list is given. use Expand() to split it into each port range")
+		} else if _, ok := icmpv6TypeGroups[strings.ToLower(r.PortRange)]; ok && proto == "icmpv6" {
+			return name, opts, ruleFieldError("PortRange", r.PortRange, "use Expand() to split it into each ICMPv6 type")
+		}
+
+		if isICMP(proto) {
+			opts.PortRangeMin, opts.PortRangeMax, err = parseICMPTypeCode(proto, r.PortRange)
+		} else if hasPorts(proto) {
+			opts.PortRangeMin, opts.PortRangeMax, err = parsePortRange(r.PortRange)
+		} else if proto == "" {
+			// Must specify the protocol if port range is given.
+			err = ruleFieldError("Protocol", r.Protocol, "must specify the protocol if port range is given")
+		} else {
+			err = ruleFieldError("PortRange", r.PortRange, "protocol %s has no ports", proto)
+		}
 		if err != nil {
 			return name, opts, err
+		}
+	}
 
-		} else if m {
-			p := strings.Index(r.PortRange, ":")
-			if p < 0 {
-				p = strings.Index(r.PortRange, "-")
-			}
+	return name, opts, nil
+}
 
-			if p < 0 {
-				// ないはず
-				return name, opts, errors.New("invalid port range(may be a wrong regular expression)")
-			}
+// Parse a port ("80") or port range ("80-8080" or "80:8080") and return the minimum and maximum port.
+func parsePortRange(portRange string) (min int, max int, err error) {
+	m, err := regexp.MatchString(`^[0-9]+([\-:][0-9]+)?$`, portRange)
+	if err != nil {
+		return 0, 0, err
+	} else if !m {
+		return 0, 0, ruleFieldError("PortRange", portRange, `must be a port or port range. (e.g. "80", "80-8080")`)
+	}
 
-			opts.PortRangeMin, err = strconv.Atoi(r.PortRange[:p])
-			if err != nil {
-				// ないはず
-				return name, opts, errors.New("invalid port range(may be a wrong regular expression)")
+	p := strings.IndexAny(portRange, "-:")
+	if p < 0 {
+		min, err = strconv.Atoi(portRange)
+		max = min
+	} else {
+		if min, err = strconv.Atoi(portRange[:p]); err == nil {
+			max, err = strconv.Atoi(portRange[p+1:])
+		}
+	}
+	if err != nil {
+		return 0, 0, ruleFieldError("PortRange", portRange, "too large number")
+	}
+
+	if min < 1 || min > 65535 || max < 1 || max > 65535 {
+		return 0, 0, ruleFieldError("PortRange", portRange, "port must be between 1 and 65535")
+	} else if min > max {
+		return 0, 0, ruleFieldError("PortRange", portRange, "minimum port must be less than or equal to maximum port")
+	}
+	return min, max, nil
+}
+
+// Parse an IP prefix in CIDR notation.
+// It returns the prefix whose host bits are cleared (e.g. "192.168.0.1/24" to "192.168.0.0/24")
+// and the ether type ("IPv4" or "IPv6") of it.
+func ParsePrefix(prefix string) (normalized string, etherType string, err error) {
+	if !strings.Contains(prefix, "/") {
+		return "", "", ruleFieldError("RemoteIPPrefix", prefix, `must be CIDR notation. (e.g. "192.168.0.0/24")`)
+	}
+
+	_, ipnet, err := net.ParseCIDR(strings.TrimSpace(prefix))
+	if err != nil {
+		return "", "", ruleFieldError("RemoteIPPrefix", prefix, "invalid CIDR")
+	}
+
+	if ipnet.IP.To4() != nil {
+		etherType = "IPv4"
+	} else {
+		etherType = "IPv6"
+	}
+	return ipnet.String(), etherType, nil
+}
+
+// Split the rule into the rules that can be converted by ToCreateOpts().
+//
+// A comma-separated port list (e.g. "80,443,8000-8100") is split into each port or port range,
+// and the ether type "both" is split into IPv4 and IPv6.
+// For ICMPv6, "neighbor-discovery" is split into the types of neighbor discovery protocol.
+func (r *RuleCreateOpts) Expand() ([]RuleCreateOpts, error) {
+	etherTypes := []string{r.EtherType}
+	if strings.EqualFold(r.EtherType, ETHER_TYPE_BOTH) {
+		if r.RemoteIPPrefix != "" {
+			return nil, ruleFieldError("EtherType", r.EtherType, "can't be used with RemoteIPPrefix [%s]", r.RemoteIPPrefix)
+		}
+		etherTypes = []string{"IPv4", "IPv6"}
+	}
+
+	expanded := make([]RuleCreateOpts, 0, len(etherTypes))
+	for _, et := range etherTypes {
+		e := *r
+		e.EtherType = et
+
+		proto, err := NormalizeProtocol(e.Protocol)
+		if err != nil {
+			return nil, err
+		}
+
+		// ICMP rule of "both" becomes ICMPv6 for IPv6.
+		// Since the type numbers differ, only the type names are allowed.
+		if len(etherTypes) > 1 && isICMP(proto) {
+			if e.PortRange != "" && e.PortRange[0] >= '0' && e.PortRange[0] <= '9' {
+				return nil, ruleFieldError("PortRange", e.PortRange, `ICMP type must be the name if "ether-type" is "%s"`, ETHER_TYPE_BOTH)
 			}
-			opts.PortRangeMax, err = strconv.Atoi(r.PortRange[p+1:])
-			if err != nil {
-				// ないはず
-				return name, opts, errors.New("invalid port range(may be a wrong regular expression)")
+			if et == "IPv4" {
+				proto = "icmp"
+			} else {
+				proto = "icmpv6"
 			}
+			e.Protocol = proto
+		}
 
-		} else {
-			p, err := strconv.Atoi(r.PortRange)
-			if err != nil {
-				return name, opts, fmt.Errorf("Invalid format of PortRange. [%s]", r.PortRange)
+		portRange := e.PortRange
+		if group, ok := icmpv6TypeGroups[strings.ToLower(portRange)]; ok && proto == "icmpv6" {
+			portRange = group
+		}
+
+		if !strings.Contains(portRange, ",") {
+			e.PortRange = portRange
+			expanded = append(expanded, e)
+			continue
+		}
+
+		for _, pr := range strings.Split(portRange, ",") {
+			pr = strings.TrimSpace(pr)
+			if pr == "" {
+				return nil, ruleFieldError("PortRange", r.PortRange, "empty entry in the port list")
 			}
-			opts.PortRangeMin = p
-			opts.PortRangeMax = p
+			e.PortRange = pr
+			expanded = append(expanded, e)
 		}
+	}
+	return expanded, nil
+}
 
-		// Must specify the protocol if port range is given.
-		if opts.Protocol == "" {
-			return name, opts, fmt.Errorf("Must specify the protocol if port range is given.")
+// Max number of API requests to create rules in parallel.
+const MAX_PARALLEL_REQUESTS = 8
+
+// Create a security group rule and return created it.
+func CreateRule(os *OpenStack, rule RuleCreateOpts) (*rules.SecGroupRule, error) {
+	sgs, err := ListGroup(os)
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := rule.resolve(sgs)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkRulePolicy(os, sgs, []rules.CreateOpts{opts}); err != nil {
+		return nil, err
+	}
+	return createRule(os, opts)
+}
+
+// Check the rules to be created against the policy.
+func checkRulePolicy(os *OpenStack, sgs []groups.SecGroup, optsList []rules.CreateOpts) error {
+	if os.Policy == nil {
+		return nil
+	}
+
+	violations := make([]PolicyViolation, 0)
+	for _, opts := range optsList {
+		group, err := FindGroup(sgs, opts.SecGroupID)
+		if err != nil {
+			return err
 		}
+		violations = append(violations, os.Policy.CheckRule(*group, ruleFromCreateOpts(opts))...)
 	}
+	return os.enforcePolicy(violations)
+}
 
-	if r.RemoteGroupID != "" {
-		opts.RemoteGroupID = r.RemoteGroupID
+// Convert to gophercloud CreateOpts, and resolve the security group and remote group that may be given by name.
+func (r *RuleCreateOpts) resolve(sgs []groups.SecGroup) (opts rules.CreateOpts, err error) {
+	name, opts, err := r.ToCreateOpts()
+	if err != nil {
+		return opts, err
 	}
 
-	if r.RemoteIPPrefix != "" {
-		opts.RemoteIPPrefix = r.RemoteIPPrefix
+	// Detect the security group
+	group, err := FindGroup(sgs, name)
+	if err != nil {
+		return opts, err
 	}
-	return name, opts, nil
+	opts.SecGroupID = group.ID
+
+	// Remote group may be given by name
+	if opts.RemoteGroupID != "" {
+		remote, err := FindGroup(sgs, opts.RemoteGroupID)
+		if err != nil {
+			return opts, err
+		}
+		opts.RemoteGroupID = remote.ID
+	}
+	return opts, nil
 }
 
-// Create a security group rule and return created it.
-func CreateRule(os *OpenStack, rule RuleCreateOpts) (*rules.SecGroupRule, error) {
-	name, opts, err := rule.ToCreateOpts()
+func createRule(os *OpenStack, opts rules.CreateOpts) (*rules.SecGroupRule, error) {
+	created, err := rules.Create(os.Network, opts).Extract()
+
+	// The requested rule is recorded if the creation fails.
+	after := created
+	if err != nil {
+		rule := ruleFromCreateOpts(opts)
+		after = &rule
+	}
+	os.record(&JournalRecord{
+		Operation: JOURNAL_CREATE_RULE,
+		Group:     os.journalGroupName(opts.SecGroupID),
+		GroupID:   opts.SecGroupID,
+		After:     &JournalState{Rule: after},
+	}, err)
+
 	if err != nil {
 		return nil, err
 	}
+	return created, nil
+}
 
-	// Detect the security group
-	group, err := GetGroup(os, name)
+// Create security group rules from the rule that may have a port list, and return created them.
+// The rules are created in parallel. If any creation fails, the rules already created are deleted.
+func CreateRules(os *OpenStack, rule RuleCreateOpts) ([]*rules.SecGroupRule, error) {
+	return CreateRuleSet(os, []RuleCreateOpts{rule})
+}
+
+// Create security group rules and return created them. Each rule is expanded by Expand().
+// The rules are created in parallel. If any creation fails, the rules already created are deleted.
+func CreateRuleSet(os *OpenStack, rs []RuleCreateOpts) ([]*rules.SecGroupRule, error) {
+	expanded := make([]RuleCreateOpts, 0, len(rs))
+	for _, r := range rs {
+		e, err := r.Expand()
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, e...)
+	}
+
+	// Validate all rules before calling API
+	for _, e := range expanded {
+		if _, _, err := e.ToCreateOpts(); err != nil {
+			return nil, err
+		}
+	}
+
+	sgs, err := ListGroup(os)
 	if err != nil {
 		return nil, err
 	}
-	opts.SecGroupID = group.ID
 
-	rt := rules.Create(os.Network, opts)
-	if rt.Err != nil {
-		return nil, rt.Err
+	optsList := make([]rules.CreateOpts, 0, len(expanded))
+	for _, e := range expanded {
+		opts, err := e.resolve(sgs)
+		if err != nil {
+			return nil, err
+		}
+		optsList = append(optsList, opts)
+	}
+	if err = checkRulePolicy(os, sgs, optsList); err != nil {
+		return nil, err
+	}
+
+	created := make([]*rules.SecGroupRule, len(optsList))
+	errs := make([]error, len(optsList))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, MAX_PARALLEL_REQUESTS)
+	for i, opts := range optsList {
+		wg.Add(1)
+		go func(i int, opts rules.CreateOpts) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			created[i], errs[i] = createRule(os, opts)
+		}(i, opts)
+	}
+	wg.Wait()
+
+	var failed error
+	for _, err := range errs {
+		if err != nil {
+			failed = err
+			break
+		}
+	}
+	if failed == nil {
+		return created, nil
+	}
+
+	// Rollback
+	remains := make([]string, 0, len(created))
+	for _, c := range created {
+		if c == nil {
+			continue
+		}
+		if err := DeleteRule(os, c.ID); err != nil {
+			remains = append(remains, c.ID)
+		}
+	}
+	if len(remains) > 0 {
+		return nil, fmt.Errorf("%s (and failed to rollback the rules. [%s])", failed, strings.Join(remains, ", "))
+	}
+	return nil, failed
+}
+
+// Return the key to compare security group rules by content, not by UUID.
+// Description is not included.
+func RuleContentKey(rule rules.SecGroupRule) string {
+	prefix := rule.RemoteIPPrefix
+	if prefix != "" {
+		if normalized, _, err := ParsePrefix(prefix); err == nil {
+			prefix = normalized
+		}
+	}
+
+	return fmt.Sprintf("%s|%s|%s|%d|%d|%s|%s",
+		rule.Direction,
+		rule.EtherType,
+		ProtocolName(rule.Protocol),
+		rule.PortRangeMin,
+		rule.PortRangeMax,
+		prefix,
+		rule.RemoteGroupID,
+	)
+}
+
+// Convert gophercloud CreateOpts to the rule that would be created.
+func ruleFromCreateOpts(opts rules.CreateOpts) rules.SecGroupRule {
+	return rules.SecGroupRule{
+		Direction:      string(opts.Direction),
+		Description:    opts.Description,
+		EtherType:      string(opts.EtherType),
+		SecGroupID:     opts.SecGroupID,
+		PortRangeMin:   opts.PortRangeMin,
+		PortRangeMax:   opts.PortRangeMax,
+		Protocol:       string(opts.Protocol),
+		RemoteGroupID:  opts.RemoteGroupID,
+		RemoteIPPrefix: opts.RemoteIPPrefix,
 	}
-	return rt.Extract()
 }
 
 // Detele a security group rule
 func DeleteRule(os *OpenStack, uuid string) error {
-	return rules.Delete(os.Network, uuid).Err
+	r := &JournalRecord{Operation: JOURNAL_DELETE_RULE}
+	if os.Journal != nil {
+		// The rule is recorded to undo the deletion.
+		rule, err := rules.Get(os.Network, uuid).Extract()
+		if err != nil {
+			return err
+		}
+		sg, err := groups.Get(os.Network, rule.SecGroupID).Extract()
+		if err != nil {
+			return err
+		}
+		r.Group = sg.Name
+		r.GroupID = rule.SecGroupID
+		r.Before = &JournalState{Rule: rule}
+	}
+
+	err := rules.Delete(os.Network, uuid).Err
+	os.record(r, err)
+	return err
 }
 
 // List the user created security groups.
@@ -174,8 +519,18 @@ func GetGroup(os *OpenStack, name string) (*groups.SecGroup, error) {
 		return nil, err
 	}
 
+	return FindGroup(sgs, name)
+}
+
+// Find a security group by ID or name from sgs.
+func FindGroup(sgs []groups.SecGroup, name string) (*groups.SecGroup, error) {
 	for _, g := range sgs {
-		if g.ID == name || g.Name == name {
+		if g.ID == name {
+			return &g, nil
+		}
+	}
+	for _, g := range sgs {
+		if g.Name == name {
 			return &g, nil
 		}
 	}
@@ -183,11 +538,16 @@ func GetGroup(os *OpenStack, name string) (*groups.SecGroup, error) {
 	return nil, fmt.Errorf("Can't found the security group. [%s]", name)
 }
 
+// Return whether the security group is created by the system.
+func IsSystemGroup(name string) bool {
+	return name == SYSTEM_SECGROUP_DEFAULT || strings.HasPrefix(name, SYSTEM_SECGROUP_PREFIX)
+}
+
 // Remove the system security groups from allgroups
 func RemoveSystemGroups(allgroups []groups.SecGroup) []groups.SecGroup {
 	ugs := make([]groups.SecGroup, 0, len(allgroups))
 	for _, g := range allgroups {
-		if g.Name != SYSTEM_SECGROUP_DEFAULT && !strings.HasPrefix(g.Name, SYSTEM_SECGROUP_PREFIX) {
+		if !IsSystemGroup(g.Name) {
 			ugs = append(ugs, g)
 		}
 	}
@@ -197,27 +557,79 @@ func RemoveSystemGroups(allgroups []groups.SecGroup) []groups.SecGroup {
 
 // Create a security group
 func CreateGroup(os *OpenStack, name string, description string) (*groups.SecGroup, error) {
+	if os.Policy != nil {
+		if err := os.enforcePolicy(os.Policy.CheckGroup(name, description)); err != nil {
+			return nil, err
+		}
+	}
+
 	opts := groups.CreateOpts{
 		Name:        name,
 		Description: description,
 	}
-	return groups.Create(os.Network, opts).Extract()
+	created, err := groups.Create(os.Network, opts).Extract()
+
+	r := &JournalRecord{Operation: JOURNAL_CREATE_GROUP, Group: name}
+	if err == nil {
+		r.GroupID = created.ID
+		r.After = &JournalState{Group: created}
+	}
+	os.record(r, err)
+
+	return created, err
 }
 
 // Delete a security group
 func DeleteGroup(os *OpenStack, name string) error {
-	group, err := GetGroup(os, name)
+	sgs, err := ListGroup(os)
+	if err != nil {
+		return err
+	}
+	group, err := FindGroup(sgs, name)
 	if err != nil {
 		return err
 	}
 
+	if os.Policy != nil {
+		vpss, err := ListVps(os, nil)
+		if err != nil {
+			return err
+		}
+		if err = os.enforcePolicy(os.Policy.CheckDeleteGroup(sgs, vpss, group.Name)); err != nil {
+			return err
+		}
+	}
+
 	rt := groups.Delete(os.Network, group.ID)
+	os.record(&JournalRecord{
+		Operation: JOURNAL_DELETE_GROUP,
+		Group:     group.Name,
+		GroupID:   group.ID,
+		Before:    &JournalState{Group: group, Referrers: referringRules(sgs, group.ID)},
+	}, rt.Err)
+
 	if rt.Err != nil {
 		return rt.Err
 	}
 	return nil
 }
 
+// Return the rules of the other groups that refer to the group as the remote group.
+func referringRules(sgs []groups.SecGroup, id string) []rules.SecGroupRule {
+	referrers := make([]rules.SecGroupRule, 0)
+	for _, sg := range sgs {
+		if sg.ID == id {
+			continue
+		}
+		for _, rule := range sg.Rules {
+			if rule.RemoteGroupID == id {
+				referrers = append(referrers, rule)
+			}
+		}
+	}
+	return referrers
+}
+
 // Attach security group to VPS and return attached security group.
 //
 // As for fixedIps or allowedAddressPairs,
@@ -232,10 +644,12 @@ func Attach(os *OpenStack, vps *Vps, groupName string, fixedIps []string, allowe
 	for _, g := range vps.SecurityGroups {
 		secGroupIds = append(secGroupIds, g.ID)
 	}
+	before := append([]string{}, secGroupIds...)
 
 	for _, sg := range sgs {
 		if sg.Name == groupName || sg.ID == groupName {
-			attached = &sg
+			g := sg
+			attached = &g
 			secGroupIds = append(secGroupIds, sg.ID)
 		}
 	}
@@ -243,28 +657,46 @@ func Attach(os *OpenStack, vps *Vps, groupName string, fixedIps []string, allowe
 		return nil, fmt.Errorf("Security group not found. [%s]", groupName)
 	}
 
+	if os.Policy != nil {
+		if err = os.enforcePolicy(os.Policy.CheckAttach(vps, *attached)); err != nil {
+			return nil, err
+		}
+	}
+
 	opts := ports.UpdateOpts{
 		SecurityGroups: &secGroupIds,
 	}
 
 	if fixedIps != nil {
-		opts.FixedIPs = fixedIps
+		opts.FixedIPs, err = toFixedIPs(fixedIps)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if allowedAddressPairs != nil {
+		pairs := make([]ports.AddressPair, 0, len(allowedAddressPairs))
 		for _, ip := range allowedAddressPairs {
-			*opts.AllowedAddressPairs = append(*opts.AllowedAddressPairs, ports.AddressPair{
-				IPAddress: ip,
+			address, err := parsePairAddress(ip)
+			if err != nil {
+				return nil, err
+			}
+			pairs = append(pairs, ports.AddressPair{
+				IPAddress: address,
 			})
 		}
+		opts.AllowedAddressPairs = &pairs
 	}
 
-	_, err = ports.Update(os.Network, vps.ExternalPort.PortId, opts).Extract()
+	updated, err := updatePort(os, vps.ExternalPort.PortId, opts)
+	os.recordPortUpdate(&JournalRecord{
+		Operation: JOURNAL_ATTACH,
+		Group:     attached.Name,
+		GroupID:   attached.ID,
+		Vps:       vps.NameTag,
+		VpsID:     vps.ID,
+	}, vps.ExternalPort.PortId, before, secGroupIds, updated, err)
 	if err != nil {
-		ed, ok := err.(gophercloud.ErrDefault400)
-		if ok {
-			err = errors.New(string(ed.Body))
-		}
 		return nil, err
 	}
 
@@ -276,7 +708,8 @@ func Detach(os *OpenStack, vps *Vps, groupName string) (detached *secgroups.Secu
 	secGroupIds := make([]string, 0, len(vps.SecurityGroups))
 	for _, sg := range vps.SecurityGroups {
 		if sg.Name == groupName || sg.ID == groupName {
-			detached = &sg
+			g := sg
+			detached = &g
 			continue
 		} else {
 			secGroupIds = append(secGroupIds, sg.ID)
@@ -286,15 +719,29 @@ func Detach(os *OpenStack, vps *Vps, groupName string) (detached *secgroups.Secu
 		return nil, fmt.Errorf("Security group not found. [%s]", groupName)
 	}
 
+	if os.Policy != nil {
+		if err = os.enforcePolicy(os.Policy.CheckDetach(vps, detached.Name)); err != nil {
+			return nil, err
+		}
+	}
+
+	before := make([]string, 0, len(vps.SecurityGroups))
+	for _, sg := range vps.SecurityGroups {
+		before = append(before, sg.ID)
+	}
+
 	opts := ports.UpdateOpts{
 		SecurityGroups: &secGroupIds,
 	}
-	_, err = ports.Update(os.Network, vps.ExternalPort.PortId, opts).Extract()
+	updated, err := updatePort(os, vps.ExternalPort.PortId, opts)
+	os.recordPortUpdate(&JournalRecord{
+		Operation: JOURNAL_DETACH,
+		Group:     detached.Name,
+		GroupID:   detached.ID,
+		Vps:       vps.NameTag,
+		VpsID:     vps.ID,
+	}, vps.ExternalPort.PortId, before, secGroupIds, updated, err)
 	if err != nil {
-		ed, ok := err.(gophercloud.ErrDefault400)
-		if ok {
-			err = errors.New(string(ed.Body))
-		}
 		return nil, err
 	}
 	return detached, nil
@@ -1,5 +1,7 @@
 package conoha
 
+import "github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+import "github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
 import "github.com/mitchellh/mapstructure"
 import "testing"
 import "reflect"
@@ -13,7 +15,7 @@ func TestToCreateOpts(t *testing.T) {
 			"PortRange":         "80:8080",
 			"Protocol":          "tcp",
 			"RemoteGroupID":     "",
-			"RemoteIPPrefix":    "192.168.0.0/24",
+			"RemoteIPPrefix":    "2001:db8::/32",
 		},
 		{
 			"SecurityGroupName": "test-name",
@@ -22,7 +24,7 @@ func TestToCreateOpts(t *testing.T) {
 			"PortRange":         "80",
 			"Protocol":          "udp",
 			"RemoteGroupID":     "",
-			"RemoteIPPrefix":    "192.168.0.0",
+			"RemoteIPPrefix":    "192.168.0.0/24",
 		},
 	}
 
@@ -54,3 +56,179 @@ func TestToCreateOpts(t *testing.T) {
 		}
 	}
 }
+
+func TestExpand(t *testing.T) {
+	r := RuleCreateOpts{
+		SecurityGroupName: "test-name",
+		Direction:         "ingress",
+		EtherType:         "IPv4",
+		PortRange:         "80, 443,8000-8100",
+		Protocol:          "tcp",
+	}
+
+	expanded, err := r.Expand()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"80", "443", "8000-8100"}
+	if len(expanded) != len(expected) {
+		t.Fatalf("%d rules should be expanded, but %d", len(expected), len(expanded))
+	}
+	for i, e := range expanded {
+		if e.PortRange != expected[i] {
+			t.Errorf(`PortRange should be "%s", but "%s"`, expected[i], e.PortRange)
+		}
+		if e.SecurityGroupName != r.SecurityGroupName || e.Protocol != r.Protocol {
+			t.Errorf("other fields should be copied")
+		}
+		if _, _, err := e.ToCreateOpts(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, _, err := r.ToCreateOpts(); err == nil {
+		t.Errorf("ToCreateOpts should reject the port list")
+	}
+
+	r.PortRange = "80,,443"
+	if _, err := r.Expand(); err == nil {
+		t.Errorf("empty entry should be rejected")
+	}
+}
+
+func TestEtherType(t *testing.T) {
+	r := RuleCreateOpts{
+		SecurityGroupName: "test-name",
+		Direction:         "ingress",
+		Protocol:          "tcp",
+		RemoteIPPrefix:    "2001:db8::/32",
+	}
+
+	// detect from remote IP prefix
+	_, opts, err := r.ToCreateOpts()
+	if err != nil {
+		t.Fatal(err)
+	} else if opts.EtherType != rules.EtherType6 {
+		t.Errorf("EtherType should be detected as IPv6, but %s", opts.EtherType)
+	}
+
+	// mismatch
+	r.EtherType = "IPv4"
+	if _, _, err = r.ToCreateOpts(); err == nil {
+		t.Errorf("IPv6 prefix with IPv4 should be rejected")
+	}
+
+	// both
+	r.EtherType = ETHER_TYPE_BOTH
+	if _, err = r.Expand(); err == nil {
+		t.Errorf("both with remote IP prefix should be rejected")
+	}
+
+	r.RemoteIPPrefix = ""
+	r.PortRange = "80,443"
+	expanded, err := r.Expand()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(expanded) != 4 {
+		t.Fatalf("4 rules should be expanded, but %d", len(expanded))
+	}
+
+	etherTypes := map[rules.RuleEtherType]int{}
+	for _, e := range expanded {
+		_, opts, err := e.ToCreateOpts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		etherTypes[opts.EtherType]++
+	}
+	if etherTypes[rules.EtherType4] != 2 || etherTypes[rules.EtherType6] != 2 {
+		t.Errorf("IPv4 and IPv6 rule pairs should be expanded. %v", etherTypes)
+	}
+}
+
+func TestToCreateOptsValidation(t *testing.T) {
+	base := RuleCreateOpts{
+		SecurityGroupName: "test-name",
+		Direction:         "ingress",
+		Protocol:          "tcp",
+	}
+
+	invalids := []struct {
+		field  string
+		modify func(r *RuleCreateOpts)
+	}{
+		{"SecurityGroupName", func(r *RuleCreateOpts) { r.SecurityGroupName = "" }},
+		{"Direction", func(r *RuleCreateOpts) { r.Direction = "inbound" }},
+		{"EtherType", func(r *RuleCreateOpts) { r.EtherType = "IPv5" }},
+		{"Protocol", func(r *RuleCreateOpts) { r.Protocol = "tcp6" }},
+		{"Protocol", func(r *RuleCreateOpts) { r.Protocol = "all"; r.PortRange = "22" }},
+		{"PortRange", func(r *RuleCreateOpts) { r.PortRange = "0" }},
+		{"PortRange", func(r *RuleCreateOpts) { r.PortRange = "65536" }},
+		{"PortRange", func(r *RuleCreateOpts) { r.PortRange = "8080-80" }},
+		{"PortRange", func(r *RuleCreateOpts) { r.PortRange = "80-" }},
+		{"PortRange", func(r *RuleCreateOpts) { r.PortRange = "99999999999999999999" }},
+		{"RemoteIPPrefix", func(r *RuleCreateOpts) { r.RemoteIPPrefix = "192.168.0.0" }},
+		{"RemoteIPPrefix", func(r *RuleCreateOpts) { r.RemoteIPPrefix = "192.168.0.0/33" }},
+		{"RemoteIPPrefix", func(r *RuleCreateOpts) { r.RemoteIPPrefix = "192.168.0.0/24"; r.RemoteGroupID = "web" }},
+		{"EtherType", func(r *RuleCreateOpts) { r.RemoteIPPrefix = "192.168.0.0/24"; r.EtherType = "IPv6" }},
+	}
+
+	for i, invalid := range invalids {
+		r := base
+		invalid.modify(&r)
+
+		_, _, err := r.ToCreateOpts()
+		if err == nil {
+			t.Errorf("[%d] should be rejected", i)
+			continue
+		}
+
+		fe, ok := err.(*RuleFieldError)
+		if !ok {
+			t.Errorf("[%d] error should be *RuleFieldError. %v", i, err)
+		} else if fe.Field != invalid.field {
+			t.Errorf(`[%d] field should be "%s", but "%s"`, i, invalid.field, fe.Field)
+		}
+	}
+
+	// normalization
+	r := base
+	r.PortRange = "1:65535"
+	r.RemoteIPPrefix = "192.168.10.20/16"
+	_, opts, err := r.ToCreateOpts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.RemoteIPPrefix != "192.168.0.0/16" {
+		t.Errorf("host bits should be cleared, but %s", opts.RemoteIPPrefix)
+	}
+	if opts.PortRangeMin != 1 || opts.PortRangeMax != 65535 {
+		t.Errorf("unexpected port range. %d - %d", opts.PortRangeMin, opts.PortRangeMax)
+	}
+}
+
+func TestFindGroup(t *testing.T) {
+	sgs := []groups.SecGroup{
+		{ID: "0b3f0b4e-1111-4a6e-9c1b-000000000001", Name: "web"},
+		{ID: "0b3f0b4e-1111-4a6e-9c1b-000000000002", Name: "db"},
+	}
+
+	g, err := FindGroup(sgs, "db")
+	if err != nil {
+		t.Fatal(err)
+	} else if g.ID != sgs[1].ID {
+		t.Errorf("unexpected group. %s", g.ID)
+	}
+
+	g, err = FindGroup(sgs, sgs[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	} else if g.Name != "web" {
+		t.Errorf("unexpected group. %s", g.Name)
+	}
+
+	if _, err = FindGroup(sgs, "app"); err == nil {
+		t.Errorf("missing group should be an error")
+	}
+}
@@ -10,6 +10,15 @@ import (
 type OpenStack struct {
 	Compute *gophercloud.ServiceClient
 	Network *gophercloud.ServiceClient
+
+	// Policy enforced before changing security groups, or nil
+	Policy *Policy
+
+	// Reason to override the policy. The violations are logged instead of being blocked.
+	PolicyOverride string
+
+	// Journal to record the changes of security groups, or nil
+	Journal *Journal
 }
 
 func NewOpenStack() (*OpenStack, error) {
@@ -0,0 +1,366 @@
+package conoha
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+)
+
+// Plan to minimize the rules of a security group.
+type OptimizePlan struct {
+	Group groups.SecGroup
+
+	// Rules before and after the optimization
+	Before []rules.SecGroupRule
+	After  []rules.SecGroupRule
+
+	// Rules to be created and deleted
+	Creates []rules.SecGroupRule
+	Deletes []rules.SecGroupRule
+}
+
+// Return whether the plan changes the rules.
+func (p *OptimizePlan) HasChanges() bool {
+	return len(p.Creates) > 0 || len(p.Deletes) > 0
+}
+
+// Rules that can be merged each other.
+type optimizeClass struct {
+	direction     string
+	etherType     string
+	protocol      string
+	remoteGroupID string
+
+	// Labels of the description. Rules that have different labels are not merged,
+	// so that the ownership and expiry of the rules are retained.
+	labels string
+}
+
+// Rules that have the same port range (or ICMP type and code) during the optimization.
+type optimizeItem struct {
+	min, max    int
+	prefixes    *CIDRSet // nil for the remote group
+	description string
+}
+
+// Make the plan to merge the adjacent and overlapping prefixes and port ranges
+// of the rules with identical direction, protocol, ether type and remote group.
+// Rules managed by conoha-net (e.g. created with TTL or as a bundle) are kept as is.
+func PlanOptimize(sg groups.SecGroup) (*OptimizePlan, error) {
+	plan := &OptimizePlan{
+		Group:   sg,
+		Before:  sg.Rules,
+		Creates: []rules.SecGroupRule{},
+		Deletes: []rules.SecGroupRule{},
+	}
+
+	optimized := make([]rules.SecGroupRule, 0, len(sg.Rules))
+	classes := map[optimizeClass][]rules.SecGroupRule{}
+	order := make([]optimizeClass, 0)
+	for _, rule := range sg.Rules {
+		if ParseAnnotation(rule.Description).IsManaged() {
+			optimized = append(optimized, rule)
+			continue
+		}
+
+		c := optimizeClass{
+			direction:     rule.Direction,
+			etherType:     rule.EtherType,
+			protocol:      ProtocolName(rule.Protocol),
+			remoteGroupID: rule.RemoteGroupID,
+			labels:        Annotation{Labels: ParseAnnotation(rule.Description).Labels}.String(),
+		}
+		if _, ok := classes[c]; !ok {
+			order = append(order, c)
+		}
+		classes[c] = append(classes[c], rule)
+	}
+
+	for _, c := range order {
+		rs, err := optimizeRules(c, classes[c])
+		if err != nil {
+			return nil, err
+		}
+		optimized = append(optimized, rs...)
+	}
+
+	// The existing rules that have the same content are retained.
+	existing := map[string][]rules.SecGroupRule{}
+	for _, rule := range sg.Rules {
+		key := RuleContentKey(rule)
+		existing[key] = append(existing[key], rule)
+	}
+
+	plan.After = make([]rules.SecGroupRule, 0, len(optimized))
+	for _, rule := range optimized {
+		key := RuleContentKey(rule)
+		if rs := existing[key]; len(rs) > 0 {
+			plan.After = append(plan.After, rs[0])
+			existing[key] = rs[1:]
+			continue
+		}
+		plan.After = append(plan.After, rule)
+		plan.Creates = append(plan.Creates, rule)
+	}
+
+	for _, rule := range sg.Rules {
+		for _, remain := range existing[RuleContentKey(rule)] {
+			if remain.ID == rule.ID {
+				plan.Deletes = append(plan.Deletes, rule)
+				break
+			}
+		}
+	}
+	return plan, nil
+}
+
+// Minimize the rules of the class.
+func optimizeRules(c optimizeClass, rs []rules.SecGroupRule) ([]rules.SecGroupRule, error) {
+	// Whether "any port" and "any address" are used.
+	// They are kept rather than 1-65535 and 0.0.0.0/0 to retain the existing rules.
+	anyPort, anyPrefix := false, false
+
+	items := make([]*optimizeItem, 0, len(rs))
+	for _, rule := range rs {
+		item := &optimizeItem{
+			min:         rule.PortRangeMin,
+			max:         rule.PortRangeMax,
+			description: rule.Description,
+		}
+		if hasPorts(c.protocol) && item.min == 0 && item.max == 0 {
+			item.min, item.max = 1, 65535
+			anyPort = true
+		}
+
+		if c.remoteGroupID == "" {
+			prefix := rule.RemoteIPPrefix
+			if prefix == "" {
+				prefix = anyAddress(c.etherType)
+				anyPrefix = true
+			}
+			set, err := NewCIDRSet(prefix)
+			if err != nil {
+				return nil, err
+			}
+			item.prefixes = set
+		}
+		items = append(items, item)
+	}
+
+	for {
+		n := len(items)
+		items = removeCoveredItems(c.protocol, items)
+		items = mergeItemPrefixes(items)
+		if hasPorts(c.protocol) {
+			items = mergeItemPorts(items)
+		}
+		if len(items) == n {
+			break
+		}
+	}
+
+	optimized := make([]rules.SecGroupRule, 0, len(items))
+	for _, item := range items {
+		min, max := item.min, item.max
+		if anyPort && min == 1 && max == 65535 {
+			min, max = 0, 0
+		}
+
+		prefixes := []string{""}
+		if item.prefixes != nil {
+			prefixes = item.prefixes.Prefixes()
+			if anyPrefix && len(prefixes) == 1 && prefixes[0] == anyAddress(c.etherType) {
+				prefixes = []string{""}
+			}
+		}
+
+		for _, prefix := range prefixes {
+			optimized = append(optimized, rules.SecGroupRule{
+				Direction:      c.direction,
+				EtherType:      c.etherType,
+				Protocol:       rs[0].Protocol,
+				PortRangeMin:   min,
+				PortRangeMax:   max,
+				RemoteGroupID:  c.remoteGroupID,
+				RemoteIPPrefix: prefix,
+				Description:    item.description,
+			})
+		}
+	}
+	return optimized, nil
+}
+
+// Return the prefix of any address of the ether type.
+func anyAddress(etherType string) string {
+	if etherType == "IPv6" {
+		return "::/0"
+	}
+	return "0.0.0.0/0"
+}
+
+// Return whether the item a covers the item b.
+func (a *optimizeItem) covers(protocol string, b *optimizeItem) bool {
+	if isICMP(protocol) {
+		// Type 0 means any type, and code 0 means any code.
+		if !(a.min == 0 && a.max == 0) && !(a.min == b.min && (a.max == 0 || a.max == b.max)) {
+			return false
+		}
+	} else if a.min > b.min || a.max < b.max {
+		return false
+	}
+
+	return a.prefixes == nil || a.prefixes.ContainsSet(b.prefixes)
+}
+
+// Remove the items covered by another item.
+func removeCoveredItems(protocol string, items []*optimizeItem) []*optimizeItem {
+	remains := make([]*optimizeItem, 0, len(items))
+	for i, item := range items {
+		covered := false
+		for j, other := range items {
+			if i == j || !other.covers(protocol, item) {
+				continue
+			}
+			// The first one is retained if they are identical.
+			if !item.covers(protocol, other) || j < i {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			remains = append(remains, item)
+		}
+	}
+	return remains
+}
+
+// Merge the prefixes of the items that have the same port range.
+func mergeItemPrefixes(items []*optimizeItem) []*optimizeItem {
+	merged := make([]*optimizeItem, 0, len(items))
+	index := map[[2]int]*optimizeItem{}
+	for _, item := range items {
+		key := [2]int{item.min, item.max}
+		m, ok := index[key]
+		if !ok {
+			m = &optimizeItem{min: item.min, max: item.max, prefixes: item.prefixes, description: item.description}
+			index[key] = m
+			merged = append(merged, m)
+			continue
+		}
+
+		if m.prefixes != nil {
+			m.prefixes = m.prefixes.Union(item.prefixes)
+		}
+		m.description = mergeItemDescription(m.description, item.description)
+	}
+	return merged
+}
+
+// Merge the adjacent and overlapping port ranges of the items that have the same prefixes.
+func mergeItemPorts(items []*optimizeItem) []*optimizeItem {
+	grouped := map[string][]*optimizeItem{}
+	order := make([]string, 0)
+	for _, item := range items {
+		key := ""
+		if item.prefixes != nil {
+			key = item.prefixes.String()
+		}
+		if _, ok := grouped[key]; !ok {
+			order = append(order, key)
+		}
+		grouped[key] = append(grouped[key], item)
+	}
+
+	merged := make([]*optimizeItem, 0, len(items))
+	for _, key := range order {
+		g := grouped[key]
+		sort.SliceStable(g, func(i, j int) bool { return g[i].min < g[j].min })
+
+		cur := *g[0]
+		for _, item := range g[1:] {
+			if item.min <= cur.max+1 {
+				if item.max > cur.max {
+					cur.max = item.max
+				}
+				cur.description = mergeItemDescription(cur.description, item.description)
+				continue
+			}
+			c := cur
+			merged = append(merged, &c)
+			cur = *item
+		}
+		merged = append(merged, &cur)
+	}
+	return merged
+}
+
+// The description is retained only if the merged rules have the same one.
+// Otherwise only the labels common to both are retained.
+func mergeItemDescription(a string, b string) string {
+	if a == b {
+		return a
+	}
+
+	la, lb := ParseAnnotation(a).Labels, ParseAnnotation(b).Labels
+	common := map[string]string{}
+	for k, v := range la {
+		if w, ok := lb[k]; ok && v == w {
+			common[k] = v
+		}
+	}
+	return Annotation{Labels: common}.String()
+}
+
+// Optimize the rules of the security group, and return the plan.
+//
+// The new rules are created before the old rules are deleted, so that the connectivity is not interrupted.
+// If dryRun is true, the rules are not changed.
+func Optimize(os *OpenStack, groupName string, dryRun bool) (*OptimizePlan, error) {
+	group, err := GetGroup(os, groupName)
+	if err != nil {
+		return nil, err
+	}
+
+	plan, err := PlanOptimize(*group)
+	if err != nil {
+		return nil, err
+	} else if dryRun || !plan.HasChanges() {
+		return plan, nil
+	}
+
+	if len(plan.Creates) > 0 {
+		rs := make([]RuleCreateOpts, 0, len(plan.Creates))
+		for _, rule := range plan.Creates {
+			r := RuleCreateOpts{}
+			r.FromSecGroupRule(rule)
+			r.SecurityGroupName = group.ID
+			rs = append(rs, r)
+		}
+
+		created, err := CreateRuleSet(os, rs)
+		if err != nil {
+			return nil, err
+		}
+
+		plan.Creates = make([]rules.SecGroupRule, 0, len(created))
+		for _, rule := range created {
+			plan.Creates = append(plan.Creates, *rule)
+		}
+	}
+
+	failed := make([]string, 0)
+	for _, rule := range plan.Deletes {
+		err := DeleteRule(os, rule.ID)
+		if _, ok := err.(gophercloud.ErrDefault404); err != nil && !ok {
+			failed = append(failed, fmt.Sprintf("%s: %s", rule.ID, err))
+		}
+	}
+	if len(failed) > 0 {
+		return plan, fmt.Errorf("Failed to delete the old rules. [%s]", strings.Join(failed, ", "))
+	}
+	return plan, nil
+}
@@ -0,0 +1,180 @@
+package conoha
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+)
+
+func testRule(id string, expr string) rules.SecGroupRule {
+	r, err := ParseRule(expr)
+	if err != nil {
+		panic(err)
+	}
+	r.SecurityGroupName = "test"
+	_, opts, err := r.ToCreateOpts()
+	if err != nil {
+		panic(err)
+	}
+	rule := ruleFromCreateOpts(opts)
+	rule.ID = id
+	return rule
+}
+
+func afterExpressions(plan *OptimizePlan) []string {
+	exprs := make([]string, 0, len(plan.After))
+	for _, rule := range plan.After {
+		var r RuleCreateOpts
+		r.FromSecGroupRule(rule)
+		exprs = append(exprs, r.String())
+	}
+	sort.Strings(exprs)
+	return exprs
+}
+
+func TestPlanOptimize(t *testing.T) {
+	sg := groups.SecGroup{
+		ID:   "sg",
+		Name: "test",
+		Rules: []rules.SecGroupRule{
+			// adjacent /32s
+			testRule("1", "in tcp/22 from 10.0.0.0/32"),
+			testRule("2", "in tcp/22 from 10.0.0.1/32"),
+			testRule("3", "in tcp/22 from 10.0.0.2/31"),
+			// overlapping port ranges
+			testRule("4", "in tcp/80-90 from 0.0.0.0/0"),
+			testRule("5", "in tcp/85-100 from 0.0.0.0/0"),
+			testRule("6", "in tcp/101 from 0.0.0.0/0"),
+			// shadowed
+			testRule("7", "in tcp/443 from 192.168.0.1/32"),
+			testRule("8", "in tcp/400-500 from 192.168.0.0/24"),
+			// duplicate
+			testRule("9", "in udp/53 from 10.1.0.0/16"),
+			testRule("10", "in udp/53 from 10.1.0.0/16"),
+			// different direction, not merged
+			testRule("11", "out tcp/22 to 10.0.0.4/30"),
+		},
+	}
+
+	plan, err := PlanOptimize(sg)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	expected := []string{
+		"in tcp/22 from 10.0.0.0/30",
+		"in tcp/400-500 from 192.168.0.0/24",
+		"in tcp/80-101 from 0.0.0.0/0",
+		"in udp/53 from 10.1.0.0/16",
+		"out tcp/22 to 10.0.0.4/30",
+	}
+	actual := afterExpressions(plan)
+	if len(actual) != len(expected) {
+		t.Fatalf("rules should be %v, but %v", expected, actual)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("rules should be %v, but %v", expected, actual)
+			break
+		}
+	}
+
+	// 8, 9 and 11 are retained
+	if len(plan.Creates) != 2 || len(plan.Deletes) != 8 {
+		t.Errorf("2 rules should be created and 8 rules should be deleted, but %d and %d", len(plan.Creates), len(plan.Deletes))
+	}
+	for _, rule := range plan.Deletes {
+		if rule.ID == "8" || rule.ID == "9" || rule.ID == "11" {
+			t.Errorf("rule %s should be retained", rule.ID)
+		}
+	}
+}
+
+func TestPlanOptimizeNoChanges(t *testing.T) {
+	sg := groups.SecGroup{
+		Rules: []rules.SecGroupRule{
+			testRule("1", "in tcp/22 from 10.0.0.0/24"),
+			testRule("2", "in udp/22 from 10.0.1.0/24"),
+			testRule("3", "in ipv6 all"),
+			testRule("4", "in icmp/echo-request from 0.0.0.0/0"),
+		},
+	}
+
+	plan, err := PlanOptimize(sg)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if plan.HasChanges() {
+		t.Errorf("plan should have no changes. %v %v", plan.Creates, plan.Deletes)
+	}
+}
+
+func TestPlanOptimizeAny(t *testing.T) {
+	sg := groups.SecGroup{
+		Rules: []rules.SecGroupRule{
+			// "any" covers others
+			testRule("1", "in tcp"),
+			testRule("2", "in tcp/22 from 10.0.0.0/8"),
+			testRule("3", "in icmp"),
+			testRule("4", "in icmp/echo-request from 10.0.0.0/8"),
+			// managed rules are kept
+			testRule("5", "in tcp/22 from 10.0.0.1/32"),
+		},
+	}
+	sg.Rules[4].Description = "[managed-by=conoha-net expires=2030-01-01T00:00:00Z]"
+
+	plan, err := PlanOptimize(sg)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(plan.Creates) != 0 || len(plan.Deletes) != 2 {
+		t.Fatalf("unexpected plan. %v %v", plan.Creates, plan.Deletes)
+	}
+	for _, rule := range plan.Deletes {
+		if rule.ID != "2" && rule.ID != "4" {
+			t.Errorf("rule %s should be retained", rule.ID)
+		}
+	}
+}
+
+func TestPlanOptimizeLabels(t *testing.T) {
+	sg := groups.SecGroup{
+		Rules: []rules.SecGroupRule{
+			testRule("1", "in tcp/22 from 10.0.0.0/32"),
+			testRule("2", "in tcp/22 from 10.0.0.1/32"),
+			testRule("3", "in tcp/22 from 10.0.0.2/32"),
+			testRule("4", "in tcp/22 from 10.0.0.3/32"),
+		},
+	}
+	sg.Rules[0].Description = "office [owner=ops]"
+	sg.Rules[1].Description = "vpn [owner=ops]"
+	sg.Rules[2].Description = "[owner=payments]"
+
+	plan, err := PlanOptimize(sg)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Only the rules of the same owner are merged, and the label is retained.
+	descriptions := map[string]string{}
+	for _, rule := range plan.After {
+		var r RuleCreateOpts
+		r.FromSecGroupRule(rule)
+		descriptions[r.String()] = rule.Description
+	}
+	expected := map[string]string{
+		"in tcp/22 from 10.0.0.0/31": "[owner=ops]",
+		"in tcp/22 from 10.0.0.2/32": "[owner=payments]",
+		"in tcp/22 from 10.0.0.3/32": "",
+	}
+	if len(descriptions) != len(expected) {
+		t.Fatalf("rules should be %v, but %v", expected, descriptions)
+	}
+	for expr, desc := range expected {
+		if d, ok := descriptions[expr]; !ok || d != desc {
+			t.Errorf("%s should have %q, but %q", expr, desc, d)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package conoha
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/secgroups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+	"github.com/sirupsen/logrus"
+)
+
+// Kinds of the policy statements.
+const (
+	POLICY_DENY          = "deny"
+	POLICY_REQUIRE_LABEL = "require-label"
+	POLICY_REQUIRE_GROUP = "require-group"
+)
+
+// Organization policy that is enforced before changing security groups.
+//
+// A policy file has one statement per line. The text after "#" is the reason shown on violation.
+//
+//	# Block the rules that allow the traffic of the rule expression from all of the remote
+//	deny in both tcp/22 from any   # SSH must go through the bastion
+//
+//	# Every custom group must have the label
+//	require-label owner
+//
+//	# VPS whose name tag matches the pattern must have the group
+//	require-group base on prod-*
+type Policy struct {
+	Statements []PolicyStatement
+}
+
+// A statement of the policy.
+type PolicyStatement struct {
+	Line   int
+	Text   string
+	Kind   string
+	Reason string
+
+	// deny
+	Denied []rules.SecGroupRule
+
+	// require-label
+	Label string
+
+	// require-group
+	Group      string
+	VpsPattern string
+}
+
+// A violation of the policy statement.
+type PolicyViolation struct {
+	Statement PolicyStatement
+	Message   string
+}
+
+func (v PolicyViolation) String() string {
+	s := fmt.Sprintf("line %d: %s: %s", v.Statement.Line, v.Statement.Text, v.Message)
+	if v.Statement.Reason != "" {
+		s += fmt.Sprintf(" (%s)", v.Statement.Reason)
+	}
+	return s
+}
+
+// Error of the change blocked by the policy.
+type PolicyError struct {
+	Violations []PolicyViolation
+}
+
+func (e *PolicyError) Error() string {
+	var buf bytes.Buffer
+	buf.WriteString("The change is blocked by the policy.")
+	for _, v := range e.Violations {
+		buf.WriteString("\n  ")
+		buf.WriteString(v.String())
+	}
+	return buf.String()
+}
+
+// Load the policy from the file.
+func LoadPolicy(file string) (*Policy, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(string(b))
+}
+
+// Parse the policy.
+func ParsePolicy(text string) (*Policy, error) {
+	p := &Policy{
+		Statements: []PolicyStatement{},
+	}
+
+	for i, line := range strings.Split(text, "\n") {
+		s := PolicyStatement{Line: i + 1}
+		if c := strings.Index(line, "#"); c >= 0 {
+			s.Reason = strings.TrimSpace(line[c+1:])
+			line = line[:c]
+		}
+		s.Text = strings.Join(strings.Fields(line), " ")
+		if s.Text == "" {
+			continue
+		}
+
+		fields := strings.Fields(s.Text)
+		s.Kind = strings.ToLower(fields[0])
+		args := fields[1:]
+
+		switch s.Kind {
+		case POLICY_DENY:
+			r, err := ParseRule(strings.Join(args, " "))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid policy. [line %d: %s]", s.Line, err)
+			}
+			r.SecurityGroupName = "policy"
+
+			expanded, err := r.Expand()
+			if err != nil {
+				return nil, fmt.Errorf("Invalid policy. [line %d: %s]", s.Line, err)
+			}
+			for _, e := range expanded {
+				_, opts, err := e.ToCreateOpts()
+				if err != nil {
+					return nil, fmt.Errorf("Invalid policy. [line %d: %s]", s.Line, err)
+				} else if opts.RemoteGroupID != "" {
+					return nil, fmt.Errorf("Invalid policy. Remote group can't be used in deny. [line %d]", s.Line)
+				}
+				s.Denied = append(s.Denied, ruleFromCreateOpts(opts))
+			}
+
+		case POLICY_REQUIRE_LABEL:
+			if len(args) != 1 || !labelKeyRegexp.MatchString(args[0]) {
+				return nil, fmt.Errorf(`Invalid policy. Must be "require-label <key>". [line %d]`, s.Line)
+			}
+			s.Label = args[0]
+
+		case POLICY_REQUIRE_GROUP:
+			if len(args) != 3 || strings.ToLower(args[1]) != "on" {
+				return nil, fmt.Errorf(`Invalid policy. Must be "require-group <group> on <vps-name-tag-pattern>". [line %d]`, s.Line)
+			} else if _, err := path.Match(args[2], ""); err != nil {
+				return nil, fmt.Errorf("Invalid policy. Bad pattern. [line %d: %s]", s.Line, args[2])
+			}
+			s.Group = args[0]
+			s.VpsPattern = args[2]
+
+		default:
+			return nil, fmt.Errorf("Invalid policy. Unknown statement. [line %d: %s]", s.Line, fields[0])
+		}
+
+		p.Statements = append(p.Statements, s)
+	}
+	return p, nil
+}
+
+// Check the group that has the description (labels).
+func (p *Policy) checkLabels(groupName string, description string) []PolicyViolation {
+	violations := make([]PolicyViolation, 0)
+	if IsSystemGroup(groupName) {
+		return violations
+	}
+
+	labels := ParseAnnotation(description).Labels
+	for _, s := range p.Statements {
+		if s.Kind != POLICY_REQUIRE_LABEL {
+			continue
+		}
+		if _, ok := labels[s.Label]; !ok {
+			violations = append(violations, PolicyViolation{
+				Statement: s,
+				Message:   fmt.Sprintf("The group %s has no %s label.", groupName, s.Label),
+			})
+		}
+	}
+	return violations
+}
+
+// Check the group to be created.
+func (p *Policy) CheckGroup(name string, description string) []PolicyViolation {
+	return p.checkLabels(name, description)
+}
+
+// Check the rule to be created in the group.
+func (p *Policy) CheckRule(sg groups.SecGroup, rule rules.SecGroupRule) []PolicyViolation {
+	return append(p.checkLabels(sg.Name, sg.Description), p.checkDeny(sg.Name, rule)...)
+}
+
+// Check whether the rule allows the denied traffic.
+func (p *Policy) checkDeny(groupName string, rule rules.SecGroupRule) []PolicyViolation {
+	violations := make([]PolicyViolation, 0)
+
+	var expr RuleCreateOpts
+	expr.FromSecGroupRule(rule)
+	for _, s := range p.Statements {
+		if s.Kind != POLICY_DENY {
+			continue
+		}
+		for _, denied := range s.Denied {
+			if ruleDenied(rule, denied) {
+				violations = append(violations, PolicyViolation{
+					Statement: s,
+					Message:   fmt.Sprintf(`The rule "%s" in the group %s allows the denied traffic.`, expr.String(), groupName),
+				})
+				break
+			}
+		}
+	}
+	return violations
+}
+
+// Return whether the rule allows the denied traffic.
+// The protocols and the ports are denied if they overlap, and the remote is denied if the rule
+// allows all of the denied remote, so that the rules narrowing the source (e.g. from the bastion) are permitted.
+func ruleDenied(rule rules.SecGroupRule, denied rules.SecGroupRule) bool {
+	if rule.Direction != denied.Direction || rule.EtherType != denied.EtherType {
+		return false
+	}
+
+	// Protocol and ports
+	pa, pb := ProtocolName(rule.Protocol), ProtocolName(denied.Protocol)
+	if pa != "all" && pb != "all" {
+		if pa != pb {
+			return false
+		}
+
+		if isICMP(pa) {
+			// Type 0 means any type, and code 0 means any code.
+			anyA := rule.PortRangeMin == 0 && rule.PortRangeMax == 0
+			anyB := denied.PortRangeMin == 0 && denied.PortRangeMax == 0
+			if !anyA && !anyB {
+				if rule.PortRangeMin != denied.PortRangeMin {
+					return false
+				} else if rule.PortRangeMax != 0 && denied.PortRangeMax != 0 && rule.PortRangeMax != denied.PortRangeMax {
+					return false
+				}
+			}
+		} else if hasPorts(pa) {
+			ia := &optimizeItem{min: rule.PortRangeMin, max: rule.PortRangeMax}
+			ib := &optimizeItem{min: denied.PortRangeMin, max: denied.PortRangeMax}
+			for _, i := range []*optimizeItem{ia, ib} {
+				if i.min == 0 && i.max == 0 {
+					i.min, i.max = 1, 65535
+				}
+			}
+			if ia.max < ib.min || ib.max < ia.min {
+				return false
+			}
+		}
+	}
+
+	// Remote. The rule with a remote group is not compared with the prefix, since its members are unknown.
+	if denied.RemoteGroupID != "" || rule.RemoteGroupID != "" {
+		return rule.RemoteGroupID == denied.RemoteGroupID
+	}
+
+	prefix, deniedPrefix := rule.RemoteIPPrefix, denied.RemoteIPPrefix
+	if prefix == "" {
+		prefix = anyAddress(rule.EtherType)
+	}
+	if deniedPrefix == "" {
+		deniedPrefix = anyAddress(denied.EtherType)
+	}
+	allowed, err := NewCIDRSet(prefix)
+	if err != nil {
+		return false
+	}
+	remote, err := NewCIDRSet(deniedPrefix)
+	if err != nil {
+		return false
+	}
+	return allowed.ContainsSet(remote)
+}
+
+// Check the group to be attached to VPS.
+func (p *Policy) CheckAttach(vps *Vps, sg groups.SecGroup) []PolicyViolation {
+	violations := p.checkLabels(sg.Name, sg.Description)
+
+	// The rules of the group are also checked, since they are applied to VPS.
+	for _, rule := range sg.Rules {
+		for _, v := range p.checkDeny(sg.Name, rule) {
+			v.Message = fmt.Sprintf("%s It can't be attached to %s.", v.Message, vps.NameTag)
+			violations = append(violations, v)
+		}
+	}
+	return violations
+}
+
+// Check the group to be detached from VPS.
+func (p *Policy) CheckDetach(vps *Vps, groupName string) []PolicyViolation {
+	violations := make([]PolicyViolation, 0)
+	for _, s := range p.Statements {
+		if s.Kind != POLICY_REQUIRE_GROUP || s.Group != groupName {
+			continue
+		}
+		if matched, _ := path.Match(s.VpsPattern, vps.NameTag); matched {
+			violations = append(violations, PolicyViolation{
+				Statement: s,
+				Message:   fmt.Sprintf("The group %s is required on %s.", groupName, vps.NameTag),
+			})
+		}
+	}
+	return violations
+}
+
+// Check the current groups and VPS against the whole policy.
+func (p *Policy) CheckState(sgs []groups.SecGroup, vpss []Vps) []PolicyViolation {
+	violations := make([]PolicyViolation, 0)
+	for _, sg := range sgs {
+		if IsSystemGroup(sg.Name) {
+			continue
+		}
+		violations = append(violations, p.checkLabels(sg.Name, sg.Description)...)
+		for _, rule := range sg.Rules {
+			violations = append(violations, p.checkDeny(sg.Name, rule)...)
+		}
+	}
+
+	for _, s := range p.Statements {
+		if s.Kind != POLICY_REQUIRE_GROUP {
+			continue
+		}
+		for _, vps := range vpss {
+			if matched, _ := path.Match(s.VpsPattern, vps.NameTag); !matched {
+				continue
+			}
+
+			found := false
+			for _, sg := range vps.SecurityGroups {
+				if sg.Name == s.Group {
+					found = true
+					break
+				}
+			}
+			if !found {
+				violations = append(violations, PolicyViolation{
+					Statement: s,
+					Message:   fmt.Sprintf("The group %s is required on %s, but not attached.", s.Group, vps.NameTag),
+				})
+			}
+		}
+	}
+	return violations
+}
+
+// Return the violations in the state after the change that are not in the state before.
+func (p *Policy) checkChange(before []groups.SecGroup, after []groups.SecGroup, vpssBefore []Vps, vpssAfter []Vps) []PolicyViolation {
+	existing := map[string]bool{}
+	for _, v := range p.CheckState(before, vpssBefore) {
+		existing[v.String()] = true
+	}
+
+	violations := make([]PolicyViolation, 0)
+	for _, v := range p.CheckState(after, vpssAfter) {
+		if !existing[v.String()] {
+			violations = append(violations, v)
+		}
+	}
+	return violations
+}
+
+// Check the group to be deleted. The group required by require-group can't be deleted,
+// and the state after the deletion is checked.
+func (p *Policy) CheckDeleteGroup(sgs []groups.SecGroup, vpss []Vps, name string) []PolicyViolation {
+	violations := make([]PolicyViolation, 0)
+	for _, s := range p.Statements {
+		if s.Kind == POLICY_REQUIRE_GROUP && s.Group == name {
+			violations = append(violations, PolicyViolation{
+				Statement: s,
+				Message:   fmt.Sprintf("The group %s is required on %s, so it can't be deleted.", name, s.VpsPattern),
+			})
+		}
+	}
+
+	after := make([]groups.SecGroup, 0, len(sgs))
+	for _, sg := range sgs {
+		if sg.Name != name {
+			after = append(after, sg)
+		}
+	}
+	vpssAfter := make([]Vps, 0, len(vpss))
+	for _, vps := range vpss {
+		attached := make([]secgroups.SecurityGroup, 0, len(vps.SecurityGroups))
+		for _, sg := range vps.SecurityGroups {
+			if sg.Name != name {
+				attached = append(attached, sg)
+			}
+		}
+		vps.SecurityGroups = attached
+		vpssAfter = append(vpssAfter, vps)
+	}
+
+	return append(violations, p.checkChange(sgs, after, vpss, vpssAfter)...)
+}
+
+// Return an error if there are the violations, unless the policy is overridden.
+// The overridden violations are logged with the reason.
+func (os *OpenStack) enforcePolicy(violations []PolicyViolation) error {
+	if len(violations) == 0 {
+		return nil
+	}
+
+	if os.PolicyOverride != "" {
+		for _, v := range violations {
+			logrus.WithField("reason", os.PolicyOverride).Warnf("Policy overridden: %s", v)
+		}
+		return nil
+	}
+	return &PolicyError{Violations: violations}
+}
@@ -0,0 +1,219 @@
+package conoha
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/secgroups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+	"github.com/sirupsen/logrus"
+)
+
+const testPolicy = `
+# guardrails
+deny in both tcp/22 from any   # SSH must go through the bastion
+deny in tcp/3306 from 0.0.0.0/0
+
+require-label owner
+require-group base on prod-*
+`
+
+func TestParsePolicy(t *testing.T) {
+	p, err := ParsePolicy(testPolicy)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if len(p.Statements) != 4 {
+		t.Fatalf("4 statements should be parsed, but %d", len(p.Statements))
+	}
+
+	s := p.Statements[0]
+	if s.Kind != POLICY_DENY || s.Line != 3 || s.Reason != "SSH must go through the bastion" || len(s.Denied) != 2 {
+		t.Errorf("unexpected statement. %v", s)
+	}
+	if p.Statements[2].Label != "owner" {
+		t.Errorf("label should be owner. %v", p.Statements[2])
+	}
+	if p.Statements[3].Group != "base" || p.Statements[3].VpsPattern != "prod-*" {
+		t.Errorf("unexpected statement. %v", p.Statements[3])
+	}
+
+	invalid := []string{
+		"allow in tcp/22",
+		"deny in tcp/99999",
+		"deny in tcp/22 from group:web",
+		"require-label",
+		"require-label bad=key",
+		"require-group base",
+		"require-group base at prod-*",
+		"require-group base on [",
+	}
+	for _, text := range invalid {
+		if _, err = ParsePolicy(text); err == nil {
+			t.Errorf("%q should be an error", text)
+		}
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	p, err := ParsePolicy(testPolicy)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	owned := groups.SecGroup{Name: "web", Description: "[owner=payments]"}
+	unowned := groups.SecGroup{Name: "web"}
+
+	tests := []struct {
+		sg         groups.SecGroup
+		rule       string
+		violations int
+	}{
+		{owned, "in tcp/22 from 10.0.0.0/8", 0},
+		{owned, "in tcp/22 from 0.0.0.0/0", 1},
+		{owned, "in tcp/22 from 203.0.113.5/32", 0},
+		{owned, "in tcp/22 from 0.0.0.0/1", 0},
+		{owned, "in tcp/20-23", 1},
+		{owned, "in tcp/3306 from 192.168.0.0/16", 0},
+		{owned, "in udp/22", 0},
+		{owned, "out tcp/22", 0},
+		{owned, "in tcp/22 from group:web", 0},
+		{owned, "in tcp/22 from ::/0", 1},
+		{owned, "in tcp/1-1000", 1},
+		{owned, "in all", 2},
+		{owned, "in tcp/3306 from ::/0", 0},
+		{unowned, "in tcp/80", 1},
+		{unowned, "in tcp/1-1024", 2},
+		{unowned, "in tcp/22", 2},
+		{groups.SecGroup{Name: "gncs-ipv4-web"}, "in tcp/80", 0},
+	}
+	for _, test := range tests {
+		v := p.CheckRule(test.sg, testRule("1", test.rule))
+		if len(v) != test.violations {
+			t.Errorf("%s in %s should have %d violations, but %v", test.rule, test.sg.Name, test.violations, v)
+		}
+	}
+
+	// The ports narrower than the denied ports are denied, but the narrower sources are not.
+	narrow, err := ParsePolicy("deny in tcp/1-1024 from any")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, rule := range []string{"in tcp/22", "in tcp/1000-2000"} {
+		if v := narrow.CheckRule(owned, testRule("1", rule)); len(v) != 1 {
+			t.Errorf("%s should be denied. %v", rule, v)
+		}
+	}
+	for _, rule := range []string{"in tcp/8080", "in tcp/22 from 0.0.0.0/1", "in tcp/1000-2000 from 203.0.113.1/32"} {
+		if v := narrow.CheckRule(owned, testRule("1", rule)); len(v) != 0 {
+			t.Errorf("%s should not be denied. %v", rule, v)
+		}
+	}
+
+	if v := p.CheckGroup("web", ""); len(v) != 1 {
+		t.Errorf("group without owner should be a violation. %v", v)
+	}
+	if v := p.CheckGroup("web", "[owner=payments]"); len(v) != 0 {
+		t.Errorf("group with owner should not be a violation. %v", v)
+	}
+
+	vps := &Vps{NameTag: "prod-web1"}
+	ssh := groups.SecGroup{
+		Name:        "ssh",
+		Description: "[owner=ops]",
+		Rules:       []rules.SecGroupRule{testRule("1", "in tcp/22")},
+	}
+	if v := p.CheckAttach(vps, ssh); len(v) != 1 || !strings.Contains(v[0].Message, "prod-web1") {
+		t.Errorf("attaching the group that allows SSH from any should be a violation. %v", v)
+	}
+
+	if v := p.CheckDetach(vps, "base"); len(v) != 1 {
+		t.Errorf("detaching the required group should be a violation. %v", v)
+	}
+	if v := p.CheckDetach(&Vps{NameTag: "dev-web1"}, "base"); len(v) != 0 {
+		t.Errorf("the group is not required on dev. %v", v)
+	}
+}
+
+func TestPolicyCheckState(t *testing.T) {
+	p, err := ParsePolicy(testPolicy)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	sgs := []groups.SecGroup{
+		{Name: "base", Description: "[owner=ops]", Rules: []rules.SecGroupRule{testRule("1", "in tcp/22 from 10.0.0.0/8")}},
+		{Name: "web", Rules: []rules.SecGroupRule{testRule("2", "in tcp/22")}},
+		{Name: "default", Rules: []rules.SecGroupRule{testRule("3", "in all")}},
+	}
+	vpss := []Vps{
+		{NameTag: "prod-web1", SecurityGroups: []secgroups.SecurityGroup{{Name: "web"}}},
+		{NameTag: "prod-web2", SecurityGroups: []secgroups.SecurityGroup{{Name: "base"}, {Name: "web"}}},
+		{NameTag: "dev-web1", SecurityGroups: []secgroups.SecurityGroup{{Name: "web"}}},
+	}
+
+	// no owner of web, SSH from any in web, base is not attached to prod-web1
+	v := p.CheckState(sgs, vpss)
+	if len(v) != 3 || !strings.Contains(v[2].Message, "prod-web1") {
+		t.Errorf("3 violations should be found. %v", v)
+	}
+}
+
+func TestEnforcePolicy(t *testing.T) {
+	p, err := ParsePolicy(testPolicy)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	v := p.CheckGroup("web", "")
+
+	os := &OpenStack{Policy: p}
+	err = os.enforcePolicy(v)
+	if _, ok := err.(*PolicyError); !ok {
+		t.Fatalf("PolicyError should be returned. %v", err)
+	}
+	if !strings.Contains(err.Error(), "line 6: require-label owner: The group web has no owner label.") {
+		t.Errorf("unexpected message. %s", err)
+	}
+
+	// Override
+	var buf bytes.Buffer
+	out := logrus.StandardLogger().Out
+	logrus.SetOutput(&buf)
+	defer logrus.SetOutput(out)
+
+	os.PolicyOverride = "incident INC-1"
+	if err = os.enforcePolicy(v); err != nil {
+		t.Errorf("overridden violation should not be an error. %v", err)
+	}
+	if !strings.Contains(buf.String(), "Policy overridden") || !strings.Contains(buf.String(), "INC-1") {
+		t.Errorf("override should be logged. %s", buf.String())
+	}
+}
+
+func TestPolicyCheckDelete(t *testing.T) {
+	p, err := ParsePolicy(testPolicy)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	base := groups.SecGroup{Name: "base", Description: "[owner=ops]", Rules: []rules.SecGroupRule{testRule("1", "in tcp/443")}}
+	web := groups.SecGroup{Name: "web", Description: "[owner=web]", Rules: []rules.SecGroupRule{testRule("2", "in tcp/80"), testRule("3", "in tcp/22")}}
+	sgs := []groups.SecGroup{base, web}
+	vpss := []Vps{
+		{NameTag: "prod-web1", SecurityGroups: []secgroups.SecurityGroup{{Name: "base"}, {Name: "web"}}},
+	}
+
+	// base is required on prod-*
+	v := p.CheckDeleteGroup(sgs, vpss, "base")
+	if len(v) != 2 || !strings.Contains(v[0].Message, "can't be deleted") || !strings.Contains(v[1].Message, "prod-web1") {
+		t.Errorf("deleting the required group should be a violation. %v", v)
+	}
+
+	// The existing violation (SSH from any in web) is not blamed on the deletion.
+	if v = p.CheckDeleteGroup(sgs, vpss, "web"); len(v) != 0 {
+		t.Errorf("deleting web should not be a violation. %v", v)
+	}
+}
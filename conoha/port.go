@@ -0,0 +1,267 @@
+package conoha
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+)
+
+// Return the port of VPS.
+// If portID is empty, the port that connect to global network will be returned.
+func GetPort(os *OpenStack, vps *Vps, portID string) (*ports.Port, error) {
+	if portID == "" {
+		portID = vps.ExternalPort.PortId
+		if portID == "" {
+			return nil, fmt.Errorf("Can't detect the external port of VPS. Please specify the port ID. [%s]", vps.NameTag)
+		}
+
+	} else {
+		found := false
+		for _, p := range vps.Ports {
+			if p.PortId == portID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("The port is not attached to VPS. [%s]", portID)
+		}
+	}
+
+	return ports.Get(os.Network, portID).Extract()
+}
+
+// List all ports of the tenant.
+func ListPorts(os *OpenStack) ([]ports.Port, error) {
+	pager := ports.List(os.Network, ports.ListOpts{})
+	if pager.Err != nil {
+		return nil, pager.Err
+	}
+
+	page, err := pager.AllPages()
+	if err != nil {
+		return nil, err
+	}
+	return ports.ExtractPorts(page)
+}
+
+// Update the port and convert the error message of API to readable one.
+func updatePort(os *OpenStack, portID string, opts ports.UpdateOpts) (*ports.Port, error) {
+	port, err := ports.Update(os.Network, portID, opts).Extract()
+	if err != nil {
+		ed, ok := err.(gophercloud.ErrDefault400)
+		if ok {
+			err = errors.New(string(ed.Body))
+		}
+		return nil, err
+	}
+	return port, nil
+}
+
+// Convert IP addresses to the fixed_ips parameter of port.
+// Subnet ID is omitted, then Neutron will choose it from the address.
+func toFixedIPs(ips []string) (fixedIPs []map[string]string, err error) {
+	fixedIPs = make([]map[string]string, 0, len(ips))
+	for _, ip := range ips {
+		ip = strings.TrimSpace(ip)
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("Invalid IP address. [%s]", ip)
+		}
+		fixedIPs = append(fixedIPs, map[string]string{"ip_address": ip})
+	}
+	return fixedIPs, nil
+}
+
+// Parse an IP address or CIDR of allowed address pair, and return normalized one.
+func parsePairAddress(address string) (string, error) {
+	address = strings.TrimSpace(address)
+	if strings.Contains(address, "/") {
+		ip, ipnet, err := net.ParseCIDR(address)
+		if err != nil {
+			return "", fmt.Errorf("Invalid CIDR. [%s]", address)
+		}
+		ones, _ := ipnet.Mask.Size()
+		return fmt.Sprintf("%s/%d", ip.String(), ones), nil
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return "", fmt.Errorf("Invalid IP address. [%s]", address)
+	}
+	return ip.String(), nil
+}
+
+// Parse a MAC address of allowed address pair. Empty string is allowed.
+func parsePairMAC(mac string) (string, error) {
+	if mac == "" {
+		return "", nil
+	}
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", fmt.Errorf("Invalid MAC address. [%s]", mac)
+	}
+	return hw.String(), nil
+}
+
+// Return whether two addresses of allowed address pair are the same.
+func samePairAddress(a, b string) bool {
+	na, err := parsePairAddress(a)
+	if err != nil {
+		return a == b
+	}
+	nb, err := parsePairAddress(b)
+	if err != nil {
+		return a == b
+	}
+	return na == nb
+}
+
+// List the allowed address pairs of the port.
+func ListAddressPairs(os *OpenStack, vps *Vps, portID string) ([]ports.AddressPair, error) {
+	port, err := GetPort(os, vps, portID)
+	if err != nil {
+		return nil, err
+	}
+	return port.AllowedAddressPairs, nil
+}
+
+// Add an allowed address pair to the port and return the pairs after updating.
+// Existing pairs are retained. macAddress may be empty.
+func AddAddressPair(os *OpenStack, vps *Vps, portID string, ipAddress string, macAddress string) ([]ports.AddressPair, error) {
+	ipAddress, err := parsePairAddress(ipAddress)
+	if err != nil {
+		return nil, err
+	}
+	macAddress, err = parsePairMAC(macAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := GetPort(os, vps, portID)
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := make([]ports.AddressPair, 0, len(port.AllowedAddressPairs)+1)
+	for _, p := range port.AllowedAddressPairs {
+		if samePairAddress(p.IPAddress, ipAddress) && (macAddress == "" || strings.EqualFold(p.MACAddress, macAddress)) {
+			return nil, fmt.Errorf("The allowed address pair already exists. [%s]", ipAddress)
+		}
+		pairs = append(pairs, p)
+	}
+	pairs = append(pairs, ports.AddressPair{
+		IPAddress:  ipAddress,
+		MACAddress: macAddress,
+	})
+
+	updated, err := updatePort(os, port.ID, ports.UpdateOpts{AllowedAddressPairs: &pairs})
+	if err != nil {
+		return nil, err
+	}
+	return updated.AllowedAddressPairs, nil
+}
+
+// Remove an allowed address pair from the port and return the pairs after updating.
+// If macAddress is empty, the pairs that have ipAddress are removed regardless of MAC address.
+func RemoveAddressPair(os *OpenStack, vps *Vps, portID string, ipAddress string, macAddress string) ([]ports.AddressPair, error) {
+	ipAddress, err := parsePairAddress(ipAddress)
+	if err != nil {
+		return nil, err
+	}
+	macAddress, err = parsePairMAC(macAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := GetPort(os, vps, portID)
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := make([]ports.AddressPair, 0, len(port.AllowedAddressPairs))
+	for _, p := range port.AllowedAddressPairs {
+		if samePairAddress(p.IPAddress, ipAddress) && (macAddress == "" || strings.EqualFold(p.MACAddress, macAddress)) {
+			continue
+		}
+		pairs = append(pairs, p)
+	}
+	if len(pairs) == len(port.AllowedAddressPairs) {
+		return nil, fmt.Errorf("The allowed address pair not found. [%s]", ipAddress)
+	}
+
+	updated, err := updatePort(os, port.ID, ports.UpdateOpts{AllowedAddressPairs: &pairs})
+	if err != nil {
+		return nil, err
+	}
+	return updated.AllowedAddressPairs, nil
+}
+
+// Add a fixed IP address to the port and return the fixed IPs after updating.
+// Existing addresses are retained. subnetID may be empty.
+func AddFixedIP(os *OpenStack, vps *Vps, portID string, ipAddress string, subnetID string) ([]ports.IP, error) {
+	ip := net.ParseIP(strings.TrimSpace(ipAddress))
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid IP address. [%s]", ipAddress)
+	}
+
+	port, err := GetPort(os, vps, portID)
+	if err != nil {
+		return nil, err
+	}
+
+	fixedIPs := make([]map[string]string, 0, len(port.FixedIPs)+1)
+	for _, fip := range port.FixedIPs {
+		if net.ParseIP(fip.IPAddress).Equal(ip) {
+			return nil, fmt.Errorf("The fixed IP already exists. [%s]", ip)
+		}
+		fixedIPs = append(fixedIPs, map[string]string{"subnet_id": fip.SubnetID, "ip_address": fip.IPAddress})
+	}
+
+	added := map[string]string{"ip_address": ip.String()}
+	if subnetID != "" {
+		added["subnet_id"] = subnetID
+	}
+	fixedIPs = append(fixedIPs, added)
+
+	updated, err := updatePort(os, port.ID, ports.UpdateOpts{FixedIPs: fixedIPs})
+	if err != nil {
+		return nil, err
+	}
+	return updated.FixedIPs, nil
+}
+
+// Remove a fixed IP address from the port and return the fixed IPs after updating.
+func RemoveFixedIP(os *OpenStack, vps *Vps, portID string, ipAddress string) ([]ports.IP, error) {
+	ip := net.ParseIP(strings.TrimSpace(ipAddress))
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid IP address. [%s]", ipAddress)
+	}
+
+	port, err := GetPort(os, vps, portID)
+	if err != nil {
+		return nil, err
+	}
+
+	fixedIPs := make([]map[string]string, 0, len(port.FixedIPs))
+	for _, fip := range port.FixedIPs {
+		if net.ParseIP(fip.IPAddress).Equal(ip) {
+			continue
+		}
+		fixedIPs = append(fixedIPs, map[string]string{"subnet_id": fip.SubnetID, "ip_address": fip.IPAddress})
+	}
+	if len(fixedIPs) == len(port.FixedIPs) {
+		return nil, fmt.Errorf("The fixed IP not found. [%s]", ip)
+	} else if len(fixedIPs) == 0 {
+		return nil, fmt.Errorf("Can't remove the last fixed IP of the port. [%s]", ip)
+	}
+
+	updated, err := updatePort(os, port.ID, ports.UpdateOpts{FixedIPs: fixedIPs})
+	if err != nil {
+		return nil, err
+	}
+	return updated.FixedIPs, nil
+}
@@ -0,0 +1,51 @@
+package conoha
+
+import "testing"
+
+func TestParsePairAddress(t *testing.T) {
+	datasets := map[string]string{
+		"192.168.0.10":     "192.168.0.10",
+		" 10.0.0.1 ":       "10.0.0.1",
+		"192.168.0.10/32":  "192.168.0.10/32",
+		"2001:DB8::1":      "2001:db8::1",
+		"2001:db8::1/128":  "2001:db8::1/128",
+		"192.168.0.0/24":   "192.168.0.0/24",
+		"not-an-address":   "",
+		"192.168.0.0/33":   "",
+		"2001:db8::1/129":  "",
+		"192.168.0.256/24": "",
+	}
+
+	for input, expected := range datasets {
+		address, err := parsePairAddress(input)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("%s should be invalid", input)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Error(err)
+		} else if address != expected {
+			t.Errorf("%s should be normalized to %s, but %s", input, expected, address)
+		}
+	}
+}
+
+func TestToFixedIPs(t *testing.T) {
+	fixedIPs, err := toFixedIPs([]string{"192.168.0.10", " 2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixedIPs) != 2 || fixedIPs[1]["ip_address"] != "2001:db8::1" {
+		t.Errorf("unexpected fixed IPs. %v", fixedIPs)
+	}
+	if _, ok := fixedIPs[0]["subnet_id"]; ok {
+		t.Errorf("subnet_id should be omitted")
+	}
+
+	if _, err = toFixedIPs([]string{"192.168.0"}); err == nil {
+		t.Errorf("invalid address should be rejected")
+	}
+}
@@ -0,0 +1,221 @@
+package conoha
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// IP protocol numbers assigned by IANA.
+// The protocols other than tcp, udp, icmp and icmpv6 are sent to API as numbers,
+// since old Neutron doesn't know their names.
+var protocolNumbers = map[string]int{
+	"icmp":       1,
+	"igmp":       2,
+	"ipip":       4,
+	"tcp":        6,
+	"egp":        8,
+	"udp":        17,
+	"dccp":       33,
+	"ipv6-encap": 41,
+	"ipv6-route": 43,
+	"ipv6-frag":  44,
+	"rsvp":       46,
+	"gre":        47,
+	"esp":        50,
+	"ah":         51,
+	"icmpv6":     58,
+	"ipv6-nonxt": 59,
+	"ipv6-opts":  60,
+	"ospf":       89,
+	"pim":        103,
+	"vrrp":       112,
+	"pgm":        113,
+	"l2tp":       115,
+	"sctp":       132,
+	"udplite":    136,
+}
+
+// Aliases of protocol names.
+var protocolAliases = map[string]string{
+	"ipv6-icmp": "icmpv6",
+	"icmp6":     "icmpv6",
+	"ospfigp":   "ospf",
+}
+
+// Protocols that have port numbers.
+var portProtocols = map[string]bool{
+	"tcp":     true,
+	"udp":     true,
+	"dccp":    true,
+	"sctp":    true,
+	"udplite": true,
+}
+
+// Named ICMP types.
+var icmpTypes = map[string]int{
+	"echo-reply":              0,
+	"destination-unreachable": 3,
+	"source-quench":           4,
+	"redirect":                5,
+	"echo-request":            8,
+	"router-advertisement":    9,
+	"router-solicitation":     10,
+	"time-exceeded":           11,
+	"parameter-problem":       12,
+	"timestamp-request":       13,
+	"timestamp-reply":         14,
+}
+
+// Named ICMPv6 types.
+var icmpv6Types = map[string]int{
+	"destination-unreachable": 1,
+	"packet-too-big":          2,
+	"time-exceeded":           3,
+	"parameter-problem":       4,
+	"echo-request":            128,
+	"echo-reply":              129,
+	"mld-query":               130,
+	"mld-report":              131,
+	"mld-done":                132,
+	"router-solicitation":     133,
+	"router-advertisement":    134,
+	"neighbor-solicitation":   135,
+	"neighbor-advertisement":  136,
+	"redirect":                137,
+	"mldv2-report":            143,
+}
+
+// Names that are expanded into multiple ICMPv6 types by Expand().
+var icmpv6TypeGroups = map[string]string{
+	"neighbor-discovery": "router-solicitation,router-advertisement,neighbor-solicitation,neighbor-advertisement",
+}
+
+// Normalize the protocol name or number.
+// It returns the canonical name ("tcp", "icmpv6", "gre", ...) if the protocol is known,
+// or the decimal number otherwise. "all" is returned as empty string.
+func NormalizeProtocol(proto string) (string, error) {
+	proto = strings.ToLower(strings.TrimSpace(proto))
+	if proto == "all" || proto == "any" {
+		return "", nil
+	}
+
+	if alias, ok := protocolAliases[proto]; ok {
+		proto = alias
+	}
+	if _, ok := protocolNumbers[proto]; ok {
+		return proto, nil
+	}
+
+	n, err := strconv.Atoi(proto)
+	if err != nil {
+		return "", ruleFieldError("Protocol", proto, `must be "all", the protocol name or number`)
+	} else if n < 0 || n > 255 {
+		return "", ruleFieldError("Protocol", proto, "protocol number must be between 0 and 255")
+	}
+
+	for name, number := range protocolNumbers {
+		if number == n {
+			return name, nil
+		}
+	}
+	return strconv.Itoa(n), nil
+}
+
+// Return the protocol value sent to API.
+func apiProtocol(normalized string) string {
+	switch normalized {
+	case "", "tcp", "udp", "icmp", "icmpv6":
+		return normalized
+	}
+
+	if n, ok := protocolNumbers[normalized]; ok {
+		return strconv.Itoa(n)
+	}
+	return normalized
+}
+
+// Return the readable name of the protocol returned by API. "all" is returned for empty string.
+func ProtocolName(proto string) string {
+	if proto == "" {
+		return "all"
+	}
+	normalized, err := NormalizeProtocol(proto)
+	if err != nil {
+		return proto
+	}
+	return normalized
+}
+
+// Return whether the protocol is ICMP or ICMPv6.
+func isICMP(normalized string) bool {
+	return normalized == "icmp" || normalized == "icmpv6"
+}
+
+// Return whether the protocol has port numbers.
+func hasPorts(normalized string) bool {
+	return portProtocols[normalized]
+}
+
+// Parse ICMP type and code. (e.g. "echo-request", "8", "3/4", "destination-unreachable/4")
+// Since API omits zero values, type 0 and code 0 can't be specified.
+// If code is omitted, any code is matched and max is returned as 0.
+func parseICMPTypeCode(normalized string, typeCode string) (icmpType int, icmpCode int, err error) {
+	types := icmpTypes
+	if normalized == "icmpv6" {
+		types = icmpv6Types
+	}
+
+	t := typeCode
+	c := ""
+	if p := strings.Index(typeCode, "/"); p >= 0 {
+		t = typeCode[:p]
+		c = typeCode[p+1:]
+	}
+
+	var ok bool
+	if icmpType, ok = types[strings.ToLower(t)]; !ok {
+		icmpType, err = strconv.Atoi(t)
+		if err != nil || icmpType < 0 || icmpType > 255 {
+			return 0, 0, ruleFieldError("PortRange", typeCode, `unknown %s type. must be the type name or number (e.g. "echo-request", "3/4")`, normalized)
+		}
+	}
+	if icmpType == 0 {
+		return 0, 0, ruleFieldError("PortRange", typeCode, "%s type 0 can't be specified, since API treats it as any type", normalized)
+	}
+
+	if c != "" {
+		icmpCode, err = strconv.Atoi(c)
+		if err != nil || icmpCode < 0 || icmpCode > 255 {
+			return 0, 0, ruleFieldError("PortRange", typeCode, "%s code must be between 1 and 255", normalized)
+		} else if icmpCode == 0 {
+			return 0, 0, ruleFieldError("PortRange", typeCode, "%s code 0 can't be specified, since API treats it as any code", normalized)
+		}
+	}
+	return icmpType, icmpCode, nil
+}
+
+// Format ICMP type and code returned by API. (e.g. "echo-request", "3/4")
+func formatICMPTypeCode(normalized string, icmpType int, icmpCode int) string {
+	if icmpType == 0 && icmpCode == 0 {
+		return ""
+	}
+
+	types := icmpTypes
+	if normalized == "icmpv6" {
+		types = icmpv6Types
+	}
+
+	s := strconv.Itoa(icmpType)
+	for name, t := range types {
+		if t == icmpType {
+			s = name
+			break
+		}
+	}
+
+	if icmpCode != 0 {
+		s += fmt.Sprintf("/%d", icmpCode)
+	}
+	return s
+}
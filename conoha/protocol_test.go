@@ -0,0 +1,144 @@
+package conoha
+
+import (
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+)
+
+func TestNormalizeProtocol(t *testing.T) {
+	datasets := map[string]string{
+		"tcp":       "tcp",
+		"TCP":       "tcp",
+		"all":       "",
+		"6":         "tcp",
+		"47":        "gre",
+		"gre":       "gre",
+		"ipv6-icmp": "icmpv6",
+		"58":        "icmpv6",
+		"253":       "253",
+	}
+	for input, expected := range datasets {
+		proto, err := NormalizeProtocol(input)
+		if err != nil {
+			t.Errorf("%s: %v", input, err)
+		} else if proto != expected {
+			t.Errorf(`%s should be normalized to "%s", but "%s"`, input, expected, proto)
+		}
+	}
+
+	for _, input := range []string{"", "256", "-1", "tcp6"} {
+		if _, err := NormalizeProtocol(input); err == nil {
+			t.Errorf("%s should be invalid", input)
+		}
+	}
+
+	if apiProtocol("gre") != "47" || apiProtocol("icmpv6") != "icmpv6" || apiProtocol("tcp") != "tcp" {
+		t.Errorf("unexpected protocol value for API")
+	}
+}
+
+func TestICMPRule(t *testing.T) {
+	r := RuleCreateOpts{
+		SecurityGroupName: "test-name",
+		Direction:         "ingress",
+		EtherType:         "IPv4",
+		Protocol:          "icmp",
+		PortRange:         "echo-request",
+	}
+	_, opts, err := r.ToCreateOpts()
+	if err != nil {
+		t.Fatal(err)
+	} else if opts.PortRangeMin != 8 || opts.PortRangeMax != 0 {
+		t.Errorf("unexpected ICMP type and code. %d/%d", opts.PortRangeMin, opts.PortRangeMax)
+	}
+
+	r.PortRange = "destination-unreachable/4"
+	if _, opts, err = r.ToCreateOpts(); err != nil {
+		t.Fatal(err)
+	} else if opts.PortRangeMin != 3 || opts.PortRangeMax != 4 {
+		t.Errorf("unexpected ICMP type and code. %d/%d", opts.PortRangeMin, opts.PortRangeMax)
+	}
+
+	for _, invalid := range []string{"echo-reply", "8/0", "unknown", "256"} {
+		r.PortRange = invalid
+		if _, _, err = r.ToCreateOpts(); err == nil {
+			t.Errorf("%s should be invalid", invalid)
+		}
+	}
+
+	// ICMP for IPv6
+	r.EtherType = "IPv6"
+	r.PortRange = ""
+	if _, _, err = r.ToCreateOpts(); err == nil {
+		t.Errorf("icmp should be rejected for IPv6")
+	}
+
+	// both
+	r.EtherType = ETHER_TYPE_BOTH
+	r.PortRange = "echo-request"
+	expanded, err := r.Expand()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(expanded) != 2 {
+		t.Fatalf("2 rules should be expanded, but %d", len(expanded))
+	}
+	_, opts, err = expanded[1].ToCreateOpts()
+	if err != nil {
+		t.Fatal(err)
+	} else if opts.Protocol != "icmpv6" || opts.PortRangeMin != 128 {
+		t.Errorf("unexpected ICMPv6 rule. %s %d", opts.Protocol, opts.PortRangeMin)
+	}
+
+	// neighbor discovery
+	r.EtherType = "IPv6"
+	r.Protocol = "icmpv6"
+	r.PortRange = "neighbor-discovery"
+	if expanded, err = r.Expand(); err != nil {
+		t.Fatal(err)
+	} else if len(expanded) != 4 {
+		t.Errorf("4 rules should be expanded, but %d", len(expanded))
+	}
+}
+
+func TestOtherProtocolRule(t *testing.T) {
+	r := RuleCreateOpts{
+		SecurityGroupName: "test-name",
+		Direction:         "ingress",
+		EtherType:         "IPv4",
+		Protocol:          "vrrp",
+	}
+	_, opts, err := r.ToCreateOpts()
+	if err != nil {
+		t.Fatal(err)
+	} else if opts.Protocol != "112" {
+		t.Errorf(`Protocol should be "112", but "%s"`, opts.Protocol)
+	}
+
+	r.PortRange = "80"
+	if _, _, err = r.ToCreateOpts(); err == nil {
+		t.Errorf("port range should be rejected for vrrp")
+	}
+
+	r.Protocol = "sctp"
+	if _, _, err = r.ToCreateOpts(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFormatICMPRule(t *testing.T) {
+	datasets := map[string]rules.SecGroupRule{
+		"in icmp/echo-request":                 {Direction: "ingress", EtherType: "IPv4", Protocol: "icmp", PortRangeMin: 8},
+		"in icmp/destination-unreachable/4":    {Direction: "ingress", EtherType: "IPv4", Protocol: "icmp", PortRangeMin: 3, PortRangeMax: 4},
+		"in ipv6 icmpv6/neighbor-solicitation": {Direction: "ingress", EtherType: "IPv6", Protocol: "icmpv6", PortRangeMin: 135},
+		"in gre":                               {Direction: "ingress", EtherType: "IPv4", Protocol: "47"},
+	}
+
+	for expected, rule := range datasets {
+		var r RuleCreateOpts
+		r.FromSecGroupRule(rule)
+		if r.String() != expected {
+			t.Errorf(`"%s" should be formatted, but "%s"`, expected, r.String())
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package conoha
+
+import (
+	"net"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+)
+
+// An ingress rule that grants the access to the service of VPS.
+type Grant struct {
+	Group groups.SecGroup
+	Rule  rules.SecGroupRule
+
+	// CIDR or the name of the remote group
+	Source string
+
+	// VPS of the remote group
+	Members []Vps
+}
+
+// A service of VPS that an address is permitted to reach.
+type Reach struct {
+	Vps   Vps
+	Port  ports.Port
+	Group groups.SecGroup
+	Rule  rules.SecGroupRule
+
+	// VPS of the remote group that have the address
+	Members []Vps
+}
+
+// Return the source of the rule. (CIDR or the name of the remote group)
+func ruleSource(rule rules.SecGroupRule, sgs []groups.SecGroup) string {
+	if rule.RemoteGroupID != "" {
+		if sg, err := FindGroup(sgs, rule.RemoteGroupID); err == nil {
+			return "group:" + sg.Name
+		}
+		return "group:" + rule.RemoteGroupID
+	} else if rule.RemoteIPPrefix != "" {
+		return rule.RemoteIPPrefix
+	}
+	return anyAddress(rule.EtherType)
+}
+
+// Find the ingress rules that grant the access to the service of VPS, over all ports of VPS.
+// The port is the port number, or the ICMP type and code. (e.g. "443", "echo-request")
+func FindGrants(vps *Vps, protocol string, port string, sgs []groups.SecGroup, ps []ports.Port, vpss []Vps) ([]Grant, error) {
+	// flows of both ether types from any address
+	flows := make([]Flow, 0, 2)
+	for _, remote := range []string{"0.0.0.0", "::"} {
+		flow, err := NewFlow("ingress", protocol, port, remote)
+		if err != nil {
+			return nil, err
+		}
+		flows = append(flows, flow)
+	}
+
+	grants := make([]Grant, 0)
+	seen := map[string]bool{}
+	for _, p := range vpsPorts(ps, vps.ID) {
+		for _, sg := range boundGroups(sgs, p) {
+			for _, rule := range sg.Rules {
+				if seen[rule.ID] {
+					continue
+				}
+
+				for _, flow := range flows {
+					if !flow.matchesRule(rule) {
+						continue
+					}
+					seen[rule.ID] = true
+
+					g := Grant{Group: sg, Rule: rule, Source: ruleSource(rule, sgs)}
+					if rule.RemoteGroupID != "" {
+						if remote, err := FindGroup(sgs, rule.RemoteGroupID); err == nil {
+							for _, v := range vpss {
+								if v.HasGroup(*remote) {
+									g.Members = append(g.Members, v)
+								}
+							}
+						}
+					}
+					grants = append(grants, g)
+					break
+				}
+			}
+		}
+	}
+	return grants, nil
+}
+
+// Find the ingress rules that grant the access to the service of VPS.
+func WhoCanReach(os *OpenStack, vps *Vps, protocol string, port string) ([]Grant, error) {
+	sgs, err := ListGroup(os)
+	if err != nil {
+		return nil, err
+	}
+
+	vpss, err := ListVps(os, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ps, err := ListPorts(os)
+	if err != nil {
+		return nil, err
+	}
+
+	return FindGrants(vps, protocol, port, sgs, ps, vpss)
+}
+
+// Find the services of all VPS that the address is permitted to reach.
+// VPS must have been populated the ports by PopulateVpsPorts to resolve the remote groups.
+func FindReaches(ip net.IP, sgs []groups.SecGroup, ps []ports.Port, vpss []Vps) []Reach {
+	etherType := "IPv6"
+	if ip.To4() != nil {
+		etherType = "IPv4"
+	}
+
+	reaches := make([]Reach, 0)
+	for _, vps := range vpss {
+		for _, p := range vpsPorts(ps, vps.ID) {
+			for _, sg := range boundGroups(sgs, p) {
+				for _, rule := range sg.Rules {
+					if rule.Direction != "ingress" || rule.EtherType != etherType {
+						continue
+					}
+
+					members, ok := matchesRemote(rule, ip, sgs, vpss)
+					if !ok {
+						continue
+					}
+					reaches = append(reaches, Reach{Vps: vps, Port: p, Group: sg, Rule: rule, Members: members})
+				}
+			}
+		}
+	}
+	return reaches
+}
+
+// Find the services of all VPS that the address is permitted to reach.
+func ReachFrom(os *OpenStack, ip net.IP) ([]Reach, error) {
+	sgs, err := ListGroup(os)
+	if err != nil {
+		return nil, err
+	}
+
+	vpss, err := ListVps(os, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ps, err := ListPorts(os)
+	if err != nil {
+		return nil, err
+	}
+	PopulateVpsPorts(vpss, ps)
+
+	return FindReaches(ip, sgs, ps, vpss), nil
+}
@@ -0,0 +1,103 @@
+package conoha
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/secgroups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+)
+
+func reachTestData() ([]groups.SecGroup, []ports.Port, []Vps) {
+	lb := testRule("web-3", "in tcp/443 from group:lb")
+	lb.RemoteGroupID = "lb-id"
+
+	sgs := []groups.SecGroup{
+		{
+			ID:   "web-id",
+			Name: "web",
+			Rules: []rules.SecGroupRule{
+				testRule("web-1", "in tcp/443 from 198.51.100.0/24"),
+				testRule("web-2", "in tcp/1-1024 from 2001:db8::/32"),
+				lb,
+				testRule("web-4", "in tcp/22 from 10.0.0.0/8"),
+				testRule("web-5", "out tcp/443"),
+			},
+		},
+		{
+			ID:    "lb-id",
+			Name:  "lb",
+			Rules: []rules.SecGroupRule{testRule("lb-1", "in tcp/80")},
+		},
+	}
+
+	ps := []ports.Port{
+		{ID: "web1-ext", DeviceID: "web1", SecurityGroups: []string{"web-id"}, FixedIPs: []ports.IP{{IPAddress: "203.0.113.1"}}},
+		{ID: "lb1-ext", DeviceID: "lb1", SecurityGroups: []string{"lb-id"}, FixedIPs: []ports.IP{{IPAddress: "198.51.100.7"}}},
+	}
+
+	vpss := []Vps{
+		{ID: "web1", NameTag: "web1", SecurityGroups: []secgroups.SecurityGroup{{Name: "web"}}},
+		{ID: "lb1", NameTag: "lb1", SecurityGroups: []secgroups.SecurityGroup{{Name: "lb"}}},
+	}
+	PopulateVpsPorts(vpss, ps)
+	return sgs, ps, vpss
+}
+
+func TestFindGrants(t *testing.T) {
+	sgs, ps, vpss := reachTestData()
+
+	grants, err := FindGrants(&vpss[0], "tcp", "443", sgs, ps, vpss)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	expected := []string{"198.51.100.0/24", "2001:db8::/32", "group:lb"}
+	if len(grants) != len(expected) {
+		t.Fatalf("%d grants should be found. %v", len(expected), grants)
+	}
+	for i, g := range grants {
+		if g.Source != expected[i] {
+			t.Errorf("source should be %s, but %s", expected[i], g.Source)
+		}
+	}
+	if len(grants[2].Members) != 1 || grants[2].Members[0].NameTag != "lb1" {
+		t.Errorf("lb1 should be the member of lb. %v", grants[2].Members)
+	}
+
+	if grants, _ = FindGrants(&vpss[0], "udp", "443", sgs, ps, vpss); len(grants) != 0 {
+		t.Errorf("udp should not be granted. %v", grants)
+	}
+	if _, err = FindGrants(&vpss[0], "tcp", "", sgs, ps, vpss); err == nil {
+		t.Errorf("port should be required")
+	}
+}
+
+func TestFindReaches(t *testing.T) {
+	sgs, ps, vpss := reachTestData()
+
+	tests := []struct {
+		ip    string
+		rules []string
+	}{
+		{"198.51.100.7", []string{"web-1", "web-3", "lb-1"}},
+		{"198.51.100.8", []string{"web-1", "lb-1"}},
+		{"2001:db8::1", []string{"web-2"}},
+		{"10.1.1.1", []string{"web-4", "lb-1"}},
+		{"2001:db9::1", []string{}},
+	}
+	for _, test := range tests {
+		reaches := FindReaches(net.ParseIP(test.ip), sgs, ps, vpss)
+		if len(reaches) != len(test.rules) {
+			t.Errorf("%s should reach %v, but %v", test.ip, test.rules, reaches)
+			continue
+		}
+		for i, r := range reaches {
+			if r.Rule.ID != test.rules[i] {
+				t.Errorf("%s should reach by %s, but %s", test.ip, test.rules[i], r.Rule.ID)
+			}
+		}
+	}
+}
@@ -0,0 +1,579 @@
+package conoha
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	goos "os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+)
+
+// Version of the snapshot format.
+const SNAPSHOT_VERSION = 1
+
+var snapshotNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// Security groups, rules and the groups of each port at a point in time.
+type Snapshot struct {
+	Version int               `json:"version"`
+	Name    string            `json:"name"`
+	Created time.Time         `json:"created"`
+	Groups  []groups.SecGroup `json:"groups"`
+	Ports   []SnapshotPort    `json:"ports"`
+}
+
+// Security groups attached to a port.
+type SnapshotPort struct {
+	ID       string `json:"id"`
+	DeviceID string `json:"device_id"`
+
+	// Names of the groups
+	SecurityGroups []string `json:"security_groups"`
+}
+
+// Return the directory to store the local data. ($CONOHA_NET_HOME or ~/.conoha-net)
+func DataDir() (string, error) {
+	if dir := goos.Getenv("CONOHA_NET_HOME"); dir != "" {
+		return dir, nil
+	}
+
+	home, err := goos.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".conoha-net"), nil
+}
+
+// Return the file of the snapshot.
+func snapshotFile(name string) (string, error) {
+	if !snapshotNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("Snapshot name must consist of alphanumerics, '.', '_' and '-'. [%s]", name)
+	}
+
+	dir, err := DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "snapshots", name+".json"), nil
+}
+
+// Create the snapshot from the security groups and ports.
+func NewSnapshot(name string, sgs []groups.SecGroup, ps []ports.Port) *Snapshot {
+	snap := &Snapshot{
+		Version: SNAPSHOT_VERSION,
+		Name:    name,
+		Created: time.Now().UTC(),
+		Groups:  sgs,
+		Ports:   make([]SnapshotPort, 0, len(ps)),
+	}
+
+	for _, p := range ps {
+		if p.DeviceID == "" {
+			continue
+		}
+
+		snap.Ports = append(snap.Ports, SnapshotPort{
+			ID:             p.ID,
+			DeviceID:       p.DeviceID,
+			SecurityGroups: portGroupNames(sgs, p),
+		})
+	}
+	return snap
+}
+
+// Return the sorted names of the groups attached to the port.
+func portGroupNames(sgs []groups.SecGroup, p ports.Port) []string {
+	names := make([]string, 0, len(p.SecurityGroups))
+	for _, id := range p.SecurityGroups {
+		if sg, err := FindGroup(sgs, id); err == nil {
+			names = append(names, sg.Name)
+		} else {
+			names = append(names, id)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Capture the current security groups and the port attachments.
+func TakeSnapshot(os *OpenStack, name string) (*Snapshot, error) {
+	sgs, err := ListGroup(os)
+	if err != nil {
+		return nil, err
+	}
+
+	ps, err := ListPorts(os)
+	if err != nil {
+		return nil, err
+	}
+	return NewSnapshot(name, sgs, ps), nil
+}
+
+// Save the snapshot to the data directory.
+func SaveSnapshot(snap *Snapshot, overwrite bool) (string, error) {
+	if snap.Name == "live" {
+		return "", fmt.Errorf(`"live" is reserved for the current state.`)
+	}
+
+	file, err := snapshotFile(snap.Name)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err = goos.Stat(file); err == nil && !overwrite {
+		return "", fmt.Errorf("The snapshot already exists. [%s]", snap.Name)
+	}
+
+	if err = goos.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return "", err
+	}
+
+	b, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return file, ioutil.WriteFile(file, b, 0600)
+}
+
+// Load the snapshot from the data directory.
+func LoadSnapshot(name string) (*Snapshot, error) {
+	file, err := snapshotFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if goos.IsNotExist(err) {
+		return nil, fmt.Errorf("Snapshot not found. [%s]", name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	snap := &Snapshot{}
+	if err = json.Unmarshal(b, snap); err != nil {
+		return nil, fmt.Errorf("Invalid snapshot. [%s: %s]", name, err)
+	} else if snap.Version < 1 || snap.Version > SNAPSHOT_VERSION {
+		return nil, fmt.Errorf("Unsupported snapshot version. [%s: %d]", name, snap.Version)
+	}
+	return snap, nil
+}
+
+// List the saved snapshots. They are sorted by the creation time.
+func ListSnapshots() ([]*Snapshot, error) {
+	dir, err := DataDir()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "snapshots", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	snaps := make([]*Snapshot, 0, len(files))
+	for _, file := range files {
+		snap, err := LoadSnapshot(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		snaps = append(snaps, snap)
+	}
+
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].Created.Before(snaps[j].Created)
+	})
+	return snaps, nil
+}
+
+// Delete the saved snapshot.
+func DeleteSnapshot(name string) error {
+	file, err := snapshotFile(name)
+	if err != nil {
+		return err
+	}
+
+	if err = goos.Remove(file); goos.IsNotExist(err) {
+		return fmt.Errorf("Snapshot not found. [%s]", name)
+	}
+	return err
+}
+
+// A group to be created by restoring.
+type RestoreGroup struct {
+	groups.SecGroup
+
+	// Whether the change has been applied
+	Applied bool
+}
+
+// A rule to be created or deleted by restoring.
+type RestoreRule struct {
+	Group string
+	Rule  rules.SecGroupRule
+
+	// Name of the remote group
+	RemoteGroup string
+
+	Applied bool
+}
+
+// Port whose groups are changed by restoring.
+type RestorePort struct {
+	ID       string
+	DeviceID string
+	Before   []string
+	After    []string
+
+	Applied bool
+}
+
+// Changes to restore the snapshot.
+type RestorePlan struct {
+	Snapshot     *Snapshot
+	CreateGroups []RestoreGroup
+	CreateRules  []RestoreRule
+	DeleteRules  []RestoreRule
+	UpdatePorts  []RestorePort
+
+	// Ports in the snapshot that no longer exist
+	MissingPorts []SnapshotPort
+}
+
+func (p *RestorePlan) HasChanges() bool {
+	return len(p.CreateGroups) > 0 || len(p.CreateRules) > 0 || len(p.DeleteRules) > 0 || len(p.UpdatePorts) > 0
+}
+
+// Return the name of the remote group of the rule.
+// The ID is returned as is for a dangling reference.
+func remoteGroupName(sgs []groups.SecGroup, rule rules.SecGroupRule) string {
+	if rule.RemoteGroupID == "" {
+		return ""
+	}
+	for _, sg := range sgs {
+		if sg.ID == rule.RemoteGroupID {
+			return sg.Name
+		}
+	}
+	return rule.RemoteGroupID
+}
+
+// Return the key to compare the rules of different tenants or snapshots.
+// The remote group is compared by name instead of UUID.
+func portableRuleKey(sgs []groups.SecGroup, rule rules.SecGroupRule) string {
+	rule.RemoteGroupID = remoteGroupName(sgs, rule)
+	return RuleContentKey(rule)
+}
+
+// Plan the changes to restore the snapshot to the current groups and ports.
+//
+// Groups are matched by name, and rules are matched by content, so that the groups
+// and the rules deleted after the snapshot are recreated with new UUIDs.
+// The descriptions of the rules are not compared, so the rules whose descriptions
+// have been changed are left as they are.
+// The system groups are not created nor changed, but attached to the ports.
+func PlanRestore(snap *Snapshot, sgs []groups.SecGroup, ps []ports.Port) *RestorePlan {
+	plan := &RestorePlan{
+		Snapshot:     snap,
+		CreateGroups: []RestoreGroup{},
+		CreateRules:  []RestoreRule{},
+		DeleteRules:  []RestoreRule{},
+		UpdatePorts:  []RestorePort{},
+		MissingPorts: []SnapshotPort{},
+	}
+
+	for _, saved := range snap.Groups {
+		if IsSystemGroup(saved.Name) {
+			continue
+		}
+
+		current := []rules.SecGroupRule{}
+		var live *groups.SecGroup
+		for i := range sgs {
+			if sgs[i].Name == saved.Name {
+				live = &sgs[i]
+				current = live.Rules
+				break
+			}
+		}
+		if live == nil {
+			plan.CreateGroups = append(plan.CreateGroups, RestoreGroup{SecGroup: saved})
+		}
+
+		existing := map[string]bool{}
+		for _, rule := range current {
+			existing[portableRuleKey(sgs, rule)] = true
+		}
+
+		desired := map[string]bool{}
+		for _, rule := range saved.Rules {
+			key := portableRuleKey(snap.Groups, rule)
+			if desired[key] {
+				continue
+			}
+			desired[key] = true
+
+			if !existing[key] {
+				plan.CreateRules = append(plan.CreateRules, RestoreRule{
+					Group:       saved.Name,
+					Rule:        rule,
+					RemoteGroup: remoteGroupName(snap.Groups, rule),
+				})
+			}
+		}
+
+		// A new group has the default egress rules, which are deleted when applying if not desired.
+		for _, rule := range current {
+			if !desired[portableRuleKey(sgs, rule)] {
+				plan.DeleteRules = append(plan.DeleteRules, RestoreRule{
+					Group:       saved.Name,
+					Rule:        rule,
+					RemoteGroup: remoteGroupName(sgs, rule),
+				})
+			}
+		}
+	}
+
+	live := map[string]ports.Port{}
+	for _, p := range ps {
+		live[p.ID] = p
+	}
+	for _, saved := range snap.Ports {
+		p, ok := live[saved.ID]
+		if !ok {
+			plan.MissingPorts = append(plan.MissingPorts, saved)
+			continue
+		}
+
+		before := portGroupNames(sgs, p)
+		if strings.Join(before, "\n") != strings.Join(saved.SecurityGroups, "\n") {
+			plan.UpdatePorts = append(plan.UpdatePorts, RestorePort{
+				ID:       saved.ID,
+				DeviceID: saved.DeviceID,
+				Before:   before,
+				After:    saved.SecurityGroups,
+			})
+		}
+	}
+	return plan
+}
+
+// Return the options to create the rule of the plan in the groups.
+// The remote group is remapped to the UUID of the group of the same name.
+func restoreRuleOpts(sgs []groups.SecGroup, r RestoreRule) (rules.CreateOpts, error) {
+	sg, err := FindGroup(sgs, r.Group)
+	if err != nil {
+		return rules.CreateOpts{}, err
+	}
+
+	opts := rules.CreateOpts{
+		Direction:      rules.RuleDirection(r.Rule.Direction),
+		Description:    r.Rule.Description,
+		EtherType:      rules.RuleEtherType(r.Rule.EtherType),
+		SecGroupID:     sg.ID,
+		PortRangeMin:   r.Rule.PortRangeMin,
+		PortRangeMax:   r.Rule.PortRangeMax,
+		Protocol:       rules.RuleProtocol(r.Rule.Protocol),
+		RemoteIPPrefix: r.Rule.RemoteIPPrefix,
+	}
+	if r.RemoteGroup != "" {
+		remote, err := FindGroup(sgs, r.RemoteGroup)
+		if err != nil {
+			return opts, err
+		}
+		opts.RemoteGroupID = remote.ID
+	}
+	return opts, nil
+}
+
+// Return the groups after the plan is applied. The groups to be created have their names as UUIDs,
+// and the groups in the snapshot have the rules in the snapshot.
+func (p *RestorePlan) restoredGroups(sgs []groups.SecGroup) []groups.SecGroup {
+	saved := map[string]groups.SecGroup{}
+	for _, sg := range p.Snapshot.Groups {
+		if !IsSystemGroup(sg.Name) {
+			saved[sg.Name] = sg
+		}
+	}
+
+	restored := make([]groups.SecGroup, 0, len(sgs)+len(p.CreateGroups))
+	for _, sg := range sgs {
+		if s, ok := saved[sg.Name]; ok {
+			sg.Rules = s.Rules
+		}
+		restored = append(restored, sg)
+	}
+	for _, sg := range p.CreateGroups {
+		created := sg.SecGroup
+		created.ID = created.Name
+		restored = append(restored, created)
+	}
+	return restored
+}
+
+// Check the groups referred by the plan and the policy before applying any change,
+// so that the restore doesn't stop halfway for them.
+func (p *RestorePlan) check(os *OpenStack, sgs []groups.SecGroup) error {
+	restored := p.restoredGroups(sgs)
+
+	optsList := make([]rules.CreateOpts, 0, len(p.CreateRules))
+	for _, r := range p.CreateRules {
+		opts, err := restoreRuleOpts(restored, r)
+		if err != nil {
+			return err
+		}
+		optsList = append(optsList, opts)
+	}
+	for _, port := range p.UpdatePorts {
+		for _, name := range port.After {
+			if _, err := FindGroup(restored, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	if os.Policy == nil {
+		return nil
+	}
+	if err := checkRulePolicy(os, restored, optsList); err != nil {
+		return err
+	}
+	for _, port := range p.UpdatePorts {
+		if err := checkPortPolicy(os, restored, port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore the snapshot. If dryRun is true, the changes are planned but not applied.
+//
+// The groups and the policy are checked before the first change. If applying fails halfway,
+// the plan is returned with the error, and the changes applied so far are marked as Applied.
+func RestoreSnapshot(os *OpenStack, snap *Snapshot, dryRun bool) (*RestorePlan, error) {
+	sgs, err := ListGroup(os)
+	if err != nil {
+		return nil, err
+	}
+
+	ps, err := ListPorts(os)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := PlanRestore(snap, sgs, ps)
+	if dryRun || !plan.HasChanges() {
+		return plan, nil
+	}
+	if err = plan.check(os, sgs); err != nil {
+		return nil, err
+	}
+
+	// Groups
+	for i, sg := range plan.CreateGroups {
+		if _, err = CreateGroup(os, sg.Name, sg.Description); err != nil {
+			return plan, err
+		}
+		plan.CreateGroups[i].Applied = true
+	}
+	if len(plan.CreateGroups) > 0 {
+		// The default egress rules of the new groups
+		if sgs, err = ListGroup(os); err != nil {
+			return plan, err
+		}
+		created := plan.CreateGroups
+		plan = PlanRestore(snap, sgs, ps)
+		plan.CreateGroups = created
+	}
+
+	// Rules
+	for i, r := range plan.CreateRules {
+		opts, err := restoreRuleOpts(sgs, r)
+		if err != nil {
+			return plan, err
+		}
+		if _, err = createRule(os, opts); err != nil {
+			return plan, err
+		}
+		plan.CreateRules[i].Applied = true
+	}
+	for i, r := range plan.DeleteRules {
+		if err = DeleteRule(os, r.Rule.ID); err != nil {
+			if _, ok := err.(gophercloud.ErrDefault404); !ok {
+				return plan, err
+			}
+		}
+		plan.DeleteRules[i].Applied = true
+	}
+
+	// Attachments
+	for i, p := range plan.UpdatePorts {
+		ids := make([]string, 0, len(p.After))
+		for _, name := range p.After {
+			sg, err := FindGroup(sgs, name)
+			if err != nil {
+				return plan, err
+			}
+			ids = append(ids, sg.ID)
+		}
+
+		var before []string
+		for _, port := range ps {
+			if port.ID == p.ID {
+				before = port.SecurityGroups
+			}
+		}
+		updated, err := updatePort(os, p.ID, ports.UpdateOpts{SecurityGroups: &ids})
+		os.recordPortUpdate(&JournalRecord{Operation: JOURNAL_UPDATE_PORT, VpsID: p.DeviceID}, p.ID, before, ids, updated, err)
+		if err != nil {
+			return plan, err
+		}
+		plan.UpdatePorts[i].Applied = true
+	}
+	return plan, nil
+}
+
+// Check the policy for the groups attached to and detached from the port.
+func checkPortPolicy(os *OpenStack, sgs []groups.SecGroup, p RestorePort) error {
+	vps := &Vps{ID: p.DeviceID, NameTag: p.DeviceID}
+	vpss, err := ListVps(os, func(v Vps) bool { return v.ID == p.DeviceID })
+	if err != nil {
+		return err
+	} else if len(vpss) > 0 {
+		vps = &vpss[0]
+	}
+
+	before := map[string]bool{}
+	for _, name := range p.Before {
+		before[name] = true
+	}
+	after := map[string]bool{}
+	for _, name := range p.After {
+		after[name] = true
+	}
+
+	violations := make([]PolicyViolation, 0)
+	for _, name := range p.After {
+		if !before[name] {
+			sg, err := FindGroup(sgs, name)
+			if err != nil {
+				return err
+			}
+			violations = append(violations, os.Policy.CheckAttach(vps, *sg)...)
+		}
+	}
+	for _, name := range p.Before {
+		if !after[name] {
+			violations = append(violations, os.Policy.CheckDetach(vps, name)...)
+		}
+	}
+	return os.enforcePolicy(violations)
+}
@@ -0,0 +1,196 @@
+package conoha
+
+import (
+	"io/ioutil"
+	goos "os"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+)
+
+// Use a temporary data directory during the test.
+func withDataDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "conoha-net")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	old, set := goos.LookupEnv("CONOHA_NET_HOME")
+	goos.Setenv("CONOHA_NET_HOME", dir)
+	return func() {
+		if set {
+			goos.Setenv("CONOHA_NET_HOME", old)
+		} else {
+			goos.Unsetenv("CONOHA_NET_HOME")
+		}
+		goos.RemoveAll(dir)
+	}
+}
+
+func snapshotTestData() ([]groups.SecGroup, []ports.Port) {
+	db := testRule("db-1", "in tcp/5432 from group:app")
+	db.RemoteGroupID = "app-id"
+
+	sgs := []groups.SecGroup{
+		{ID: "app-id", Name: "app", Description: "[owner=web]", Rules: []rules.SecGroupRule{testRule("app-1", "out all")}},
+		{ID: "db-id", Name: "db", Rules: []rules.SecGroupRule{db, testRule("db-2", "in tcp/22 from 10.0.0.0/8")}},
+		{ID: "sys-id", Name: "default", Rules: []rules.SecGroupRule{testRule("sys-1", "in all")}},
+	}
+	ps := []ports.Port{
+		{ID: "p1", DeviceID: "vps1", SecurityGroups: []string{"db-id", "sys-id"}},
+		{ID: "p2", DeviceID: "vps2", SecurityGroups: []string{"app-id"}},
+		{ID: "p3", DeviceID: ""},
+	}
+	return sgs, ps
+}
+
+func TestSaveSnapshot(t *testing.T) {
+	defer withDataDir(t)()
+
+	sgs, ps := snapshotTestData()
+	snap := NewSnapshot("pre-migration", sgs, ps)
+	if len(snap.Ports) != 2 || snap.Ports[0].SecurityGroups[0] != "db" || snap.Ports[0].SecurityGroups[1] != "default" {
+		t.Errorf("unexpected ports. %v", snap.Ports)
+	}
+
+	if _, err := SaveSnapshot(snap, false); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := SaveSnapshot(snap, false); err == nil {
+		t.Errorf("existing snapshot should not be overwritten")
+	}
+	if _, err := SaveSnapshot(snap, true); err != nil {
+		t.Errorf("%v", err)
+	}
+
+	loaded, err := LoadSnapshot("pre-migration")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if loaded.Version != SNAPSHOT_VERSION || len(loaded.Groups) != 3 || loaded.Groups[1].Rules[0].RemoteGroupID != "app-id" {
+		t.Errorf("unexpected snapshot. %v", loaded)
+	}
+	if loaded.Groups[0].Description != "[owner=web]" || loaded.Groups[1].Rules[1].RemoteIPPrefix != "10.0.0.0/8" {
+		t.Errorf("unexpected snapshot. %v", loaded)
+	}
+
+	if _, err = SaveSnapshot(NewSnapshot("live", sgs, ps), false); err == nil {
+		t.Errorf("live should be reserved")
+	}
+
+	snaps, err := ListSnapshots()
+	if err != nil || len(snaps) != 1 {
+		t.Errorf("a snapshot should be listed. %v %v", snaps, err)
+	}
+
+	if err = DeleteSnapshot("pre-migration"); err != nil {
+		t.Errorf("%v", err)
+	}
+	if _, err = LoadSnapshot("pre-migration"); err == nil {
+		t.Errorf("deleted snapshot should not be loaded")
+	}
+
+	for _, name := range []string{"", "../etc", ".hidden", "a/b"} {
+		if _, err = LoadSnapshot(name); err == nil {
+			t.Errorf("%q should be an invalid name", name)
+		}
+	}
+}
+
+func TestPlanRestore(t *testing.T) {
+	sgs, ps := snapshotTestData()
+	snap := NewSnapshot("before", sgs, ps)
+
+	// Nothing changed
+	if plan := PlanRestore(snap, sgs, ps); plan.HasChanges() {
+		t.Errorf("plan should be empty. %v", plan)
+	}
+
+	// app was deleted and recreated with the default rules, the rule of db was changed,
+	// and the groups of the ports were changed.
+	recreated := testRule("new-1", "out all")
+	recreated.SecGroupID = "app-id2"
+	db := testRule("db-3", "in tcp/5432 from group:app")
+	db.RemoteGroupID = "app-id2"
+
+	current := []groups.SecGroup{
+		{ID: "app-id2", Name: "app", Rules: []rules.SecGroupRule{recreated, testRule("new-2", "out ipv6 all")}},
+		{ID: "db-id", Name: "db", Rules: []rules.SecGroupRule{db, testRule("db-4", "in tcp/22")}},
+		{ID: "sys-id", Name: "default", Rules: []rules.SecGroupRule{}},
+	}
+	currentPorts := []ports.Port{
+		{ID: "p1", DeviceID: "vps1", SecurityGroups: []string{"db-id"}},
+	}
+
+	plan := PlanRestore(snap, current, currentPorts)
+	if len(plan.CreateGroups) != 0 {
+		t.Errorf("groups should be matched by name. %v", plan.CreateGroups)
+	}
+
+	// The remote group is matched by name, so db-1 is the same as db-3.
+	if len(plan.CreateRules) != 1 || plan.CreateRules[0].Rule.ID != "db-2" {
+		t.Errorf("db-2 should be created. %v", plan.CreateRules)
+	}
+	if len(plan.DeleteRules) != 2 || plan.DeleteRules[0].Rule.ID != "new-2" || plan.DeleteRules[1].Rule.ID != "db-4" {
+		t.Errorf("new-2 and db-4 should be deleted. %v", plan.DeleteRules)
+	}
+	if len(plan.UpdatePorts) != 1 || len(plan.UpdatePorts[0].After) != 2 || len(plan.UpdatePorts[0].Before) != 1 {
+		t.Errorf("groups of p1 should be restored. %v", plan.UpdatePorts)
+	}
+	if len(plan.MissingPorts) != 1 || plan.MissingPorts[0].ID != "p2" {
+		t.Errorf("p2 should be missing. %v", plan.MissingPorts)
+	}
+
+	// Deleted group
+	plan = PlanRestore(snap, current[1:], currentPorts)
+	if len(plan.CreateGroups) != 1 || plan.CreateGroups[0].Name != "app" {
+		t.Errorf("app should be created. %v", plan.CreateGroups)
+	}
+	if len(plan.CreateRules) != 3 || plan.CreateRules[0].Group != "app" || plan.CreateRules[1].RemoteGroup != "app" {
+		t.Errorf("rules of app and db should be created. %v", plan.CreateRules)
+	}
+}
+
+func TestRestorePlanCheck(t *testing.T) {
+	sgs, ps := snapshotTestData()
+	snap := NewSnapshot("before", sgs, ps)
+	current := append([]groups.SecGroup{}, sgs[1:]...)
+	currentPorts := []ports.Port{{ID: "p1", DeviceID: "vps1", SecurityGroups: []string{"sys-id"}}}
+
+	// The group to be created is referred by the rules and the ports.
+	plan := PlanRestore(snap, current, currentPorts)
+	if err := plan.check(&OpenStack{}, current); err != nil {
+		t.Errorf("%v", err)
+	}
+
+	// The policy is checked against the group to be created before any change.
+	policy, err := ParsePolicy("deny out tcp/443 to 0.0.0.0/0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err = plan.check(&OpenStack{Policy: policy}, current); err == nil {
+		t.Errorf("out all of app should violate the policy")
+	}
+
+	// Dangling remote group
+	dangling := testRule("db-5", "in tcp/3306 from group:gone")
+	dangling.RemoteGroupID = "gone-id"
+	snap.Groups[1].Rules = append(snap.Groups[1].Rules, dangling)
+	if err = PlanRestore(snap, current, currentPorts).check(&OpenStack{}, current); err == nil {
+		t.Errorf("the remote group that doesn't exist should be an error")
+	}
+}
+
+func TestPlanRestoreDescription(t *testing.T) {
+	sgs, ps := snapshotTestData()
+	snap := NewSnapshot("before", sgs, ps)
+
+	// The descriptions of the rules are not restored.
+	current, _ := snapshotTestData()
+	current[1].Rules[1].Description = "changed"
+	if plan := PlanRestore(snap, current, ps); plan.HasChanges() {
+		t.Errorf("plan should be empty. %v", plan)
+	}
+}
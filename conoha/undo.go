@@ -0,0 +1,373 @@
+package conoha
+
+import (
+	"fmt"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+)
+
+// Return whether the record has the state to undo the operation.
+func undoable(r JournalRecord) bool {
+	switch r.Operation {
+	case JOURNAL_CREATE_RULE:
+		return r.After != nil && r.After.Rule != nil
+	case JOURNAL_DELETE_RULE:
+		return r.Before != nil && r.Before.Rule != nil
+	case JOURNAL_CREATE_GROUP:
+		return r.After != nil && r.After.Group != nil
+	case JOURNAL_DELETE_GROUP:
+		return r.Before != nil && r.Before.Group != nil
+	case JOURNAL_ATTACH, JOURNAL_DETACH, JOURNAL_UPDATE_PORT:
+		return r.Before != nil && r.Before.Port != nil && r.After != nil && r.After.Port != nil
+	}
+	return false
+}
+
+// Find the record to undo from the records of the journal.
+// If id is empty, the most recent operation of the profile that succeeded and hasn't been undone is returned.
+// The operations made by undo are skipped unless they're specified by id.
+func FindUndoTarget(records []JournalRecord, profile string, id string) (*JournalRecord, error) {
+	undone := map[string]bool{}
+	for _, r := range records {
+		if r.Undo != "" {
+			undone[r.Undo] = true
+		}
+	}
+
+	if id != "" {
+		for i := range records {
+			r := &records[i]
+			if r.ID != id {
+				continue
+			}
+
+			switch {
+			case r.Profile != profile:
+				return nil, fmt.Errorf("The operation was made with another profile. [%s: %s]", id, r.Profile)
+			case r.Result != JOURNAL_OK:
+				return nil, fmt.Errorf("The operation failed, so there is nothing to undo. [%s]", id)
+			case undone[id]:
+				return nil, fmt.Errorf("The operation has already been undone. [%s]", id)
+			case !undoable(*r):
+				return nil, fmt.Errorf("The journal record has no state to undo the operation. [%s]", id)
+			}
+			return r, nil
+		}
+		return nil, fmt.Errorf("Journal record not found. [%s]", id)
+	}
+
+	for i := len(records) - 1; i >= 0; i-- {
+		r := &records[i]
+		if r.Profile == profile && r.Result == JOURNAL_OK && r.Undo == "" && !undone[r.ID] && undoable(*r) {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("No operation to undo.")
+}
+
+func findGroupByID(sgs []groups.SecGroup, id string) *groups.SecGroup {
+	for i := range sgs {
+		if sgs[i].ID == id {
+			return &sgs[i]
+		}
+	}
+	return nil
+}
+
+// Return whether a and b have the same elements.
+func sameElements(a []string, b []string) bool {
+	m := map[string]int{}
+	for _, s := range a {
+		m[s]++
+	}
+	for _, s := range b {
+		m[s]--
+	}
+	for _, n := range m {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the content keys of the rules. The remote group of self is replaced with "self".
+func ruleKeySet(sg groups.SecGroup) map[string]bool {
+	keys := map[string]bool{}
+	for _, rule := range sg.Rules {
+		if rule.RemoteGroupID == sg.ID {
+			rule.RemoteGroupID = "self"
+		}
+		keys[RuleContentKey(rule)] = true
+	}
+	return keys
+}
+
+func sameRules(a groups.SecGroup, b groups.SecGroup) bool {
+	ka, kb := ruleKeySet(a), ruleKeySet(b)
+	if len(ka) != len(kb) {
+		return false
+	}
+	for key := range ka {
+		if !kb[key] {
+			return false
+		}
+	}
+	return true
+}
+
+// Check whether the current groups or port have diverged from the state after the operation.
+// The port is required to undo attach, detach and update-port, and it's nil if the port has been deleted.
+func CheckUndo(r JournalRecord, sgs []groups.SecGroup, port *ports.Port) error {
+	if !undoable(r) {
+		return fmt.Errorf("The journal record has no state to undo the operation. [%s]", r.ID)
+	}
+
+	switch r.Operation {
+	case JOURNAL_CREATE_RULE:
+		rule := r.After.Rule
+		sg := findGroupByID(sgs, rule.SecGroupID)
+		if sg == nil {
+			return fmt.Errorf("The group of the rule has been deleted. [%s]", r.Group)
+		}
+		for _, current := range sg.Rules {
+			if current.ID == rule.ID {
+				return nil
+			}
+		}
+		return fmt.Errorf("The rule has already been deleted. [%s]", rule.ID)
+
+	case JOURNAL_DELETE_RULE:
+		rule := r.Before.Rule
+		sg := findGroupByID(sgs, rule.SecGroupID)
+		if sg == nil {
+			return fmt.Errorf("The group of the rule has been deleted. [%s]", r.Group)
+		}
+		if rule.RemoteGroupID != "" && findGroupByID(sgs, rule.RemoteGroupID) == nil {
+			return fmt.Errorf("The remote group of the rule has been deleted. [%s]", rule.RemoteGroupID)
+		}
+		key := RuleContentKey(*rule)
+		for _, current := range sg.Rules {
+			if RuleContentKey(current) == key {
+				return fmt.Errorf("The same rule has been created again. [%s]", current.ID)
+			}
+		}
+
+	case JOURNAL_CREATE_GROUP:
+		sg := findGroupByID(sgs, r.After.Group.ID)
+		if sg == nil {
+			return fmt.Errorf("The group has already been deleted. [%s]", r.Group)
+		}
+		if !sameRules(*sg, *r.After.Group) {
+			return fmt.Errorf("The rules of the group have been changed since the operation. [%s]", r.Group)
+		}
+
+	case JOURNAL_DELETE_GROUP:
+		deleted := r.Before.Group
+		if sg := findGroupByName(sgs, deleted.Name); sg != nil {
+			return fmt.Errorf("The group of the same name has been created again. [%s]", sg.ID)
+		}
+		for _, rule := range deleted.Rules {
+			if rule.RemoteGroupID != "" && rule.RemoteGroupID != deleted.ID && findGroupByID(sgs, rule.RemoteGroupID) == nil {
+				return fmt.Errorf("The remote group of the rule has been deleted. [%s]", rule.RemoteGroupID)
+			}
+		}
+		for _, rule := range r.Before.Referrers {
+			if findGroupByID(sgs, rule.SecGroupID) == nil {
+				return fmt.Errorf("The group of the rule referring to the group has been deleted. [%s]", rule.SecGroupID)
+			}
+		}
+
+	case JOURNAL_ATTACH, JOURNAL_DETACH, JOURNAL_UPDATE_PORT:
+		if port == nil {
+			return fmt.Errorf("The port has been deleted. [%s]", r.Before.Port.ID)
+		}
+		if !sameElements(port.SecurityGroups, r.After.Port.SecurityGroups) {
+			return fmt.Errorf("The groups of the port have been changed since the operation. [%s]", port.ID)
+		}
+		for _, id := range r.Before.Port.SecurityGroups {
+			if findGroupByID(sgs, id) == nil {
+				return fmt.Errorf("The group to attach again has been deleted. [%s]", id)
+			}
+		}
+	}
+	return nil
+}
+
+// Return the options to create the same rule in the group.
+func createOptsFromRule(rule rules.SecGroupRule, groupID string) rules.CreateOpts {
+	return rules.CreateOpts{
+		Direction:      rules.RuleDirection(rule.Direction),
+		Description:    rule.Description,
+		EtherType:      rules.RuleEtherType(rule.EtherType),
+		SecGroupID:     groupID,
+		PortRangeMin:   rule.PortRangeMin,
+		PortRangeMax:   rule.PortRangeMax,
+		Protocol:       rules.RuleProtocol(rule.Protocol),
+		RemoteGroupID:  rule.RemoteGroupID,
+		RemoteIPPrefix: rule.RemoteIPPrefix,
+	}
+}
+
+// Reverse the operation of the record with the recorded state.
+// It's refused if the current state has diverged from the state after the operation.
+func Undo(os *OpenStack, r *JournalRecord) error {
+	sgs, err := ListGroup(os)
+	if err != nil {
+		return err
+	}
+
+	var port *ports.Port
+	if r.Before != nil && r.Before.Port != nil {
+		if port, err = ports.Get(os.Network, r.Before.Port.ID).Extract(); err != nil {
+			if _, ok := err.(gophercloud.ErrDefault404); !ok {
+				return err
+			}
+			port = nil
+		}
+	}
+	if err = CheckUndo(*r, sgs, port); err != nil {
+		return err
+	}
+
+	// The records of the operations below refer to the undone record.
+	if os.Journal != nil {
+		os.Journal.undo = r.ID
+		defer func() { os.Journal.undo = "" }()
+	}
+
+	switch r.Operation {
+	case JOURNAL_CREATE_RULE:
+		return DeleteRule(os, r.After.Rule.ID)
+
+	case JOURNAL_DELETE_RULE:
+		opts := createOptsFromRule(*r.Before.Rule, r.Before.Rule.SecGroupID)
+		if err = checkRulePolicy(os, sgs, []rules.CreateOpts{opts}); err != nil {
+			return err
+		}
+		_, err = createRule(os, opts)
+		return err
+
+	case JOURNAL_CREATE_GROUP:
+		return DeleteGroup(os, r.After.Group.ID)
+
+	case JOURNAL_DELETE_GROUP:
+		return undoDeleteGroup(os, sgs, r.Before.Group, r.Before.Referrers)
+
+	default:
+		return undoPortUpdate(os, sgs, r)
+	}
+}
+
+// Create the deleted group again with the same rules.
+// The group has a new UUID, and the rules that refer to the group, including the rules
+// of the other groups deleted together, are remapped to it.
+// If any step fails, the new group is deleted to roll back.
+func undoDeleteGroup(os *OpenStack, sgs []groups.SecGroup, deleted *groups.SecGroup, referrers []rules.SecGroupRule) error {
+	created, err := CreateGroup(os, deleted.Name, deleted.Description)
+	if err != nil {
+		return err
+	}
+
+	if err = restoreDeletedGroup(os, sgs, deleted, referrers, created); err != nil {
+		// Rollback
+		if derr := DeleteGroup(os, created.ID); derr != nil {
+			return fmt.Errorf("%s (and failed to rollback the group. [%s])", err, created.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// Create the rules of the deleted group and the referring rules for the new group.
+func restoreDeletedGroup(os *OpenStack, sgs []groups.SecGroup, deleted *groups.SecGroup, referrers []rules.SecGroupRule, created *groups.SecGroup) error {
+	want := map[string]rules.CreateOpts{}
+	for _, rule := range deleted.Rules {
+		opts := createOptsFromRule(rule, created.ID)
+		if rule.RemoteGroupID == deleted.ID {
+			opts.RemoteGroupID = created.ID
+		}
+		want[RuleContentKey(ruleFromCreateOpts(opts))] = opts
+	}
+
+	// The default rules of the new group
+	have := map[string]bool{}
+	for _, rule := range created.Rules {
+		have[RuleContentKey(rule)] = true
+	}
+
+	optsList := make([]rules.CreateOpts, 0, len(want)+len(referrers))
+	for key, opts := range want {
+		if !have[key] {
+			optsList = append(optsList, opts)
+		}
+	}
+
+	// The rules of the other groups
+	for _, rule := range referrers {
+		opts := createOptsFromRule(rule, rule.SecGroupID)
+		opts.RemoteGroupID = created.ID
+		optsList = append(optsList, opts)
+	}
+
+	if err := checkRulePolicy(os, append(sgs, *created), optsList); err != nil {
+		return err
+	}
+
+	for _, rule := range created.Rules {
+		if _, ok := want[RuleContentKey(rule)]; !ok {
+			if err := DeleteRule(os, rule.ID); err != nil {
+				return err
+			}
+		}
+	}
+	for _, opts := range optsList {
+		if _, err := createRule(os, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replace the groups of the port with the groups before the operation.
+func undoPortUpdate(os *OpenStack, sgs []groups.SecGroup, r *JournalRecord) error {
+	before, after := r.Before.Port, r.After.Port
+
+	if os.Policy != nil {
+		names := func(ids []string) []string {
+			ns := make([]string, 0, len(ids))
+			for _, id := range ids {
+				if sg := findGroupByID(sgs, id); sg != nil {
+					ns = append(ns, sg.Name)
+				}
+			}
+			return ns
+		}
+		p := RestorePort{ID: before.ID, DeviceID: before.DeviceID, Before: names(after.SecurityGroups), After: names(before.SecurityGroups)}
+		if err := checkPortPolicy(os, sgs, p); err != nil {
+			return err
+		}
+	}
+
+	operation := JOURNAL_UPDATE_PORT
+	switch r.Operation {
+	case JOURNAL_ATTACH:
+		operation = JOURNAL_DETACH
+	case JOURNAL_DETACH:
+		operation = JOURNAL_ATTACH
+	}
+
+	ids := append([]string{}, before.SecurityGroups...)
+	updated, err := updatePort(os, before.ID, ports.UpdateOpts{SecurityGroups: &ids})
+	os.recordPortUpdate(&JournalRecord{
+		Operation: operation,
+		Group:     r.Group,
+		GroupID:   r.GroupID,
+		Vps:       r.Vps,
+		VpsID:     r.VpsID,
+	}, before.ID, after.SecurityGroups, ids, updated, err)
+	return err
+}
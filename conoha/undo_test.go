@@ -0,0 +1,139 @@
+package conoha
+
+import (
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+)
+
+func TestFindUndoTarget(t *testing.T) {
+	rule := testRule("r1", "in tcp/22")
+	port := &JournalState{Port: &JournalPort{ID: "p1", SecurityGroups: []string{"web-id"}}}
+
+	records := []JournalRecord{
+		{ID: "1", Profile: "a", Operation: JOURNAL_DELETE_RULE, Result: JOURNAL_OK, Before: &JournalState{Rule: &rule}},
+		{ID: "2", Profile: "a", Operation: JOURNAL_DETACH, Result: JOURNAL_OK, Before: port, After: port},
+		{ID: "3", Profile: "a", Operation: JOURNAL_ATTACH, Result: JOURNAL_OK, Before: port, After: port, Undo: "2"},
+		{ID: "4", Profile: "a", Operation: JOURNAL_DELETE_RULE, Result: JOURNAL_FAILED, Before: &JournalState{Rule: &rule}},
+		{ID: "5", Profile: "a", Operation: JOURNAL_DELETE_RULE, Result: JOURNAL_OK},
+		{ID: "6", Profile: "b", Operation: JOURNAL_DELETE_RULE, Result: JOURNAL_OK, Before: &JournalState{Rule: &rule}},
+	}
+
+	// 6 is another profile, 5 has no state, 4 failed, 3 is undo and 2 has been undone.
+	r, err := FindUndoTarget(records, "a", "")
+	if err != nil || r.ID != "1" {
+		t.Errorf("1 should be found. %v %v", r, err)
+	}
+
+	if r, err = FindUndoTarget(records, "a", "3"); err != nil || r.ID != "3" {
+		t.Errorf("undo should be undone if it's specified. %v %v", r, err)
+	}
+	for _, id := range []string{"2", "4", "5", "6", "7"} {
+		if _, err = FindUndoTarget(records, "a", id); err == nil {
+			t.Errorf("%s should not be undone", id)
+		}
+	}
+
+	if _, err = FindUndoTarget(records[1:5], "a", ""); err == nil {
+		t.Errorf("nothing should be undone")
+	}
+}
+
+func TestCheckUndo(t *testing.T) {
+	ssh := testRule("r1", "in tcp/22 from 10.0.0.0/8")
+	ssh.SecGroupID = "web-id"
+	egress := testRule("r2", "out all")
+	egress.SecGroupID = "web-id"
+	self := testRule("r3", "in all")
+	self.SecGroupID = "web-id"
+	self.RemoteGroupID = "web-id"
+
+	web := groups.SecGroup{ID: "web-id", Name: "web", Rules: []rules.SecGroupRule{egress}}
+	sgs := []groups.SecGroup{web, {ID: "sys-id", Name: "default"}}
+
+	cases := []struct {
+		name   string
+		record JournalRecord
+		sgs    []groups.SecGroup
+		port   *ports.Port
+		ok     bool
+	}{
+		{"deleted rule", JournalRecord{Operation: JOURNAL_DELETE_RULE, Before: &JournalState{Rule: &ssh}}, sgs, nil, true},
+		{"rule created again", JournalRecord{Operation: JOURNAL_DELETE_RULE, Before: &JournalState{Rule: &egress}}, sgs, nil, false},
+		{"group of deleted rule", JournalRecord{Operation: JOURNAL_DELETE_RULE, Before: &JournalState{Rule: &ssh}}, sgs[1:], nil, false},
+		{"remote group of deleted rule", JournalRecord{Operation: JOURNAL_DELETE_RULE, Before: &JournalState{Rule: &rules.SecGroupRule{SecGroupID: "web-id", RemoteGroupID: "app-id"}}}, sgs, nil, false},
+
+		{"created rule", JournalRecord{Operation: JOURNAL_CREATE_RULE, After: &JournalState{Rule: &egress}}, sgs, nil, true},
+		{"created rule already deleted", JournalRecord{Operation: JOURNAL_CREATE_RULE, After: &JournalState{Rule: &ssh}}, sgs, nil, false},
+
+		{"created group", JournalRecord{Operation: JOURNAL_CREATE_GROUP, After: &JournalState{Group: &web}}, sgs, nil, true},
+		{"rule added to created group", JournalRecord{Operation: JOURNAL_CREATE_GROUP, After: &JournalState{Group: &groups.SecGroup{ID: "web-id", Name: "web"}}}, sgs, nil, false},
+		{"created group already deleted", JournalRecord{Operation: JOURNAL_CREATE_GROUP, After: &JournalState{Group: &web}}, sgs[1:], nil, false},
+
+		{"deleted group", JournalRecord{Operation: JOURNAL_DELETE_GROUP, Before: &JournalState{Group: &groups.SecGroup{ID: "old-id", Name: "db", Rules: []rules.SecGroupRule{egress}}}}, sgs, nil, true},
+		{"group of same name", JournalRecord{Operation: JOURNAL_DELETE_GROUP, Before: &JournalState{Group: &groups.SecGroup{ID: "old-id", Name: "web"}}}, sgs, nil, false},
+		{"deleted group referring itself", JournalRecord{Operation: JOURNAL_DELETE_GROUP, Before: &JournalState{Group: &groups.SecGroup{ID: "web-id", Name: "web", Rules: []rules.SecGroupRule{self}}}}, sgs[1:], nil, true},
+		{"referring rule of deleted group", JournalRecord{Operation: JOURNAL_DELETE_GROUP, Before: &JournalState{Group: &groups.SecGroup{ID: "old-id", Name: "db"}, Referrers: []rules.SecGroupRule{ssh}}}, sgs, nil, true},
+		{"group of referring rule", JournalRecord{Operation: JOURNAL_DELETE_GROUP, Before: &JournalState{Group: &groups.SecGroup{ID: "old-id", Name: "db"}, Referrers: []rules.SecGroupRule{ssh}}}, sgs[1:], nil, false},
+		{"remote group of deleted group", JournalRecord{Operation: JOURNAL_DELETE_GROUP, Before: &JournalState{Group: &groups.SecGroup{ID: "old-id", Name: "db", Rules: []rules.SecGroupRule{self}}}}, sgs[1:], nil, false},
+
+		{"detach", JournalRecord{Operation: JOURNAL_DETACH,
+			Before: &JournalState{Port: &JournalPort{ID: "p1", SecurityGroups: []string{"sys-id", "web-id"}}},
+			After:  &JournalState{Port: &JournalPort{ID: "p1", SecurityGroups: []string{"sys-id"}}}},
+			sgs, &ports.Port{ID: "p1", SecurityGroups: []string{"sys-id"}}, true},
+		{"port changed", JournalRecord{Operation: JOURNAL_DETACH,
+			Before: &JournalState{Port: &JournalPort{ID: "p1", SecurityGroups: []string{"sys-id", "web-id"}}},
+			After:  &JournalState{Port: &JournalPort{ID: "p1", SecurityGroups: []string{"sys-id"}}}},
+			sgs, &ports.Port{ID: "p1", SecurityGroups: []string{}}, false},
+		{"port deleted", JournalRecord{Operation: JOURNAL_ATTACH,
+			Before: &JournalState{Port: &JournalPort{ID: "p1", SecurityGroups: []string{"sys-id"}}},
+			After:  &JournalState{Port: &JournalPort{ID: "p1", SecurityGroups: []string{"sys-id", "web-id"}}}},
+			sgs, nil, false},
+		{"detached group deleted", JournalRecord{Operation: JOURNAL_DETACH,
+			Before: &JournalState{Port: &JournalPort{ID: "p1", SecurityGroups: []string{"sys-id", "web-id"}}},
+			After:  &JournalState{Port: &JournalPort{ID: "p1", SecurityGroups: []string{"sys-id"}}}},
+			sgs[1:], &ports.Port{ID: "p1", SecurityGroups: []string{"sys-id"}}, false},
+
+		{"no state", JournalRecord{Operation: JOURNAL_DELETE_RULE}, sgs, nil, false},
+	}
+	for _, c := range cases {
+		err := CheckUndo(c.record, c.sgs, c.port)
+		if c.ok && err != nil {
+			t.Errorf("%s should be undone. %v", c.name, err)
+		} else if !c.ok && err == nil {
+			t.Errorf("%s should not be undone", c.name)
+		}
+	}
+}
+
+func TestReferringRules(t *testing.T) {
+	app := testRule("db-1", "in tcp/5432")
+	app.RemoteGroupID = "app-id"
+	self := testRule("app-1", "in all")
+	self.RemoteGroupID = "app-id"
+
+	sgs := []groups.SecGroup{
+		{ID: "app-id", Name: "app", Rules: []rules.SecGroupRule{self}},
+		{ID: "db-id", Name: "db", Rules: []rules.SecGroupRule{app, testRule("db-2", "in tcp/22")}},
+	}
+	if referrers := referringRules(sgs, "app-id"); len(referrers) != 1 || referrers[0].ID != "db-1" {
+		t.Errorf("db-1 should refer to app. %v", referrers)
+	}
+}
+
+func TestJournalUndo(t *testing.T) {
+	j, cleanup := withJournal(t)
+	defer cleanup()
+
+	j.undo = "1"
+	j.Append(&JournalRecord{Operation: JOURNAL_CREATE_RULE})
+	j.undo = ""
+	j.Append(&JournalRecord{Operation: JOURNAL_CREATE_RULE})
+
+	records, err := j.Read()
+	if err != nil || len(records) != 2 || records[0].Undo != "1" || records[1].Undo != "" {
+		t.Errorf("undone record should be set. %v %v", records, err)
+	}
+}
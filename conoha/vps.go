@@ -26,6 +26,9 @@ type AttachedPort struct {
 	PortId    string     `json:"port_id"`
 	PortState string     `json:"port_state"`
 	FixedIPs  []ports.IP `json:"fixed_ips"`
+
+	// UUIDs of the security groups of the port. It's set by PopulateVpsPorts, and nil if unknown.
+	SecurityGroups []string `json:"security_groups,omitempty"`
 }
 
 func (v *Vps) FromServer(s servers.Server) error {
@@ -0,0 +1,306 @@
+package conoha
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	goos "os"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"github.com/sirupsen/logrus"
+)
+
+// Drift of the current state from the baseline snapshot.
+type DriftEvent struct {
+	Time       time.Time    `json:"time"`
+	Baseline   string       `json:"baseline"`
+	Changes    []DiffChange `json:"changes"`
+	Violations []string     `json:"violations"`
+	Remediated bool         `json:"remediated"`
+
+	diff *SnapshotDiff
+}
+
+// Return whether the current state drifts from the baseline or violates the policy.
+func (e *DriftEvent) HasDrift() bool {
+	return len(e.Changes) > 0 || len(e.Violations) > 0
+}
+
+func (e *DriftEvent) String() string {
+	if !e.HasDrift() {
+		return fmt.Sprintf("No drift from %s.", e.Baseline)
+	}
+
+	s := fmt.Sprintf("Drift detected from %s: %d change(s), %d policy violation(s).", e.Baseline, len(e.Changes), len(e.Violations))
+	if e.Remediated {
+		s += " Remediated."
+	}
+	return s
+}
+
+// Notifier reports the drift events.
+type Notifier interface {
+	Notify(e *DriftEvent) error
+}
+
+// Write the events as text with the diff.
+type WriterNotifier struct {
+	Writer io.Writer
+}
+
+func (n *WriterNotifier) Notify(e *DriftEvent) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s\n", e.Time.Local().Format(time.RFC3339), e)
+	if e.diff != nil && len(e.Changes) > 0 {
+		buf.WriteString(e.diff.Unified())
+	}
+	for _, v := range e.Violations {
+		fmt.Fprintf(&buf, "policy: %s\n", v)
+	}
+
+	_, err := n.Writer.Write(buf.Bytes())
+	return err
+}
+
+// Append the events to the file as JSON lines.
+type JSONLinesNotifier struct {
+	File string
+}
+
+func (n *JSONLinesNotifier) Notify(e *DriftEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f, err := goos.OpenFile(n.File, goos.O_APPEND|goos.O_CREATE|goos.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// POST the events to the URL as JSON.
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (n *WebhookNotifier) Notify(e *DriftEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	resp, err := client.Post(n.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook returned an error. [%s: %s]", n.URL, resp.Status)
+	}
+	return nil
+}
+
+// Create the notifier from the spec. ("stdout", "jsonl:<file>" or "webhook:<url>")
+func NewNotifier(spec string) (Notifier, error) {
+	kind, arg := spec, ""
+	if p := strings.Index(spec, ":"); p >= 0 {
+		kind, arg = spec[:p], spec[p+1:]
+	}
+
+	switch kind {
+	case "stdout":
+		return &WriterNotifier{Writer: goos.Stdout}, nil
+	case "jsonl":
+		if arg == "" {
+			return nil, fmt.Errorf(`Must specify the file of the notifier. (e.g. "jsonl:/var/log/conoha-net/drift.jsonl")`)
+		}
+		return &JSONLinesNotifier{File: arg}, nil
+	case "webhook":
+		if !strings.HasPrefix(arg, "http://") && !strings.HasPrefix(arg, "https://") {
+			return nil, fmt.Errorf(`Must specify the URL of the webhook. (e.g. "webhook:https://example.com/hook") [%s]`, arg)
+		}
+		return &WebhookNotifier{URL: arg}, nil
+	}
+	return nil, fmt.Errorf(`Notifier must be either "stdout", "jsonl:<file>" or "webhook:<url>". [%s]`, spec)
+}
+
+// Watcher detects the drift from the baseline snapshot and the policy violations.
+type Watcher struct {
+	Baseline  *Snapshot
+	Policy    *Policy
+	Notifiers []Notifier
+
+	// Restore the baseline when the drift is detected.
+	Remediate bool
+
+	// The last notified drift, to notify only the changes of the drift.
+	last string
+
+	// Functions to restore the baseline and to evaluate the current state.
+	// RestoreSnapshot and Watcher.current are used if they're nil.
+	restore  func(os *OpenStack, snap *Snapshot, dryRun bool) (*RestorePlan, error)
+	evaluate func(os *OpenStack) (*DriftEvent, error)
+}
+
+// Compare the groups, ports and VPS with the baseline and the policy.
+func (w *Watcher) Evaluate(sgs []groups.SecGroup, ps []ports.Port, vpss []Vps) *DriftEvent {
+	d := DiffSnapshots(w.Baseline, NewSnapshot("live", sgs, ps))
+	e := &DriftEvent{
+		Time:       time.Now(),
+		Baseline:   w.Baseline.Name,
+		Changes:    d.Changes,
+		Violations: []string{},
+		diff:       d,
+	}
+
+	if w.Policy != nil {
+		for _, v := range w.Policy.CheckState(sgs, vpss) {
+			e.Violations = append(e.Violations, v.String())
+		}
+	}
+	return e
+}
+
+// Check the current state, and report the drift.
+func (w *Watcher) Check(os *OpenStack) (*DriftEvent, error) {
+	e, err := w.current(os)
+	if err != nil {
+		return nil, err
+	}
+	return e, w.handle(os, e)
+}
+
+// Evaluate the current groups, ports and VPS.
+func (w *Watcher) current(os *OpenStack) (*DriftEvent, error) {
+	sgs, err := ListGroup(os)
+	if err != nil {
+		return nil, err
+	}
+
+	vpss, err := ListVps(os, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ps, err := ListPorts(os)
+	if err != nil {
+		return nil, err
+	}
+
+	return w.Evaluate(sgs, ps, vpss), nil
+}
+
+// Return the fingerprint of the drift to compare with the last one. It's empty if there is no drift.
+func driftFingerprint(e *DriftEvent) (string, error) {
+	if !e.HasDrift() {
+		return "", nil
+	}
+
+	b, err := json.Marshal(struct {
+		Changes    []DiffChange
+		Violations []string
+	}{e.Changes, e.Violations})
+	return string(b), err
+}
+
+// Remediate and notify the drift if it's changed since the last check.
+//
+// The drift is remediated only when restoring the baseline has changes to apply,
+// since some changes such as the descriptions of the rules can't be restored.
+// The drift that remains after remediation is remembered, so that it's not notified again.
+func (w *Watcher) handle(os *OpenStack, e *DriftEvent) error {
+	fingerprint, err := driftFingerprint(e)
+	if err != nil {
+		return err
+	}
+	if fingerprint == w.last {
+		return nil
+	}
+
+	if w.Remediate && len(e.Changes) > 0 {
+		fingerprint = w.remediate(os, e, fingerprint)
+	}
+	w.last = fingerprint
+
+	return w.notify(e)
+}
+
+// Restore the baseline, and return the fingerprint of the drift after that.
+func (w *Watcher) remediate(os *OpenStack, e *DriftEvent, fingerprint string) string {
+	restore, evaluate := w.restore, w.evaluate
+	if restore == nil {
+		restore = RestoreSnapshot
+	}
+	if evaluate == nil {
+		evaluate = w.current
+	}
+
+	plan, err := restore(os, w.Baseline, false)
+	if err != nil {
+		logrus.Errorf("Failed to remediate the drift: %s", err)
+		return fingerprint
+	} else if !plan.HasChanges() {
+		return fingerprint
+	}
+	e.Remediated = true
+
+	after, err := evaluate(os)
+	if err != nil {
+		logrus.Errorf("Failed to check the remediated state: %s", err)
+		return fingerprint
+	}
+	remains, err := driftFingerprint(after)
+	if err != nil {
+		return fingerprint
+	}
+	return remains
+}
+
+// Notify the event by all notifiers.
+func (w *Watcher) notify(e *DriftEvent) error {
+	var first error
+	for _, n := range w.Notifiers {
+		if err := n.Notify(e); err != nil {
+			logrus.Errorf("Failed to notify: %s", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// Check the state every interval until stop is closed. The errors are logged and the watch continues.
+func (w *Watcher) Run(os *OpenStack, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := w.Check(os); err != nil {
+			logrus.Errorf("%s", err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package conoha
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	goos "os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+)
+
+func TestNewNotifier(t *testing.T) {
+	n, err := NewNotifier("stdout")
+	if _, ok := n.(*WriterNotifier); !ok || err != nil {
+		t.Errorf("WriterNotifier should be created. %v", err)
+	}
+
+	n, err = NewNotifier("jsonl:/tmp/drift.jsonl")
+	if j, ok := n.(*JSONLinesNotifier); !ok || err != nil || j.File != "/tmp/drift.jsonl" {
+		t.Errorf("JSONLinesNotifier should be created. %v", err)
+	}
+
+	n, err = NewNotifier("webhook:https://example.com/hook?a=b")
+	if w, ok := n.(*WebhookNotifier); !ok || err != nil || w.URL != "https://example.com/hook?a=b" {
+		t.Errorf("WebhookNotifier should be created. %v", err)
+	}
+
+	for _, spec := range []string{"", "jsonl", "jsonl:", "webhook:example.com", "mail:ops@example.com"} {
+		if _, err = NewNotifier(spec); err == nil {
+			t.Errorf("%q should be an invalid notifier", spec)
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	sgs, ps := snapshotTestData()
+	policy, err := ParsePolicy("deny in tcp/22 from 0.0.0.0/0\n")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	var buf bytes.Buffer
+	w := &Watcher{
+		Baseline:  NewSnapshot("baseline", sgs, ps),
+		Policy:    policy,
+		Notifiers: []Notifier{&WriterNotifier{Writer: &buf}},
+	}
+
+	// No drift is not notified.
+	e := w.Evaluate(sgs, ps, []Vps{})
+	if e.HasDrift() {
+		t.Errorf("no drift should be detected. %v", e.Changes)
+	}
+	if err = w.handle(nil, e); err != nil || buf.Len() != 0 {
+		t.Errorf("no drift should not be notified. %s %v", buf.String(), err)
+	}
+
+	// SSH from any was added to db.
+	drifted := append([]groups.SecGroup{}, sgs...)
+	drifted[1].Rules = append([]rules.SecGroupRule{testRule("db-9", "in tcp/22")}, sgs[1].Rules...)
+
+	e = w.Evaluate(drifted, ps, []Vps{})
+	if len(e.Changes) != 1 || e.Changes[0].Rule != "in tcp/22" || len(e.Violations) != 1 {
+		t.Fatalf("a change and a violation should be detected. %v %v", e.Changes, e.Violations)
+	}
+	if err = w.handle(nil, e); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, l := range []string{"1 change(s), 1 policy violation(s)", "@@ group db @@\n+in tcp/22\n", "policy: "} {
+		if !strings.Contains(buf.String(), l) {
+			t.Errorf("%q should be notified.\n%s", l, buf.String())
+		}
+	}
+
+	// The same drift is notified once.
+	buf.Reset()
+	if err = w.handle(nil, w.Evaluate(drifted, ps, []Vps{})); err != nil || buf.Len() != 0 {
+		t.Errorf("the same drift should not be notified again. %s %v", buf.String(), err)
+	}
+
+	// The recovery is notified.
+	if err = w.handle(nil, w.Evaluate(sgs, ps, []Vps{})); err != nil || !strings.Contains(buf.String(), "No drift from baseline.") {
+		t.Errorf("the recovery should be notified. %s %v", buf.String(), err)
+	}
+}
+
+func TestJSONLinesNotifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conoha-net")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer goos.RemoveAll(dir)
+
+	n := &JSONLinesNotifier{File: filepath.Join(dir, "drift.jsonl")}
+	for _, name := range []string{"a", "b"} {
+		if err = n.Notify(&DriftEvent{Baseline: name, Changes: []DiffChange{{Kind: DIFF_GROUP, Op: DIFF_ADDED, Group: "web"}}}); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	b, err := ioutil.ReadFile(n.File)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("2 events should be appended. %s", b)
+	}
+
+	var e DriftEvent
+	if err = json.Unmarshal([]byte(lines[1]), &e); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if e.Baseline != "b" || len(e.Changes) != 1 || e.Changes[0].Group != "web" {
+		t.Errorf("unexpected event. %v", e)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var received DriftEvent
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request. %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("%v", err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	n := &WebhookNotifier{URL: server.URL}
+	if err := n.Notify(&DriftEvent{Baseline: "baseline", Violations: []string{"deny"}}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if received.Baseline != "baseline" || len(received.Violations) != 1 {
+		t.Errorf("unexpected event. %v", received)
+	}
+
+	status = http.StatusInternalServerError
+	if err := n.Notify(&DriftEvent{Baseline: "baseline"}); err == nil {
+		t.Errorf("error status should be an error")
+	}
+}
+
+func TestWatcherRemediate(t *testing.T) {
+	sgs, ps := snapshotTestData()
+
+	var buf bytes.Buffer
+	w := &Watcher{
+		Baseline:  NewSnapshot("baseline", sgs, ps),
+		Notifiers: []Notifier{&WriterNotifier{Writer: &buf}},
+		Remediate: true,
+	}
+
+	live := sgs
+	restored := 0
+	w.restore = func(os *OpenStack, snap *Snapshot, dryRun bool) (*RestorePlan, error) {
+		plan := PlanRestore(snap, live, ps)
+		if plan.HasChanges() {
+			restored++
+			live = sgs
+		}
+		return plan, nil
+	}
+	w.evaluate = func(os *OpenStack) (*DriftEvent, error) {
+		return w.Evaluate(live, ps, []Vps{}), nil
+	}
+
+	// The description of the rule can't be restored, so the drift is notified once without remediation.
+	live, _ = snapshotTestData()
+	live[1].Rules[1].Description = "changed"
+	for i := 0; i < 3; i++ {
+		e := w.Evaluate(live, ps, []Vps{})
+		if len(e.Changes) != 1 {
+			t.Fatalf("the description should be changed. %v", e.Changes)
+		}
+		if err := w.handle(nil, e); err != nil || e.Remediated {
+			t.Errorf("the description should not be remediated. %v", err)
+		}
+	}
+	if restored != 0 || strings.Count(buf.String(), "1 change(s)") != 1 {
+		t.Errorf("the drift should be notified once. %d\n%s", restored, buf.String())
+	}
+
+	// The added rule is remediated.
+	buf.Reset()
+	live, _ = snapshotTestData()
+	live[1].Rules = append(live[1].Rules, testRule("db-9", "in tcp/22"))
+	e := w.Evaluate(live, ps, []Vps{})
+	if err := w.handle(nil, e); err != nil || !e.Remediated || restored != 1 || w.last != "" {
+		t.Errorf("the drift should be remediated. %v %v", e.Changes, err)
+	}
+	if !strings.Contains(buf.String(), "Remediated.") {
+		t.Errorf("the remediation should be notified.\n%s", buf.String())
+	}
+}
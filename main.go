@@ -30,6 +30,15 @@ func run() error {
 			Usage: `specify output type. must be either "text" or "json".`,
 			Value: "text",
 		},
+		cli.StringFlag{
+			Name:   "policy",
+			Usage:  "policy file enforced before changing security groups.",
+			EnvVar: "CONOHA_NET_POLICY",
+		},
+		cli.StringFlag{
+			Name:  "override-policy",
+			Usage: "override the policy with the reason. the violations are logged.",
+		},
 	}
 
 	// debug